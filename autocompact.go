@@ -0,0 +1,235 @@
+//  Copyright (c) 2014 Marty Schoch
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package gouchstore
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Fragmentation returns the fraction of the file which is no longer used.
+func (d *DatabaseInfo) Fragmentation() float64 {
+	if d.FileSize == 0 || d.SpaceUsed >= d.FileSize {
+		return 0
+	}
+	return 1 - float64(d.SpaceUsed)/float64(d.FileSize)
+}
+
+// WastedBytes returns the number of bytes in the file which are no longer used.
+func (d *DatabaseInfo) WastedBytes() uint64 {
+	if d.SpaceUsed >= d.FileSize {
+		return 0
+	}
+	return d.FileSize - d.SpaceUsed
+}
+
+// AutoCompactConfig describes when an AutoCompactor compacts.
+type AutoCompactConfig struct {
+	// Interval is how often the database is checked.
+	Interval time.Duration
+
+	// Compaction is needed once the fragmentation reaches
+	// FragmentationThreshold, or the wasted bytes reach
+	// WastedBytesThreshold.  A zero threshold is not checked.
+	FragmentationThreshold float64
+	WastedBytesThreshold   uint64
+
+	// MinFileSize keeps small files from being compacted over and over.
+	MinFileSize uint64
+
+	// WindowStart and WindowEnd limit compaction to a time of day, as
+	// durations since midnight local time.  The window may span midnight,
+	// if both are zero compaction may run at any time.
+	WindowStart time.Duration
+	WindowEnd   time.Duration
+
+	// MinInterval is the least time between the start of two compactions.
+	MinInterval time.Duration
+
+	// TempDir is where the compacted file is written, it must be on the
+	// same filesystem as the database.  The default is the database directory.
+	TempDir string
+
+	// OnCompactionStart is called before compacting, and OnCompactionDone
+	// after, with the outcome.  They are called without holding the lock.
+	OnCompactionStart func(info *DatabaseInfo)
+	OnCompactionDone  func(result *AutoCompactResult)
+
+	// OnCompactionProgress is called as the documents are copied, as
+	// described by CompactOptions.Progress.
+	OnCompactionProgress func(progress CompactProgress)
+}
+
+// AutoCompactResult describes one compaction run by an AutoCompactor.
+type AutoCompactResult struct {
+	Start      time.Time
+	End        time.Time
+	SizeBefore uint64
+	SizeAfter  uint64
+	Err        error
+}
+
+// AutoCompactor compacts a database in the background when it becomes too fragmented.
+type AutoCompactor struct {
+	db        *Gouchstore
+	config    AutoCompactConfig
+	lock      sync.Locker
+	lastStart time.Time
+	lastErr   error
+	ctx       context.Context
+	cancel    context.CancelFunc
+	done      chan struct{}
+}
+
+// StartAutoCompactor starts checking the database every config.Interval,
+// compacting it with CompactLive when it needs it.
+//
+// Gouchstore handles are not safe for concurrent use, the compactor holds
+// lock while it uses the handle, so callers must hold the same lock whenever
+// they use the handle.
+func (g *Gouchstore) StartAutoCompactor(config AutoCompactConfig, lock sync.Locker) (*AutoCompactor, error) {
+	if config.Interval <= 0 || config.FragmentationThreshold < 0 || config.FragmentationThreshold > 1 ||
+		config.MinInterval < 0 || config.WindowStart < 0 || config.WindowStart >= 24*time.Hour ||
+		config.WindowEnd < 0 || config.WindowEnd > 24*time.Hour {
+		return nil, ErrInvalidArguments
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	rv := &AutoCompactor{
+		db:     g,
+		config: config,
+		lock:   lock,
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go rv.run()
+	return rv, nil
+}
+
+func (c *AutoCompactor) run() {
+	defer close(c.done)
+	ticker := time.NewTicker(c.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case now := <-ticker.C:
+			if c.ctx.Err() != nil {
+				// stopped while a tick was pending
+				return
+			}
+			c.lock.Lock()
+			info, err := c.db.DatabaseInfo()
+			c.lock.Unlock()
+			if err != nil {
+				// the handle was closed
+				return
+			}
+			if c.shouldCompact(info, now) {
+				c.compact(info, now)
+			}
+		}
+	}
+}
+
+// shouldCompact decides whether the database described by info needs
+// compacting, and may be compacted at now.
+func (c *AutoCompactor) shouldCompact(info *DatabaseInfo, now time.Time) bool {
+	if info.FileSize < c.config.MinFileSize {
+		return false
+	}
+	needed := (c.config.FragmentationThreshold > 0 && info.Fragmentation() >= c.config.FragmentationThreshold) ||
+		(c.config.WastedBytesThreshold > 0 && info.WastedBytes() >= c.config.WastedBytesThreshold)
+	if !needed {
+		return false
+	}
+	if !c.lastStart.IsZero() && now.Sub(c.lastStart) < c.config.MinInterval {
+		return false
+	}
+	return c.inWindow(now)
+}
+
+func (c *AutoCompactor) inWindow(now time.Time) bool {
+	start, end := c.config.WindowStart, c.config.WindowEnd
+	if start == 0 && end == 0 {
+		return true
+	}
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	sinceMidnight := now.Sub(midnight)
+	if start <= end {
+		return sinceMidnight >= start && sinceMidnight < end
+	}
+	// the window spans midnight
+	return sinceMidnight >= start || sinceMidnight < end
+}
+
+func (c *AutoCompactor) compact(info *DatabaseInfo, now time.Time) {
+	c.lastStart = now
+	result := &AutoCompactResult{
+		Start:      time.Now(),
+		SizeBefore: info.FileSize,
+	}
+	if c.config.OnCompactionStart != nil {
+		c.config.OnCompactionStart(info)
+	}
+
+	result.Err = c.compactToTemp()
+	if result.Err == nil {
+		c.lock.Lock()
+		var after *DatabaseInfo
+		after, result.Err = c.db.DatabaseInfo()
+		c.lock.Unlock()
+		if result.Err == nil {
+			result.SizeAfter = after.FileSize
+		}
+	}
+	result.End = time.Now()
+	c.lastErr = result.Err
+	if result.Err != nil {
+		c.db.logf("gouchstore: auto compaction of %s failed: %v", c.db.filename, result.Err)
+	}
+	if c.config.OnCompactionDone != nil {
+		c.config.OnCompactionDone(result)
+	}
+}
+
+func (c *AutoCompactor) compactToTemp() error {
+	dir := c.config.TempDir
+	if dir == "" {
+		dir = filepath.Dir(c.db.filename)
+	}
+	tempFile, err := ioutil.TempFile(dir, filepath.Base(c.db.filename)+".compact-")
+	if err != nil {
+		return err
+	}
+	tempFilename := tempFile.Name()
+	tempFile.Close()
+
+	options := &CompactOptions{Progress: c.config.OnCompactionProgress}
+	err = c.db.CompactLiveWithOptions(c.ctx, tempFilename, c.lock, options)
+	if err != nil {
+		os.Remove(tempFilename)
+	}
+	return err
+}
+
+// Stop stops the compactor, cancelling a compaction in progress, and waits
+// for it to return.  It returns the error of the last compaction, if it
+// failed, a cancelled compaction fails with context.Canceled.
+func (c *AutoCompactor) Stop() error {
+	c.cancel()
+	<-c.done
+	return c.lastErr
+}
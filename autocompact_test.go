@@ -0,0 +1,225 @@
+//  Copyright (c) 2014 Marty Schoch
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package gouchstore
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAutoCompactShouldCompact(t *testing.T) {
+	fragmented := &DatabaseInfo{FileSize: 10000, SpaceUsed: 4000}
+	compact := &DatabaseInfo{FileSize: 10000, SpaceUsed: 9000}
+	at := func(hour int) time.Time {
+		return time.Date(2014, 6, 1, hour, 30, 0, 0, time.Local)
+	}
+
+	tests := []struct {
+		config AutoCompactConfig
+		info   *DatabaseInfo
+		now    time.Time
+		should bool
+	}{
+		{AutoCompactConfig{FragmentationThreshold: 0.5}, fragmented, at(12), true},
+		{AutoCompactConfig{FragmentationThreshold: 0.5}, compact, at(12), false},
+		{AutoCompactConfig{WastedBytesThreshold: 1000}, compact, at(12), true},
+		{AutoCompactConfig{WastedBytesThreshold: 1001}, compact, at(12), false},
+		{AutoCompactConfig{FragmentationThreshold: 0.5, MinFileSize: 20000}, fragmented, at(12), false},
+		{AutoCompactConfig{FragmentationThreshold: 0.5, WindowStart: 1 * time.Hour, WindowEnd: 5 * time.Hour}, fragmented, at(3), true},
+		{AutoCompactConfig{FragmentationThreshold: 0.5, WindowStart: 1 * time.Hour, WindowEnd: 5 * time.Hour}, fragmented, at(12), false},
+		{AutoCompactConfig{FragmentationThreshold: 0.5, WindowStart: 22 * time.Hour, WindowEnd: 2 * time.Hour}, fragmented, at(23), true},
+		{AutoCompactConfig{FragmentationThreshold: 0.5, WindowStart: 22 * time.Hour, WindowEnd: 2 * time.Hour}, fragmented, at(1), true},
+		{AutoCompactConfig{FragmentationThreshold: 0.5, WindowStart: 22 * time.Hour, WindowEnd: 2 * time.Hour}, fragmented, at(12), false},
+	}
+	for i, test := range tests {
+		c := &AutoCompactor{config: test.config}
+		if c.shouldCompact(test.info, test.now) != test.should {
+			t.Errorf("%d: expected should compact %t", i, test.should)
+		}
+	}
+
+	// rate limited
+	c := &AutoCompactor{config: AutoCompactConfig{FragmentationThreshold: 0.5, MinInterval: time.Hour}, lastStart: at(12)}
+	if c.shouldCompact(fragmented, at(12).Add(30*time.Minute)) {
+		t.Errorf("expected compaction to be rate limited")
+	}
+	if !c.shouldCompact(fragmented, at(13)) {
+		t.Errorf("expected compaction after the minimum interval")
+	}
+}
+
+func TestAutoCompactor(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "test.couch")
+	db, err := Open(filename, OPEN_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 5; i++ {
+		err = saveNumberedDocs(db, 0, 200)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var lock sync.Mutex
+	started := make(chan *DatabaseInfo, 1)
+	results := make(chan *AutoCompactResult, 1)
+	var progress []CompactProgress
+	_, err = db.StartAutoCompactor(AutoCompactConfig{}, &lock)
+	if err != ErrInvalidArguments {
+		t.Errorf("expected invalid arguments without an interval, got %v", err)
+	}
+	compactor, err := db.StartAutoCompactor(AutoCompactConfig{
+		Interval:               10 * time.Millisecond,
+		FragmentationThreshold: 0.5,
+		MinInterval:            time.Hour,
+		OnCompactionStart: func(info *DatabaseInfo) {
+			started <- info
+		},
+		OnCompactionDone: func(result *AutoCompactResult) {
+			results <- result
+		},
+		OnCompactionProgress: func(p CompactProgress) {
+			progress = append(progress, p)
+		},
+	}, &lock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var info *DatabaseInfo
+	var result *AutoCompactResult
+	select {
+	case info = <-started:
+		result = <-results
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected compaction to start")
+	}
+	err = compactor.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Err != nil {
+		t.Fatal(result.Err)
+	}
+	if info.Fragmentation() < 0.5 {
+		t.Errorf("expected fragmentation of at least 0.5, got %f", info.Fragmentation())
+	}
+	if result.SizeBefore != info.FileSize || result.SizeAfter >= result.SizeBefore {
+		t.Errorf("expected the file to shrink, from %d to %d", result.SizeBefore, result.SizeAfter)
+	}
+	// the progress callbacks happen before OnCompactionDone
+	if len(progress) == 0 {
+		t.Errorf("expected progress to be reported")
+	} else if last := progress[len(progress)-1]; last.DocsCopied != last.DocsTotal || last.DocsTotal != 200 {
+		t.Errorf("expected 200 of 200 documents copied, got %d of %d", last.DocsCopied, last.DocsTotal)
+	}
+	if result.End.Before(result.Start) {
+		t.Errorf("expected end after start, got %v and %v", result.Start, result.End)
+	}
+
+	// the temporary file was swapped in
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected just the database file, got %d files", len(entries))
+	}
+	dbInfo, err := db.DatabaseInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dbInfo.FileSize != result.SizeAfter || dbInfo.DocumentCount != 200 {
+		t.Errorf("expected 200 documents in %d bytes, got %d in %d", result.SizeAfter, dbInfo.DocumentCount, dbInfo.FileSize)
+	}
+}
+
+func TestAutoCompactorStopCancelsCompaction(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "test.couch")
+	db, err := Open(filename, OPEN_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 5; i++ {
+		err = saveNumberedDocs(db, 0, 200)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	before, err := db.DatabaseInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lock sync.Mutex
+	copying := make(chan struct{})
+	results := make(chan *AutoCompactResult, 1)
+	compactors := make(chan *AutoCompactor, 1)
+	var once sync.Once
+	compactor, err := db.StartAutoCompactor(AutoCompactConfig{
+		Interval:               10 * time.Millisecond,
+		FragmentationThreshold: 0.5,
+		OnCompactionDone: func(result *AutoCompactResult) {
+			results <- result
+		},
+		OnCompactionProgress: func(p CompactProgress) {
+			// hold the compaction until Stop is called
+			once.Do(func() {
+				close(copying)
+				<-(<-compactors).ctx.Done()
+			})
+		},
+	}, &lock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compactors <- compactor
+
+	select {
+	case <-copying:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected compaction to start")
+	}
+	err = compactor.Stop()
+	if err != context.Canceled {
+		t.Errorf("expected the compaction to be cancelled, got %v", err)
+	}
+	result := <-results
+	if result.Err != context.Canceled {
+		t.Errorf("expected the result to be cancelled, got %v", result.Err)
+	}
+
+	// the database is unchanged and the temporary file removed
+	lock.Lock()
+	after, err := db.DatabaseInfo()
+	lock.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.FileSize != before.FileSize {
+		t.Errorf("expected the file size to stay %d, got %d", before.FileSize, after.FileSize)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected just the database file, got %d files", len(entries))
+	}
+}
@@ -59,6 +59,13 @@ func encode_raw48(val interface{}) []byte {
 	return bufbytes[len(bufbytes)-6:]
 }
 
+func encode_raw64(val interface{}) []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, val)
+	bufbytes := buf.Bytes()
+	return bufbytes[len(bufbytes)-8:]
+}
+
 func decode_raw08(raw []byte) uint8 {
 	var rv uint8
 	buf := bytes.NewBuffer(raw)
@@ -90,6 +97,13 @@ func decode_raw32(raw []byte) uint32 {
 	return rv
 }
 
+func decode_raw64(raw []byte) uint64 {
+	var rv uint64
+	buf := bytes.NewBuffer(raw)
+	binary.Read(buf, binary.BigEndian, &rv)
+	return rv
+}
+
 func decode_raw48(raw []byte) uint64 {
 	var rv uint64
 	buf := bytes.NewBuffer([]byte{0, 0})
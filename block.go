@@ -18,25 +18,26 @@ const (
 	gs_BLOCK_INVALID byte = 0xff
 )
 
+// seekPreviousBlockFrom returns the start of the block before pos and the
+// type of that block, or -1 when there are no more blocks.
 func (g *Gouchstore) seekPreviousBlockFrom(pos int64) (int64, byte, error) {
 	pos -= 1 // need to move back at least one byte
+	if pos < 0 {
+		return -1, gs_BLOCK_INVALID, nil
+	}
 	pos -= pos % gs_BLOCK_SIZE
-	for ; pos >= 0; pos -= gs_BLOCK_SIZE {
-		var err error
-		buf := make([]byte, 1)
-		n, err := g.ops.ReadAt(g.file, buf, pos)
-		if n != 1 || err != nil {
-			return -1, gs_BLOCK_INVALID, err
-		}
-		if buf[0] == gs_BLOCK_HEADER {
-			return pos, gs_BLOCK_HEADER, nil
-		} else if buf[0] == gs_BLOCK_DATA {
-			return pos, gs_BLOCK_DATA, nil
-		} else {
-			return -1, gs_BLOCK_INVALID, nil
-		}
+	buf := make([]byte, 1)
+	n, err := g.ops.ReadAt(g.file, buf, pos)
+	if n != 1 || err != nil {
+		return -1, gs_BLOCK_INVALID, err
+	}
+	if buf[0] == gs_BLOCK_HEADER {
+		return pos, gs_BLOCK_HEADER, nil
+	} else if buf[0] == gs_BLOCK_DATA {
+		return pos, gs_BLOCK_DATA, nil
 	}
-	return -1, gs_BLOCK_INVALID, nil
+	// skip over blocks with a damaged marker
+	return pos, gs_BLOCK_INVALID, nil
 }
 
 func (g *Gouchstore) seekLastHeaderBlockFrom(pos int64) (int64, error) {
@@ -46,6 +47,9 @@ func (g *Gouchstore) seekLastHeaderBlockFrom(pos int64) (int64, error) {
 		if err != nil {
 			return -1, err
 		}
+		if pos < 0 {
+			return -1, corruptAt(0, CHUNK_TYPE_HEADER, ErrNoHeader)
+		}
 	}
 	return pos, nil
 }
@@ -9,10 +9,6 @@
 
 package gouchstore
 
-import (
-	"errors"
-)
-
 // Interface for writing bulk data into couchstore.
 // Migrated to facilitate Seriesly, re-evaluate overall API
 
@@ -43,15 +39,13 @@ func (b *bulkWriter) Close() error {
 	return nil
 }
 
-var errClosed = errors.New("db is closed")
-
 func (b *bulkWriter) Commit() error {
 	ch := make(chan error)
 	select {
 	case b.commit <- ch:
 		return <-ch
 	case <-b.quit:
-		return errClosed
+		return ErrClosed
 	}
 }
 
@@ -0,0 +1,225 @@
+//  Copyright (c) 2014 Marty Schoch
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package gouchstore
+
+import (
+	"io"
+	"sort"
+)
+
+// BulkLoadIterator supplies the documents for BulkLoad.
+type BulkLoadIterator interface {
+	// Next returns the next document, or io.EOF when there are no more.
+	// doc is nil for a deleted document.
+	Next() (doc *Document, docInfo *DocumentInfo, err error)
+}
+
+// BulkLoad fills an empty database with the documents from docs, in any
+// order, and the local documents localDocs.  The bodies are written in the
+// order given, and assigned sequence numbers in that order, then each index
+// is built once, bottom up, so the file is as compact as after compaction.
+// The by-id and by-expiry indexes are sorted with
+// Options.CompactionTreeWriter.
+//
+// Every document ID must be unique, ErrDuplicateID is returned otherwise.
+// Like SaveDocuments nothing is committed, and if BulkLoad fails the
+// database is left empty.
+func (g *Gouchstore) BulkLoad(docs BulkLoadIterator, localDocs []*LocalDocument) error {
+	err := g.checkWritable()
+	if err != nil {
+		return err
+	}
+	builder, err := g.newIndexBuilder()
+	if err != nil {
+		return err
+	}
+	defer builder.close()
+	for {
+		doc, docInfo, err := docs.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		batch, batchInfos := []*Document{doc}, []*DocumentInfo{docInfo}
+		err = g.checkDocuments(batch, batchInfos)
+		if err != nil {
+			return err
+		}
+		err = g.applyJSONMode(batch, batchInfos)
+		if err != nil {
+			return err
+		}
+
+		seq := builder.seq + 1
+		seqterm, idterm, seqval, idval, err := g.addDocToUpdateList(doc, docInfo, seq)
+		if err != nil {
+			return err
+		}
+		err = builder.add(seqterm, seqval, idterm, idval, docInfo.Expiry(), doc == nil || docInfo.Deleted)
+		if err != nil {
+			return err
+		}
+		docInfo.Seq = seq
+	}
+
+	err = builder.finish()
+	if err != nil {
+		return err
+	}
+	localDocsRoot, err := g.bulkLoadLocalDocs(localDocs)
+	if err != nil {
+		return err
+	}
+	builder.apply()
+	g.header.localDocsRoot = localDocsRoot
+	return nil
+}
+
+// indexBuilder builds the indexes of an empty database bottom up, from
+// documents added in sequence order.
+type indexBuilder struct {
+	g          *Gouchstore
+	seq        uint64
+	seqMr      *modifyResult
+	tw         TreeWriter
+	expiryTw   TreeWriter
+	bySeqRoot  *nodePointer
+	byIdRoot   *nodePointer
+	expiryRoot *nodePointer
+}
+
+func (g *Gouchstore) newIndexBuilder() (*indexBuilder, error) {
+	if g.header.updateSeq != 0 || g.header.byIdRoot != nil || g.header.bySeqRoot != nil || g.header.localDocsRoot != nil {
+		return nil, ErrNotEmpty
+	}
+	rv := &indexBuilder{
+		g:     g,
+		seqMr: newBtreeModifyResult(gouchstoreSeqComparator, bySeqReduce, bySeqReReduce, nil, g.thresholds.BySeq.KV, g.thresholds.BySeq.KP),
+	}
+	var err error
+	reduce, rereduce := g.byIdReducers()
+	rv.tw, err = g.options.CompactionTreeWriter(gouchstoreIdComparator, reduce, rereduce, nil)
+	if err != nil {
+		return nil, err
+	}
+	if g.expiry {
+		rv.expiryTw, err = g.options.CompactionTreeWriter(gouchstoreIdComparator, bySeqReduce, bySeqReReduce, nil)
+		if err != nil {
+			rv.tw.Close()
+			return nil, err
+		}
+	}
+	return rv, nil
+}
+
+// add adds the next document, seqterm must be the next sequence number.
+func (b *indexBuilder) add(seqterm, seqval, idterm, idval []byte, expiry uint32, deleted bool) error {
+	err := b.g.mrPushItem(seqterm, seqval, b.seqMr)
+	if err != nil {
+		return err
+	}
+	err = b.tw.AddItem(idterm, idval)
+	if err != nil {
+		return err
+	}
+	if b.expiryTw != nil && !deleted && expiry != 0 {
+		err = b.expiryTw.AddItem(expiryKey(expiry, idterm), []byte{})
+		if err != nil {
+			return err
+		}
+	}
+	b.seq = decode_raw48(seqterm)
+	return nil
+}
+
+// finish writes out the indexes, which are not used until apply.
+func (b *indexBuilder) finish() error {
+	if b.seq == 0 {
+		return nil
+	}
+	var err error
+	b.bySeqRoot, err = b.g.completeNewBtree(b.seqMr)
+	if err != nil {
+		return err
+	}
+	err = b.tw.Sort()
+	if err != nil {
+		return err
+	}
+	b.byIdRoot, err = b.tw.Write(b.g)
+	if err != nil {
+		return err
+	}
+	if b.expiryTw != nil {
+		err = b.expiryTw.Sort()
+		if err != nil {
+			return err
+		}
+		b.expiryRoot, err = b.expiryTw.Write(b.g)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// apply makes the finished indexes those of the database.
+func (b *indexBuilder) apply() {
+	b.g.header.updateSeq = b.seq
+	b.g.header.bySeqRoot = b.bySeqRoot
+	b.g.header.byIdRoot = b.byIdRoot
+	if b.expiryRoot != nil {
+		b.g.expiryRoot = b.expiryRoot
+		b.g.expiryRootDirty = true
+	}
+}
+
+func (b *indexBuilder) close() {
+	b.tw.Close()
+	if b.expiryTw != nil {
+		b.expiryTw.Close()
+	}
+}
+
+// bulkLoadLocalDocs builds the local documents tree, deleted local documents
+// are left out.
+func (g *Gouchstore) bulkLoadLocalDocs(localDocs []*LocalDocument) (*nodePointer, error) {
+	sorted := make([]*LocalDocument, 0, len(localDocs))
+	for _, localDoc := range localDocs {
+		if len(localDoc.ID) > gs_MAX_ID_LENGTH {
+			return nil, ErrKeyTooLarge
+		}
+		if int64(len(localDoc.Body)) > gs_MAX_DOC_DISK_SIZE {
+			return nil, ErrDocumentTooLarge
+		}
+		if !localDoc.Deleted {
+			sorted = append(sorted, localDoc)
+		}
+	}
+	if len(sorted) == 0 {
+		return nil, nil
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return gouchstoreIdComparator([]byte(sorted[i].ID), []byte(sorted[j].ID)) < 0
+	})
+
+	mr := newBtreeModifyResult(gouchstoreIdComparator, nil, nil, nil, g.thresholds.Local.KV, g.thresholds.Local.KP)
+	for i, localDoc := range sorted {
+		if i > 0 && sorted[i-1].ID == localDoc.ID {
+			return nil, ErrDuplicateID
+		}
+		err := g.mrPushItem([]byte(localDoc.ID), localDoc.Body, mr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return g.completeNewBtree(mr)
+}
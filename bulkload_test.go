@@ -0,0 +1,221 @@
+//  Copyright (c) 2014 Marty Schoch
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package gouchstore
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+type sliceIterator struct {
+	docs     []*Document
+	docInfos []*DocumentInfo
+}
+
+func (s *sliceIterator) Next() (*Document, *DocumentInfo, error) {
+	if len(s.docInfos) == 0 {
+		return nil, nil, io.EOF
+	}
+	doc, docInfo := s.docs[0], s.docInfos[0]
+	s.docs, s.docInfos = s.docs[1:], s.docInfos[1:]
+	return doc, docInfo, nil
+}
+
+// shuffledDocs returns count documents in a random order, every tenth deleted.
+func shuffledDocs(count int) *sliceIterator {
+	rv := &sliceIterator{}
+	for _, i := range rand.New(rand.NewSource(1)).Perm(count) {
+		id := fmt.Sprintf("doc-%08d", i)
+		docInfo := NewDocumentInfo(id)
+		docInfo.Rev = 1
+		var doc *Document
+		if i%10 == 0 {
+			docInfo.Deleted = true
+		} else {
+			doc = &Document{ID: id, Body: []byte(fmt.Sprintf(`{"i":%d}`, i))}
+		}
+		rv.docs = append(rv.docs, doc)
+		rv.docInfos = append(rv.docInfos, docInfo)
+	}
+	return rv
+}
+
+func TestBulkLoad(t *testing.T) {
+	defer os.Remove("test.couch")
+	defer os.Remove("test-saved.couch")
+
+	db, err := Open("test.couch", OPEN_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	docs := shuffledDocs(3000)
+	order := append([]*DocumentInfo{}, docs.docInfos...)
+	err = db.BulkLoad(docs, []*LocalDocument{
+		{ID: "_local/b", Body: []byte(`{"b":2}`)},
+		{ID: "_local/a", Body: []byte(`{"a":1}`)},
+		{ID: "_local/gone", Deleted: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// sequence numbers follow the order given
+	for i, docInfo := range order {
+		if docInfo.Seq != uint64(i+1) {
+			t.Fatalf("expected %s to have seq %d, got %d", docInfo.ID, i+1, docInfo.Seq)
+		}
+	}
+	count := 0
+	err = db.ChangesSince(0, 0, func(g *Gouchstore, docInfo *DocumentInfo, userContext interface{}) error {
+		if docInfo.ID != order[count].ID || docInfo.Seq != uint64(count+1) {
+			return fmt.Errorf("expected %s at seq %d, got %s at %d", order[count].ID, count+1, docInfo.ID, docInfo.Seq)
+		}
+		count++
+		return nil
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3000 {
+		t.Errorf("expected 3000 changes, got %d", count)
+	}
+
+	for _, i := range []int{0, 1, 1234, 2999} {
+		id := fmt.Sprintf("doc-%08d", i)
+		docInfo, err := db.DocumentInfoById(id)
+		if err != nil {
+			t.Fatalf("%s: %v", id, err)
+		}
+		if docInfo.Deleted != (i%10 == 0) {
+			t.Errorf("expected %s deleted %t", id, i%10 == 0)
+		}
+		if docInfo.Deleted {
+			continue
+		}
+		doc, err := db.DocumentById(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(doc.Body) != fmt.Sprintf(`{"i":%d}`, i) {
+			t.Errorf("expected body for %d, got %s", i, doc.Body)
+		}
+	}
+	localDoc, err := db.LocalDocumentById("_local/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(localDoc.Body) != `{"a":1}` {
+		t.Errorf("expected local doc body, got %s", localDoc.Body)
+	}
+	_, err = db.LocalDocumentById("_local/gone")
+	if err != ErrNotFound {
+		t.Errorf("expected deleted local doc to be missing, got %v", err)
+	}
+	info, err := db.DatabaseInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.LastSeq != 3000 || info.DocumentCount != 2700 || info.DeletedCount != 300 {
+		t.Errorf("expected 2700 documents, 300 deleted, last seq 3000, got %d, %d, %d", info.DocumentCount, info.DeletedCount, info.LastSeq)
+	}
+
+	// the same documents saved in batches take more space
+	saved, err := Open("test-saved.couch", OPEN_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer saved.Close()
+	docs = shuffledDocs(3000)
+	for i := 0; i < 3000; i += 100 {
+		err = saved.SaveDocuments(docs.docs[i:i+100], docs.docInfos[i:i+100])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = saved.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.pos <= db.pos {
+		t.Errorf("expected bulk loaded file to be smaller, got %d and %d", db.pos, saved.pos)
+	}
+
+	// only empty files can be loaded
+	err = db.BulkLoad(shuffledDocs(10), nil)
+	if err != ErrNotEmpty {
+		t.Errorf("expected ErrNotEmpty, got %v", err)
+	}
+}
+
+func TestBulkLoadDuplicate(t *testing.T) {
+	defer os.Remove("test.couch")
+
+	db, err := Open("test.couch", OPEN_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	docs := shuffledDocs(100)
+	docs.docs = append(docs.docs, &Document{ID: "doc-00000042", Body: []byte(`{}`)})
+	docs.docInfos = append(docs.docInfos, NewDocumentInfo("doc-00000042"))
+	err = db.BulkLoad(docs, nil)
+	if err != ErrDuplicateID {
+		t.Errorf("expected ErrDuplicateID, got %v", err)
+	}
+	info, err := db.DatabaseInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.LastSeq != 0 || info.DocumentCount != 0 {
+		t.Errorf("expected the database to stay empty, got %d documents", info.DocumentCount)
+	}
+}
+
+func TestBulkLoadExpiry(t *testing.T) {
+	defer os.Remove("test.couch")
+
+	db, err := Open("test.couch", OPEN_CREATE|OPEN_EXPIRY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	docs := shuffledDocs(100)
+	// deleted documents are not in the expiry index
+	expected := 0
+	for i, docInfo := range docs.docInfos {
+		docInfo.SetExpiry(uint32(1000 + i))
+		if i <= 50 && !docInfo.Deleted {
+			expected++
+		}
+	}
+	err = db.BulkLoad(docs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := db.ExpireDocuments(1050, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expired != expected {
+		t.Errorf("expected %d documents to expire, got %d", expected, expired)
+	}
+}
@@ -0,0 +1,70 @@
+//  Copyright (c) 2014 Marty Schoch
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package gouchstore
+
+import (
+	"container/list"
+	"sync"
+)
+
+// nodeCache keeps the most recently used decompressed btree nodes, keyed
+// by their position.  Nodes are never rewritten in place, so an entry stays
+// valid for as long as the file is open.
+type nodeCache struct {
+	m       sync.Mutex
+	size    int
+	entries map[int64]*list.Element
+	lru     *list.List
+}
+
+type nodeCacheEntry struct {
+	pos  int64
+	node []byte
+}
+
+func newNodeCache(size int) *nodeCache {
+	return &nodeCache{
+		size:    size,
+		entries: make(map[int64]*list.Element, size),
+		lru:     list.New(),
+	}
+}
+
+func (c *nodeCache) get(pos int64) ([]byte, bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	e, ok := c.entries[pos]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*nodeCacheEntry).node, true
+}
+
+func (c *nodeCache) put(pos int64, node []byte) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if e, ok := c.entries[pos]; ok {
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.entries[pos] = c.lru.PushFront(&nodeCacheEntry{pos: pos, node: node})
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*nodeCacheEntry).pos)
+	}
+}
+
+func (c *nodeCache) len() int {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.lru.Len()
+}
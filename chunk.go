@@ -18,6 +18,11 @@ const gs_CHUNK_CRC_SIZE int64 = 4
 
 // attempt to read a chunk at the specified location
 func (g *Gouchstore) readChunkAt(pos int64, header bool) ([]byte, error) {
+	chunkType := CHUNK_TYPE_DATA
+	if header {
+		chunkType = CHUNK_TYPE_HEADER
+	}
+	chunkPos := pos
 	// chunk starts with 8 bytes (32bit length, 32bit crc)
 	chunkPrefix := make([]byte, gs_CHUNK_LENGTH_SIZE+gs_CHUNK_CRC_SIZE)
 	n, err := g.readAt(chunkPrefix, pos)
@@ -25,7 +30,7 @@ func (g *Gouchstore) readChunkAt(pos int64, header bool) ([]byte, error) {
 		return nil, err
 	}
 	if n < gs_CHUNK_LENGTH_SIZE+gs_CHUNK_CRC_SIZE {
-		return nil, gs_ERROR_INVALID_CHUNK_SHORT_PREFIX
+		return nil, corruptAt(chunkPos, chunkType, ErrChunkShortPrefix)
 	}
 
 	size := decode_raw31(chunkPrefix[0:gs_CHUNK_LENGTH_SIZE])
@@ -33,23 +38,28 @@ func (g *Gouchstore) readChunkAt(pos int64, header bool) ([]byte, error) {
 
 	// size should at least be the size of the length field + 1 (for headers)
 	if header && size < uint32(gs_CHUNK_LENGTH_SIZE+1) {
-		return nil, gs_ERROR_INVALID_CHUNK_SIZE_TOO_SMALL
+		return nil, corruptAt(chunkPos, chunkType, ErrChunkSizeTooSmall)
 	}
 	if header {
 		size -= uint32(gs_CHUNK_LENGTH_SIZE) // headers include the length of the hash, data does not
 	}
 
+	// don't trust a size which reaches past the end of the file
+	if int64(size) > g.pos-pos {
+		return nil, corruptAt(chunkPos, chunkType, ErrChunkDataLessThanSize)
+	}
+
 	data := make([]byte, size)
 	pos += n // skip the actual number of bytes read for the header (may be more than header size if we crossed a block boundary)
 	n, err = g.readAt(data, pos)
 	if uint32(n) < size {
-		return nil, gs_ERROR_INVALID_CHUNK_DATA_LESS_THAN_SIZE
+		return nil, corruptAt(chunkPos, chunkType, ErrChunkDataLessThanSize)
 	}
 
 	// validate crc
 	actualCRC := crc32.ChecksumIEEE(data)
 	if actualCRC != crc {
-		return nil, gs_ERROR_INVALID_CHUNK_BAD_CRC
+		return nil, corruptAt(chunkPos, chunkType, ErrChunkBadCRC)
 	}
 
 	return data, nil
@@ -61,13 +71,37 @@ func (g *Gouchstore) readCompressedDataChunkAt(pos int64) ([]byte, error) {
 		return nil, err
 	}
 
-	decompressedChunk, err := g.ops.SnappyDecode(nil, chunk)
+	decompressedChunk, err := g.codec.Decode(nil, chunk)
 	if err != nil {
-		return nil, err
+		return nil, corruptAt(pos, CHUNK_TYPE_DATA, ErrChunkBadCompression)
 	}
 	return decompressedChunk, nil
 }
 
+// readNodeAt reads a compressed btree node, reporting corruption as such.
+// Nodes are kept in the node cache, if there is one.
+func (g *Gouchstore) readNodeAt(pos int64) ([]byte, error) {
+	if g.nodeCache != nil {
+		if nodeData, ok := g.nodeCache.get(pos); ok {
+			return nodeData, nil
+		}
+	}
+	nodeData, err := g.readCompressedDataChunkAt(pos)
+	if cerr, ok := err.(*CorruptError); ok {
+		cerr.ChunkType = CHUNK_TYPE_NODE
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(nodeData) < 1 {
+		return nil, corruptAt(pos, CHUNK_TYPE_NODE, ErrBadNodeType)
+	}
+	if g.nodeCache != nil {
+		g.nodeCache.put(pos, nodeData)
+	}
+	return nodeData, nil
+}
+
 func (g *Gouchstore) writeChunk(buf []byte, header bool) (int64, int64, error) {
 	// always write to the end of the file
 	startPos := g.pos
@@ -121,6 +155,6 @@ func (g *Gouchstore) writeChunk(buf []byte, header bool) (int64, int64, error) {
 }
 
 func (g *Gouchstore) writeCompressedChunk(buf []byte) (int64, int64, error) {
-	compressed := g.ops.SnappyEncode(nil, buf)
+	compressed := g.codec.Encode(nil, buf)
 	return g.writeChunk(compressed, false)
 }
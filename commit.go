@@ -0,0 +1,181 @@
+//  Copyright (c) 2014 Marty Schoch
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package gouchstore
+
+// Durability controls how hard Commit works to make a header durable.
+type Durability int
+
+const (
+	// DURABILITY_DEFAULT uses the durability the handle was opened with.
+	DURABILITY_DEFAULT Durability = iota
+	// DURABILITY_FULL syncs the data, writes the header, then syncs again.
+	// A header is never on disk before the data it points to.
+	DURABILITY_FULL
+	// DURABILITY_SINGLE_SYNC writes the header right behind the data and
+	// syncs them together.  A crash during the sync may leave a valid
+	// header pointing at data which never made it to disk.
+	DURABILITY_SINGLE_SYNC
+	// DURABILITY_NONE writes the header and leaves flushing to the OS.
+	DURABILITY_NONE
+)
+
+func (d Durability) String() string {
+	switch d {
+	case DURABILITY_DEFAULT:
+		return "default"
+	case DURABILITY_FULL:
+		return "full"
+	case DURABILITY_SINGLE_SYNC:
+		return "single-sync"
+	case DURABILITY_NONE:
+		return "none"
+	}
+	return "unknown"
+}
+
+// CommitFuture is the result of an asynchronous commit.
+type CommitFuture struct {
+	done chan struct{}
+	err  error
+}
+
+func newCommitFuture() *CommitFuture {
+	return &CommitFuture{
+		done: make(chan struct{}),
+	}
+}
+
+func (f *CommitFuture) complete(err error) {
+	f.err = err
+	close(f.done)
+}
+
+// Done returns a channel which is closed once the commit has finished.
+func (f *CommitFuture) Done() <-chan struct{} {
+	return f.done
+}
+
+// Wait blocks until the commit has finished and returns its error, if any.
+func (f *CommitFuture) Wait() error {
+	<-f.done
+	return f.err
+}
+
+// Commit makes all changes since the last commit visible to future opens,
+// using the durability the handle was opened with.
+func (g *Gouchstore) Commit() error {
+	return g.CommitEx(DURABILITY_DEFAULT)
+}
+
+// CommitEx is like Commit but overrides the handle durability for this commit.
+func (g *Gouchstore) CommitEx(durability Durability) error {
+	err := g.checkWritable()
+	if err != nil {
+		return err
+	}
+	finish, err := g.prepareCommit(durability)
+	if err != nil {
+		return err
+	}
+	return finish()
+}
+
+// CommitAsync writes the header for the current state and returns
+// immediately.  Any syncs required by the durability run in the background,
+// the returned future completes once they are done.
+//
+// The handle may continue to be used while the commit is in flight,
+// changes made after CommitAsync returns are not part of this commit.
+// Close, and the switch to a new file at the end of CompactLive, wait for
+// the commit to finish.
+func (g *Gouchstore) CommitAsync(durability Durability) *CommitFuture {
+	rv := newCommitFuture()
+	err := g.checkWritable()
+	if err != nil {
+		rv.complete(err)
+		return rv
+	}
+	finish, err := g.prepareCommit(durability)
+	if err != nil {
+		rv.complete(err)
+		return rv
+	}
+	g.commits.Add(1)
+	go func() {
+		defer g.commits.Done()
+		rv.complete(finish())
+	}()
+	return rv
+}
+
+// prepareCommit does all the work of a commit which must happen before
+// the caller can continue to modify the database.  The returned function
+// performs the rest and may be run on another goroutine.
+func (g *Gouchstore) prepareCommit(durability Durability) (func() error, error) {
+	if durability == DURABILITY_DEFAULT {
+		durability = g.durability
+	}
+
+	err := g.saveExpiryRoot()
+	if err != nil {
+		return nil, err
+	}
+	err = g.saveThresholds()
+	if err != nil {
+		return nil, err
+	}
+
+	// the header lands on the next block boundary
+	g.header.position = uint64(g.pos)
+	if g.pos%gs_BLOCK_SIZE != 0 {
+		g.header.position += uint64(gs_BLOCK_SIZE - g.pos%gs_BLOCK_SIZE)
+	}
+	g.setCommitted()
+
+	switch durability {
+	case DURABILITY_FULL:
+		headerPos := g.pos
+		headerBytes := g.header.toBytes()
+		//Extend file size to where end of header will land before we do first sync
+		dummyHeader := make([]byte, len(headerBytes))
+		_, _, err := g.writeChunk(dummyHeader, true)
+		if err != nil {
+			return nil, err
+		}
+		return func() error {
+			err := g.ops.Sync(g.file)
+			if err != nil {
+				return err
+			}
+			err = g.writeHeaderBytesAt(headerBytes, headerPos)
+			if err != nil {
+				return err
+			}
+			return g.ops.Sync(g.file)
+		}, nil
+	case DURABILITY_SINGLE_SYNC:
+		err := g.writeHeader(g.header)
+		if err != nil {
+			return nil, err
+		}
+		return func() error {
+			return g.ops.Sync(g.file)
+		}, nil
+	case DURABILITY_NONE:
+		err := g.writeHeader(g.header)
+		if err != nil {
+			return nil, err
+		}
+		return func() error {
+			return nil
+		}, nil
+	}
+	return nil, ErrInvalidArguments
+}
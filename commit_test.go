@@ -0,0 +1,230 @@
+//  Copyright (c) 2014 Marty Schoch
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package gouchstore
+
+import (
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type syncCountingGouchOps struct {
+	*BaseGouchOps
+	syncs int32
+}
+
+func (g *syncCountingGouchOps) Sync(f *os.File) error {
+	atomic.AddInt32(&g.syncs, 1)
+	return g.BaseGouchOps.Sync(f)
+}
+
+// blockingSyncGouchOps blocks every Sync until release is closed.
+type blockingSyncGouchOps struct {
+	*BaseGouchOps
+	release chan struct{}
+}
+
+func (g *blockingSyncGouchOps) Sync(f *os.File) error {
+	<-g.release
+	return g.BaseGouchOps.Sync(f)
+}
+
+func TestCloseWaitsForCommitAsync(t *testing.T) {
+	defer os.Remove("test.couch")
+	ops := &blockingSyncGouchOps{BaseGouchOps: NewBaseGouchOps(), release: make(chan struct{})}
+	db, err := OpenWithOptions("test.couch", &Options{Create: true, Ops: ops})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.SaveDocument(&Document{ID: "a", Body: []byte(`{}`)}, &DocumentInfo{ID: "a", Rev: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	future := db.CommitAsync(DURABILITY_FULL)
+
+	closed := make(chan error)
+	go func() {
+		closed <- db.Close()
+	}()
+	select {
+	case err = <-closed:
+		t.Fatalf("expected Close to wait for the commit, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(ops.release)
+	err = <-closed
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = future.Wait()
+	if err != nil {
+		t.Errorf("expected the commit to finish, got %v", err)
+	}
+
+	db, err = Open("test.couch", OPEN_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, err = db.DocumentInfoById("a")
+	if err != nil {
+		t.Errorf("expected the committed document, got %v", err)
+	}
+}
+
+func TestCommitDurability(t *testing.T) {
+	tests := []struct {
+		options       int
+		override      Durability
+		async         bool
+		expectedSyncs int32
+	}{
+		{options: OPEN_CREATE, expectedSyncs: 2},
+		{options: OPEN_CREATE | OPEN_DURABILITY_SINGLE_SYNC, expectedSyncs: 1},
+		{options: OPEN_CREATE | OPEN_DURABILITY_NONE, expectedSyncs: 0},
+		{options: OPEN_CREATE | OPEN_DURABILITY_NONE, override: DURABILITY_FULL, expectedSyncs: 2},
+		{options: OPEN_CREATE, override: DURABILITY_NONE, expectedSyncs: 0},
+		{options: OPEN_CREATE, async: true, expectedSyncs: 2},
+		{options: OPEN_CREATE, override: DURABILITY_SINGLE_SYNC, async: true, expectedSyncs: 1},
+	}
+
+	for i, test := range tests {
+		os.Remove("test.couch")
+		ops := &syncCountingGouchOps{BaseGouchOps: NewBaseGouchOps()}
+		db, err := OpenEx("test.couch", test.options, ops)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		docs := make([]*Document, 0)
+		docInfos := make([]*DocumentInfo, 0)
+		for j := 0; j < 100; j++ {
+			id := "doc-" + strconv.Itoa(j)
+			docs = append(docs, &Document{ID: id, Body: []byte(`{"abc":123}`)})
+			docInfos = append(docInfos, &DocumentInfo{ID: id, Rev: 1, ContentMeta: DOC_IS_COMPRESSED})
+		}
+		err = db.SaveDocuments(docs, docInfos)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if test.async {
+			err = db.CommitAsync(test.override).Wait()
+		} else {
+			err = db.CommitEx(test.override)
+		}
+		if err != nil {
+			t.Fatalf("test %d: %v", i, err)
+		}
+		if ops.syncs != test.expectedSyncs {
+			t.Errorf("test %d: expected %d syncs, got %d", i, test.expectedSyncs, ops.syncs)
+		}
+		err = db.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		db, err = Open("test.couch", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertDocsExistWithContent(t, db, docs, docInfos)
+		db.Close()
+	}
+	os.Remove("test.couch")
+}
+
+func TestCommitAsyncThenContinueWriting(t *testing.T) {
+	defer os.Remove("test.couch")
+	db, err := Open("test.couch", OPEN_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	first := &Document{ID: "first", Body: []byte(`{"abc":1}`)}
+	firstInfo := &DocumentInfo{ID: "first", Rev: 1, ContentMeta: DOC_IS_COMPRESSED}
+	err = db.SaveDocument(first, firstInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	future := db.CommitAsync(DURABILITY_DEFAULT)
+
+	// keep writing while the commit is syncing
+	second := &Document{ID: "second", Body: []byte(`{"abc":2}`)}
+	secondInfo := &DocumentInfo{ID: "second", Rev: 1, ContentMeta: DOC_IS_COMPRESSED}
+	err = db.SaveDocument(second, secondInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	<-future.Done()
+	err = future.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := Open("test.couch", OPEN_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	assertDocsExistWithContent(t, reopened, []*Document{first}, []*DocumentInfo{firstInfo})
+	_, err = reopened.DocumentInfoById("second")
+	if err != ErrNotFound {
+		t.Errorf("expected uncommitted document to be not found, got %v", err)
+	}
+}
+
+func TestOpenConflictingDurability(t *testing.T) {
+	_, err := Open("test.couch", OPEN_CREATE|OPEN_DURABILITY_SINGLE_SYNC|OPEN_DURABILITY_NONE)
+	if err != ErrInvalidArguments {
+		t.Errorf("expected invalid arguments, got %v", err)
+	}
+}
+
+func TestCommitHeaderPosition(t *testing.T) {
+	defer os.Remove("test.couch")
+
+	db, err := Open("test.couch", OPEN_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		err = db.SaveDocument(&Document{ID: "a", Body: []byte(`{}`)}, &DocumentInfo{ID: "a", Rev: uint64(i + 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = db.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	info, err := db.DatabaseInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db, err = Open("test.couch", OPEN_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	reopened, err := db.DatabaseInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.HeaderPosition != reopened.HeaderPosition {
+		t.Errorf("expected header at %d after commit, found it at %d", info.HeaderPosition, reopened.HeaderPosition)
+	}
+}
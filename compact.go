@@ -9,6 +9,11 @@
 
 package gouchstore
 
+import (
+	"context"
+	"os"
+)
+
 const (
 	COMPACT_KEEP_ITEM int = 0
 	COMPACT_DROP_ITEM int = 1
@@ -20,8 +25,47 @@ func defaultCompactHook(target *Gouchstore, docInfo *DocumentInfo, context inter
 
 type compactHook func(target *Gouchstore, docInfo *DocumentInfo, context interface{}) (int, error)
 
+// The progress callback is called after every gs_COMPACT_PROGRESS_INTERVAL
+// documents copied.
+const gs_COMPACT_PROGRESS_INTERVAL = 1000
+
+// CompactProgress describes how far a compaction has got.
+type CompactProgress struct {
+	DocsCopied   uint64 // documents read from the by-seq index so far
+	DocsTotal    uint64 // documents in the by-seq index
+	BytesWritten int64  // bytes written to the target file so far
+}
+
+// CompactOptions controls a compaction.
+type CompactOptions struct {
+	// Progress is called as documents are copied, and once more when done.
+	Progress func(progress CompactProgress)
+
+	// Transform rewrites each document body as it is copied, it is given
+	// the uncompressed body and may change the ContentMeta of docInfo.
+	// The body returned is compressed if docInfo.Compressed().
+	Transform func(docInfo *DocumentInfo, body []byte) ([]byte, error)
+
+	// Recompress compresses every document body, including those which
+	// were stored uncompressed.
+	Recompress bool
+
+	// Codec replaces the codec of the source in the target file, every
+	// compressed body and node is rewritten with it.
+	Codec Codec
+}
+
+// rewriteBodies reports whether bodies must be decoded, rather than copied.
+func (o *CompactOptions) rewriteBodies() bool {
+	return o.Transform != nil || o.Recompress || o.Codec != nil
+}
+
 type compactContext struct {
+	ctx         context.Context
+	options     CompactOptions
+	progress    CompactProgress
 	tw          TreeWriter
+	expiryTw    TreeWriter
 	targetMr    *modifyResult
 	targetDb    *Gouchstore
 	hook        compactHook
@@ -29,17 +73,77 @@ type compactContext struct {
 }
 
 func (g *Gouchstore) Compact(targetFilename string) error {
+	return g.CompactWithOptions(context.Background(), targetFilename, nil)
+}
+
+// CompactWithOptions is like Compact, but can be cancelled through ctx and
+// reports progress as described by options.  If compaction fails, or is
+// cancelled, any temporary files are removed, and so is the target file if
+// compaction created it.
+func (g *Gouchstore) CompactWithOptions(ctx context.Context, targetFilename string, options *CompactOptions) error {
+	err := g.checkOpen()
+	if err != nil {
+		return err
+	}
+	targetDb, _, err := g.compactTo(ctx, targetFilename, options)
+	if err != nil {
+		return err
+	}
+	return targetDb.Close()
+}
+
+// compactTo writes the live data into a new file, and returns the handle
+// used to write it, committed and still open, and whether it created the
+// file.  If it fails, the file is removed only if it created it.
+func (g *Gouchstore) compactTo(ctx context.Context, targetFilename string, options *CompactOptions) (*Gouchstore, bool, error) {
 	// create a compaction context
 	context := compactContext{
+		ctx:  ctx,
 		hook: defaultCompactHook,
 	}
+	if options != nil {
+		context.options = *options
+	}
+	if g.header.bySeqRoot != nil && len(g.header.bySeqRoot.reducedValue) >= gs_BY_SEQ_REDUCE_SIZE {
+		context.progress.DocsTotal = decode_raw40(g.header.bySeqRoot.reducedValue[0:gs_BY_SEQ_REDUCE_SIZE])
+	}
 
 	// open the target database
-	targetDb, err := Open(targetFilename, OPEN_CREATE)
+	targetOptions := g.options
+	targetOptions.Create = true
+	targetOptions.ReadOnly = false
+	targetOptions.IdTreeThresholds = g.thresholds.ById
+	targetOptions.SeqTreeThresholds = g.thresholds.BySeq
+	targetOptions.LocalTreeThresholds = g.thresholds.Local
+	targetOptions.ContentHash = g.contentHash
+	if context.options.Codec != nil {
+		targetOptions.Codec = context.options.Codec
+	}
+	if g.expiry {
+		// drop what has expired, and rebuild the expiry index for the rest
+		context.hook = expiryCompactHook
+		context.hookContext = expiryNow()
+	}
+	_, err := os.Stat(targetFilename)
+	created := os.IsNotExist(err)
+	targetDb, err := OpenWithOptions(targetFilename, &targetOptions)
 	if err != nil {
-		return err
+		return nil, false, err
 	}
-	defer targetDb.Close()
+	err = g.compactInto(targetDb, &context)
+	if err != nil {
+		targetDb.Close()
+		if created {
+			os.Remove(targetFilename)
+		}
+		return nil, false, err
+	}
+	g.logf("gouchstore: compacted %s into %s", g.filename, targetFilename)
+	return targetDb, created, nil
+}
+
+func (g *Gouchstore) compactInto(targetDb *Gouchstore, context *compactContext) error {
+	var err error
 
 	context.targetDb = targetDb
 	targetDb.header.updateSeq = g.header.updateSeq
@@ -47,12 +151,24 @@ func (g *Gouchstore) Compact(targetFilename string) error {
 	targetDb.header.purgePtr = g.header.purgePtr
 
 	if g.header.bySeqRoot != nil {
-		context.tw, err = g.ops.CompactionTreeWriter(gouchstoreIdComparator, byIdReduce, byIdReReduce, nil)
+		reduce, rereduce := targetDb.byIdReducers()
+		context.tw, err = g.options.CompactionTreeWriter(gouchstoreIdComparator, reduce, rereduce, nil)
 		if err != nil {
 			return err
 		}
 		defer context.tw.Close()
-		err = g.compactSeqTree(targetDb, &context)
+		if g.expiry {
+			context.expiryTw, err = g.options.CompactionTreeWriter(gouchstoreIdComparator, bySeqReduce, bySeqReReduce, nil)
+			if err != nil {
+				return err
+			}
+			defer context.expiryTw.Close()
+		}
+		err = g.compactSeqTree(targetDb, context)
+		if err != nil {
+			return err
+		}
+		err = context.ctx.Err()
 		if err != nil {
 			return err
 		}
@@ -64,10 +180,21 @@ func (g *Gouchstore) Compact(targetFilename string) error {
 		if err != nil {
 			return err
 		}
+		if context.expiryTw != nil {
+			err = context.expiryTw.Sort()
+			if err != nil {
+				return err
+			}
+			targetDb.expiryRoot, err = context.expiryTw.Write(targetDb)
+			if err != nil {
+				return err
+			}
+			targetDb.expiryRootDirty = true
+		}
 	}
 
 	if g.header.localDocsRoot != nil {
-		err := g.compactLocalDocsTree(targetDb, &context)
+		err := g.compactLocalDocsTree(targetDb, context)
 		if err != nil {
 			return err
 		}
@@ -79,16 +206,28 @@ func (g *Gouchstore) Compact(targetFilename string) error {
 		}
 	}
 
+	err = context.ctx.Err()
+	if err != nil {
+		return err
+	}
 	err = targetDb.Commit()
 	if err != nil {
 		return err
 	}
+	context.reportProgress()
 
 	return nil
 }
 
+func (c *compactContext) reportProgress() {
+	if c.options.Progress != nil {
+		c.progress.BytesWritten = c.targetDb.pos
+		c.options.Progress(c.progress)
+	}
+}
+
 func (g *Gouchstore) compactLocalDocsTree(target *Gouchstore, context *compactContext) error {
-	context.targetMr = newBtreeModifyResult(gouchstoreIdComparator, nil, nil, nil, gs_DB_CHUNK_THRESHOLD, gs_DB_CHUNK_THRESHOLD)
+	context.targetMr = newBtreeModifyResult(gouchstoreIdComparator, nil, nil, nil, target.thresholds.Local.KV, target.thresholds.Local.KP)
 
 	srcFold := lookupRequest{
 		gouchstore:      g,
@@ -116,12 +255,17 @@ func (g *Gouchstore) compactLocalDocsTree(target *Gouchstore, context *compactCo
 func compactLocalDocsFetchCallback(req *lookupRequest, key []byte, value []byte) error {
 	context := req.callbackContext.(*compactContext)
 
+	// the expiry index is rebuilt and the thresholds recorded again, never copied
+	if string(key) == gs_EXPIRY_ROOT_DOC_ID || string(key) == gs_THRESHOLDS_DOC_ID {
+		return nil
+	}
+
 	return context.targetDb.mrPushItem(key, value, context.targetMr)
 }
 
 func (g *Gouchstore) compactSeqTree(target *Gouchstore, context *compactContext) error {
 
-	context.targetMr = newBtreeModifyResult(gouchstoreSeqComparator, bySeqReduce, bySeqReReduce, nil, gs_DB_CHUNK_THRESHOLD, gs_DB_CHUNK_THRESHOLD)
+	context.targetMr = newBtreeModifyResult(gouchstoreSeqComparator, bySeqReduce, bySeqReReduce, nil, target.thresholds.BySeq.KV, target.thresholds.BySeq.KP)
 
 	srcFold := lookupRequest{
 		gouchstore:      g,
@@ -148,9 +292,20 @@ func (g *Gouchstore) compactSeqTree(target *Gouchstore, context *compactContext)
 
 func compactSeqFetchCallback(req *lookupRequest, key []byte, value []byte) error {
 	context := req.callbackContext.(*compactContext)
+	err := context.ctx.Err()
+	if err != nil {
+		return err
+	}
+	context.progress.DocsCopied++
+	if context.progress.DocsCopied%gs_COMPACT_PROGRESS_INTERVAL == 0 {
+		context.reportProgress()
+	}
 
 	info := &DocumentInfo{}
-	decodeBySeqValue(info, value)
+	err = decodeBySeqValue(info, value)
+	if err != nil {
+		return err
+	}
 	if context.hook != nil {
 		hookAction, err := context.hook(context.targetDb, info, context.hookContext)
 		if err != nil {
@@ -161,22 +316,21 @@ func compactSeqFetchCallback(req *lookupRequest, key []byte, value []byte) error
 		}
 	}
 
-	if info.bodyPosition != 0 {
-		// Copy the document from the old db file to the new one:
-		data, err := req.gouchstore.readChunkAt(int64(info.bodyPosition), false)
+	if info.bodyPosition != 0 && context.options.rewriteBodies() {
+		err = rewriteBody(req.gouchstore, info, context)
 		if err != nil {
 			return err
 		}
-
-		pos, _, err := context.targetDb.writeChunk(data, false)
+		value = info.encodeBySeq()
+	} else if info.bodyPosition != 0 {
+		err = req.gouchstore.copyBody(context.targetDb, info)
 		if err != nil {
 			return err
 		}
-		info.bodyPosition = uint64(pos)
 		value = info.encodeBySeq()
 	}
 
-	err := outputSeqTreeItem(key, value, context)
+	err = outputSeqTreeItem(key, value, context)
 	if err != nil {
 		return err
 	}
@@ -185,6 +339,46 @@ func compactSeqFetchCallback(req *lookupRequest, key []byte, value []byte) error
 
 }
 
+// copyBody copies the body chunk of info from g to target, as it is, and
+// points info at the copy.
+func (g *Gouchstore) copyBody(target *Gouchstore, info *DocumentInfo) error {
+	data, err := g.readChunkAt(int64(info.bodyPosition), false)
+	if err != nil {
+		return err
+	}
+	pos, _, err := target.writeChunk(data, false)
+	if err != nil {
+		return err
+	}
+	info.bodyPosition = uint64(pos)
+	return nil
+}
+
+// rewriteBody writes the body described by info to the target, decoded and
+// encoded again as the compaction options require, and updates info to match.
+func rewriteBody(g *Gouchstore, info *DocumentInfo, context *compactContext) error {
+	var body []byte
+	var err error
+	if info.Compressed() {
+		body, err = g.readCompressedDataChunkAt(int64(info.bodyPosition))
+	} else {
+		body, err = g.readChunkAt(int64(info.bodyPosition), false)
+	}
+	if err != nil {
+		return err
+	}
+	if context.options.Transform != nil {
+		body, err = context.options.Transform(info, body)
+		if err != nil {
+			return err
+		}
+	}
+	if context.options.Recompress {
+		info.SetCompressed(true)
+	}
+	return context.targetDb.writeDoc(&Document{ID: info.ID, Body: body}, &info.bodyPosition, &info.Size, info.Compressed())
+}
+
 func outputSeqTreeItem(k, v []byte, context *compactContext) error {
 	err := context.targetDb.mrPushItem(k, v, context.targetMr)
 	if err != nil {
@@ -192,7 +386,10 @@ func outputSeqTreeItem(k, v []byte, context *compactContext) error {
 	}
 
 	docInfo := &DocumentInfo{}
-	decodeBySeqValue(docInfo, v)
+	err = decodeBySeqValue(docInfo, v)
+	if err != nil {
+		return err
+	}
 	docInfo.Seq = decode_raw48(k)
 
 	idK := []byte(docInfo.ID)
@@ -203,5 +400,12 @@ func outputSeqTreeItem(k, v []byte, context *compactContext) error {
 		return err
 	}
 
+	if context.expiryTw != nil && !docInfo.Deleted && docInfo.Expiry() != 0 {
+		err = context.expiryTw.AddItem(expiryKey(docInfo.Expiry(), idK), []byte{})
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
@@ -0,0 +1,250 @@
+//  Copyright (c) 2014 Marty Schoch
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package gouchstore
+
+import (
+	"context"
+	"os"
+	"sync"
+)
+
+// After this many rounds of catching up the writers are paused anyway, so
+// compaction finishes even if they write faster than it can copy.
+const gs_COMPACT_CATCHUP_ROUNDS = 10
+
+const gs_COMPACT_REPLAY_BATCH_SIZE = 1000
+
+// CompactLive compacts the database into targetFilename while the handle
+// stays in use, then replaces the database file with the compacted one.
+//
+// The committed documents are copied from a snapshot, then the changes
+// committed since are replayed, keeping their sequence numbers, until the
+// target has caught up.  The last changes are replayed with writers paused,
+// before the target is renamed over the database file and the handle
+// switches to it.  Changes which had not been committed yet are replayed
+// into the new file without committing them, so they are still lost if the
+// handle is closed without a Commit.
+//
+// Gouchstore handles are not safe for concurrent use, compaction holds lock
+// while it uses the handle, so callers must hold the same lock whenever they
+// use the handle.
+func (g *Gouchstore) CompactLive(targetFilename string, lock sync.Locker) error {
+	return g.CompactLiveWithOptions(context.Background(), targetFilename, lock, nil)
+}
+
+// CompactLiveWithOptions is like CompactLive, but can be cancelled through
+// ctx and reports the progress of copying the snapshot to options.Progress.
+// Changes replayed afterwards are copied as they are, so options which
+// rewrite bodies are not supported.
+func (g *Gouchstore) CompactLiveWithOptions(ctx context.Context, targetFilename string, lock sync.Locker, options *CompactOptions) error {
+	if options != nil && options.rewriteBodies() {
+		return ErrInvalidArguments
+	}
+	lock.Lock()
+	err := g.checkWritable()
+	var snapshot *Gouchstore
+	if err == nil {
+		snapshot, err = g.openSnapshot()
+	}
+	lock.Unlock()
+	if err != nil {
+		return err
+	}
+	defer snapshot.Close()
+
+	targetDb, created, err := snapshot.compactTo(ctx, targetFilename, options)
+	if err != nil {
+		return err
+	}
+	swapped := false
+	defer func() {
+		if !swapped {
+			targetDb.Close()
+			if created {
+				os.Remove(targetFilename)
+			}
+		}
+	}()
+	copied := snapshot.header.updateSeq
+
+	for round := 0; ; round++ {
+		err = ctx.Err()
+		if err != nil {
+			return err
+		}
+		lock.Lock()
+		err = g.checkWritable()
+		if err != nil {
+			lock.Unlock()
+			return err
+		}
+		snapshot.refreshSnapshot(g, g.committed)
+		if snapshot.header.updateSeq == copied || round == gs_COMPACT_CATCHUP_ROUNDS {
+			swapped, err = g.finishLiveCompaction(snapshot, targetDb, copied)
+			lock.Unlock()
+			return err
+		}
+		lock.Unlock()
+
+		copied, err = snapshot.replayChanges(targetDb, copied)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// openSnapshot opens a second, read only, handle on the database file,
+// positioned at the last commit of g.
+func (g *Gouchstore) openSnapshot() (*Gouchstore, error) {
+	options := g.options
+	options.Create = false
+	options.ReadOnly = true
+	rv, err := OpenWithOptions(g.filename, &options)
+	if err != nil {
+		return nil, err
+	}
+	rv.refreshSnapshot(g, g.committed)
+	return rv, nil
+}
+
+// refreshSnapshot moves the snapshot to the state of source described by h,
+// its last commit or its current header, including what has not been
+// committed yet.  Everything it refers to has already been written, and is
+// never changed by later writes.
+func (g *Gouchstore) refreshSnapshot(source *Gouchstore, h *header) {
+	hcopy := *h
+	g.header = &hcopy
+	g.pos = source.pos
+	g.expiryRoot = source.expiryRoot
+	g.contentHash = source.contentHash
+}
+
+// replayChanges copies the documents changed after since from g into
+// target, and returns the last sequence number copied.
+func (g *Gouchstore) replayChanges(target *Gouchstore, since uint64) (uint64, error) {
+	var seqs, seqvals, ids, idvals [][]byte
+	flush := func() error {
+		if len(seqs) == 0 {
+			return nil
+		}
+		err := target.updateIndexes(seqs, seqvals, ids, idvals)
+		if err != nil {
+			return err
+		}
+		target.header.updateSeq = since
+		seqs, seqvals, ids, idvals = nil, nil, nil, nil
+		return nil
+	}
+
+	err := g.rawChangesSince(since+1, 0, func(g *Gouchstore, docInfo *DocumentInfo, userContext interface{}) error {
+		if docInfo.bodyPosition != 0 {
+			err := g.copyBody(target, docInfo)
+			if err != nil {
+				return err
+			}
+		}
+		seqs = append(seqs, encode_raw48(docInfo.Seq))
+		seqvals = append(seqvals, docInfo.encodeBySeq())
+		ids = append(ids, []byte(docInfo.ID))
+		idvals = append(idvals, docInfo.encodeById())
+		since = docInfo.Seq
+		if len(seqs) == gs_COMPACT_REPLAY_BATCH_SIZE {
+			return flush()
+		}
+		return nil
+	}, nil)
+	if err != nil {
+		return since, err
+	}
+	return since, flush()
+}
+
+// finishLiveCompaction replays and commits the last committed changes, then
+// replays those not committed yet, and switches g over to the compacted
+// file, it reports whether the switch was made.  Writers must be paused.
+func (g *Gouchstore) finishLiveCompaction(snapshot, targetDb *Gouchstore, copied uint64) (bool, error) {
+	// asynchronous commits must land in the old file before it is replaced
+	g.commits.Wait()
+
+	copied, err := snapshot.replayChanges(targetDb, copied)
+	if err != nil {
+		return false, err
+	}
+	err = targetDb.replayLocalDocuments(snapshot, g.committed)
+	if err != nil {
+		return false, err
+	}
+	targetDb.expiryRootDirty = targetDb.expiry
+	targetDb.thresholdsDirty = targetDb.thresholds != uniformThresholds(gs_DB_CHUNK_THRESHOLD)
+	err = targetDb.CommitEx(g.durability)
+	if err != nil {
+		return false, err
+	}
+
+	// the uncommitted changes stay uncommitted
+	if *g.header != *g.committed {
+		snapshot.refreshSnapshot(g, g.header)
+		_, err = snapshot.replayChanges(targetDb, copied)
+		if err != nil {
+			return false, err
+		}
+		err = targetDb.replayLocalDocuments(snapshot, g.header)
+		if err != nil {
+			return false, err
+		}
+		// the copied local documents hold no expiry root or thresholds
+		targetDb.expiryRootDirty = targetDb.expiry
+		targetDb.thresholdsDirty = targetDb.thresholds != uniformThresholds(gs_DB_CHUNK_THRESHOLD)
+	}
+
+	err = os.Rename(targetDb.filename, g.filename)
+	if err != nil {
+		return false, err
+	}
+	g.logf("gouchstore: replaced %s with compacted %s", g.filename, targetDb.filename)
+
+	old := g.file
+	g.file = targetDb.file
+	g.pos = targetDb.pos
+	g.header = targetDb.header
+	g.committed = targetDb.committed
+	g.expiryRoot = targetDb.expiryRoot
+	g.expiryRootDirty = targetDb.expiryRootDirty
+	g.thresholdsDirty = targetDb.thresholdsDirty
+	if g.nodeCache != nil {
+		g.nodeCache = newNodeCache(g.options.NodeCacheSize)
+	}
+	// the file, and its lock, now belong to g
+	oldUnlock := g.unlock
+	g.unlock = targetDb.unlock
+	targetDb.unlock = nil
+	targetDb.closed = true
+	err = g.ops.Close(old)
+	if oldUnlock != nil {
+		oldUnlock()
+	}
+	return true, err
+}
+
+// replayLocalDocuments copies the local documents of snapshot again, with
+// the purge state of source header h.  Local documents are few, and have no
+// sequence numbers to catch up with.
+func (g *Gouchstore) replayLocalDocuments(snapshot *Gouchstore, h *header) error {
+	g.header.localDocsRoot = nil
+	if snapshot.header.localDocsRoot != nil {
+		err := snapshot.compactLocalDocsTree(g, &compactContext{targetDb: g})
+		if err != nil {
+			return err
+		}
+	}
+	g.header.purgeSeq = h.purgeSeq + 1
+	g.header.purgePtr = h.purgePtr
+	return nil
+}
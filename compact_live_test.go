@@ -0,0 +1,294 @@
+//  Copyright (c) 2014 Marty Schoch
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package gouchstore
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+)
+
+// writingLocker runs write each time it is unlocked, as if another
+// goroutine was waiting to write as soon as compaction let go.
+type writingLocker struct {
+	sync.Mutex
+	writing bool
+	write   func()
+}
+
+func (l *writingLocker) Unlock() {
+	l.Mutex.Unlock()
+	if l.write != nil && !l.writing {
+		l.writing = true
+		l.Lock()
+		l.write()
+		l.Mutex.Unlock()
+		l.writing = false
+	}
+}
+
+func TestCompactLive(t *testing.T) {
+	defer os.Remove("test.couch")
+	defer os.Remove("test-compacted.couch")
+
+	db, err := OpenWithOptions("test.couch", &Options{Create: true, NodeCacheSize: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	expected := make(map[string]uint64)
+	save := func(id string, rev uint64, deleted bool) {
+		docInfo := &DocumentInfo{ID: id, Rev: rev, Deleted: deleted}
+		var doc *Document
+		if !deleted {
+			doc = &Document{ID: id, Body: []byte(fmt.Sprintf(`{"rev":%d}`, rev))}
+		}
+		err := db.SaveDocument(doc, docInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected[id] = rev
+	}
+	for i := 0; i < 500; i++ {
+		save(fmt.Sprintf("doc-%03d", i), 1, false)
+	}
+	err = db.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 500; i++ {
+		save(fmt.Sprintf("doc-%03d", i), 2, false)
+	}
+	err = db.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sizeBefore := db.pos
+
+	round := 0
+	lock := &writingLocker{}
+	lock.write = func() {
+		round++
+		if round > 3 {
+			return
+		}
+		// updates, new documents and deletions, some left uncommitted
+		for i := 0; i < 100; i++ {
+			save(fmt.Sprintf("doc-%03d", i*5), uint64(2+round), false)
+		}
+		save(fmt.Sprintf("new-%d", round), 1, false)
+		save(fmt.Sprintf("doc-%03d", round), 3, true)
+		err := db.SaveLocalDocument(&LocalDocument{ID: "_local/round", Body: []byte(fmt.Sprintf("%d", round))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if round < 3 {
+			err = db.Commit()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	err = db.CompactLive("test-compacted.couch", lock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if round < 3 {
+		t.Fatalf("expected writes during compaction, got %d rounds", round)
+	}
+	if _, err := os.Stat("test-compacted.couch"); !os.IsNotExist(err) {
+		t.Errorf("expected the compacted file to be renamed, got %v", err)
+	}
+	if db.pos >= sizeBefore {
+		t.Errorf("expected the file to shrink from %d, got %d", sizeBefore, db.pos)
+	}
+
+	check := func(db *Gouchstore) {
+		for id, rev := range expected {
+			docInfo, err := db.DocumentInfoById(id)
+			if err != nil {
+				t.Fatalf("%s: %v", id, err)
+			}
+			if docInfo.Rev != rev {
+				t.Errorf("expected %s to have rev %d, got %d", id, rev, docInfo.Rev)
+			}
+			if docInfo.Deleted {
+				continue
+			}
+			doc, err := db.DocumentByDocumentInfo(docInfo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(doc.Body) != fmt.Sprintf(`{"rev":%d}`, rev) {
+				t.Errorf("expected %s to have body for rev %d, got %s", id, rev, doc.Body)
+			}
+		}
+		localDoc, err := db.LocalDocumentById("_local/round")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(localDoc.Body) != "3" {
+			t.Errorf("expected local doc from the last round, got %s", localDoc.Body)
+		}
+		dbInfo, err := db.DatabaseInfo()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dbInfo.LastSeq != 1000+3*102 {
+			t.Errorf("expected last seq %d, got %d", 1000+3*102, dbInfo.LastSeq)
+		}
+		if dbInfo.DocumentCount != 500 || dbInfo.DeletedCount != 3 {
+			t.Errorf("expected 500 documents and 3 deleted, got %d and %d", dbInfo.DocumentCount, dbInfo.DeletedCount)
+		}
+		count := 0
+		err = db.ChangesSince(0, 0, func(g *Gouchstore, docInfo *DocumentInfo, userContext interface{}) error {
+			count++
+			return nil
+		}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 503 {
+			t.Errorf("expected 503 changes, got %d", count)
+		}
+	}
+	check(db)
+
+	// the handle keeps working on the compacted file
+	err = db.SaveDocument(&Document{ID: "after", Body: []byte(`{}`)}, &DocumentInfo{ID: "after", Rev: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// replayed bodies are not rewritten, so options which would are refused
+	err = db.CompactLiveWithOptions(context.Background(), "test-compacted.couch", &sync.Mutex{}, &CompactOptions{Recompress: true})
+	if err != ErrInvalidArguments {
+		t.Errorf("expected ErrInvalidArguments, got %v", err)
+	}
+	db.Close()
+
+	db, err = Open("test.couch", OPEN_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, err = db.DocumentInfoById("after")
+	if err != nil {
+		t.Errorf("expected document saved after compaction, got %v", err)
+	}
+	// the last round was committed with "after"
+	docInfo, err := db.DocumentInfoById("doc-005")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if docInfo.Rev != 5 {
+		t.Errorf("expected rev 5, got %d", docInfo.Rev)
+	}
+}
+
+func TestCompactLiveKeepsChangesUncommitted(t *testing.T) {
+	defer os.Remove("test.couch")
+	defer os.Remove("test-compacted.couch")
+
+	db, err := Open("test.couch", OPEN_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for rev := uint64(1); rev <= 3; rev++ {
+		for i := 0; i < 100; i++ {
+			id := fmt.Sprintf("doc-%03d", i)
+			err = db.SaveDocument(&Document{ID: id, Body: []byte(`{}`)}, &DocumentInfo{ID: id, Rev: rev})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = db.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// changes which are never committed
+	err = db.SaveDocument(&Document{ID: "doc-000", Body: []byte(`{}`)}, &DocumentInfo{ID: "doc-000", Rev: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.SaveDocument(&Document{ID: "uncommitted", Body: []byte(`{}`)}, &DocumentInfo{ID: "uncommitted", Rev: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.SaveLocalDocument(&LocalDocument{ID: "_local/uncommitted", Body: []byte(`{}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.CompactLive("test-compacted.couch", &sync.Mutex{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the handle still sees them
+	docInfo, err := db.DocumentInfoById("doc-000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if docInfo.Rev != 4 {
+		t.Errorf("expected the handle to see rev 4, got %d", docInfo.Rev)
+	}
+	_, err = db.DocumentInfoById("uncommitted")
+	if err != nil {
+		t.Errorf("expected the handle to see the uncommitted document, got %v", err)
+	}
+	_, err = db.LocalDocumentById("_local/uncommitted")
+	if err != nil {
+		t.Errorf("expected the handle to see the uncommitted local document, got %v", err)
+	}
+
+	// but they are dropped when it is closed without a commit
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open("test.couch", OPEN_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	docInfo, err = db.DocumentInfoById("doc-000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if docInfo.Rev != 3 {
+		t.Errorf("expected the committed rev 3, got %d", docInfo.Rev)
+	}
+	_, err = db.DocumentInfoById("uncommitted")
+	if err != ErrNotFound {
+		t.Errorf("expected the uncommitted document to be dropped, got %v", err)
+	}
+	_, err = db.LocalDocumentById("_local/uncommitted")
+	if err != ErrNotFound {
+		t.Errorf("expected the uncommitted local document to be dropped, got %v", err)
+	}
+	info, err := db.DatabaseInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.LastSeq != 300 || info.DocumentCount != 100 {
+		t.Errorf("expected 100 documents at seq 300, got %d at %d", info.DocumentCount, info.LastSeq)
+	}
+}
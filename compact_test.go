@@ -11,10 +11,14 @@ package gouchstore
 
 import (
 	"bytes"
+	"context"
 	"io"
+	"io/ioutil"
 	"os"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestCompactSmall(t *testing.T) {
@@ -310,3 +314,218 @@ func compareTwoDbFiles(t *testing.T, path1, path2 string) {
 	}
 
 }
+
+func TestCompactProgress(t *testing.T) {
+	defer os.Remove("test.couch")
+	defer os.Remove("test-compacted.couch")
+	db, err := Open("test.couch", OPEN_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = saveNumberedDocs(db, 0, 2500)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var reports []CompactProgress
+	err = db.CompactWithOptions(context.Background(), "test-compacted.couch", &CompactOptions{
+		Progress: func(progress CompactProgress) {
+			reports = append(reports, progress)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 3 {
+		t.Fatalf("expected 3 progress reports, got %d", len(reports))
+	}
+	if reports[0].DocsCopied != 1000 || reports[0].DocsTotal != 2500 {
+		t.Errorf("expected 1000 of 2500 docs copied, got %d of %d", reports[0].DocsCopied, reports[0].DocsTotal)
+	}
+	last := reports[len(reports)-1]
+	if last.DocsCopied != 2500 || last.DocsTotal != 2500 {
+		t.Errorf("expected all 2500 docs copied, got %d of %d", last.DocsCopied, last.DocsTotal)
+	}
+	if reports[0].BytesWritten <= 0 || reports[0].BytesWritten >= last.BytesWritten {
+		t.Errorf("expected bytes written to grow, got %d then %d", reports[0].BytesWritten, last.BytesWritten)
+	}
+}
+
+func TestCompactCancel(t *testing.T) {
+	defer os.Remove("test.couch")
+	tempDir := t.TempDir()
+	db, err := OpenWithOptions("test.couch", &Options{Create: true, CompactionTreeWriter: OnDiskTreeWriterFunc(tempDir)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = saveNumberedDocs(db, 0, 2500)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err = db.CompactWithOptions(ctx, "test-compacted.couch", &CompactOptions{
+		Progress: func(progress CompactProgress) {
+			cancel()
+		},
+	})
+	if err != context.Canceled {
+		t.Errorf("expected compaction to be cancelled, got %v", err)
+	}
+	_, err = os.Stat("test-compacted.couch")
+	if !os.IsNotExist(err) {
+		t.Errorf("expected the target file to be removed, got %v", err)
+	}
+	entries, err := ioutil.ReadDir(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("expected the temporary files to be removed, found %d", len(entries))
+	}
+
+	// an expired context stops compaction before it starts
+	ctx, cancel = context.WithTimeout(context.Background(), -time.Second)
+	defer cancel()
+	err = db.CompactWithOptions(ctx, "test-compacted.couch", nil)
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+
+	// a target which existed before is kept
+	defer os.Remove("test-compacted.couch")
+	err = ioutil.WriteFile("test-compacted.couch", nil, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	err = db.CompactWithOptions(ctx, "test-compacted.couch", &CompactOptions{
+		Progress: func(progress CompactProgress) {
+			cancel()
+		},
+	})
+	if err != context.Canceled {
+		t.Errorf("expected compaction to be cancelled, got %v", err)
+	}
+	_, err = os.Stat("test-compacted.couch")
+	if err != nil {
+		t.Errorf("expected the existing target file to be kept, got %v", err)
+	}
+}
+
+func TestCompactRewriteBodies(t *testing.T) {
+	defer os.Remove("test.couch")
+	defer os.Remove("test-compacted.couch")
+	db, err := Open("test.couch", OPEN_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	bodies := make(map[string]string)
+	for i := 0; i < 20; i++ {
+		id := "doc-" + strconv.Itoa(i)
+		bodies[id] = `{"body":"` + strings.Repeat(id, 20) + `"}`
+		docInfo := &DocumentInfo{ID: id, Rev: 1}
+		// every other document is stored uncompressed
+		docInfo.SetCompressed(i%2 == 0)
+		err = db.SaveDocument(&Document{ID: id, Body: []byte(bodies[id])}, docInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = db.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.CompactWithOptions(context.Background(), "test-compacted.couch", &CompactOptions{
+		Recompress: true,
+		Transform: func(docInfo *DocumentInfo, body []byte) ([]byte, error) {
+			docInfo.SetDatatype(DOC_IS_JSON)
+			return bytes.ToUpper(body), nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compacted, err := Open("test-compacted.couch", OPEN_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer compacted.Close()
+	err = compacted.ChangesSince(0, 0, func(g *Gouchstore, bySeq *DocumentInfo, userContext interface{}) error {
+		byId, err := g.DocumentInfoById(bySeq.ID)
+		if err != nil {
+			return err
+		}
+		for _, docInfo := range []*DocumentInfo{bySeq, byId} {
+			if !docInfo.Compressed() || docInfo.Datatype() != DOC_IS_JSON {
+				t.Errorf("expected %s to be compressed json, got content meta %d", docInfo.ID, docInfo.ContentMeta)
+			}
+		}
+		if bySeq.Size != byId.Size || bySeq.bodyPosition != byId.bodyPosition {
+			t.Errorf("expected %s to match in both trees, got %v and %v", bySeq.ID, bySeq, byId)
+		}
+		doc, err := g.DocumentByDocumentInfo(byId)
+		if err != nil {
+			return err
+		}
+		if string(doc.Body) != strings.ToUpper(bodies[bySeq.ID]) {
+			t.Errorf("expected transformed body for %s, got %s", bySeq.ID, doc.Body)
+		}
+		return nil
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the uncompressed documents shrink
+	before, err := db.DocumentInfoById("doc-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := compacted.DocumentInfoById("doc-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Size >= before.Size {
+		t.Errorf("expected compressing to shrink doc-1 from %d, got %d", before.Size, after.Size)
+	}
+}
+
+func TestCompactCodec(t *testing.T) {
+	defer os.Remove("test.couch")
+	defer os.Remove("test-compacted.couch")
+	db, err := Open("test.couch", OPEN_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = saveNumberedDocs(db, 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.CompactWithOptions(context.Background(), "test-compacted.couch", &CompactOptions{Codec: &xorCodec{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	compacted, err := OpenWithOptions("test-compacted.couch", &Options{ReadOnly: true, Codec: &xorCodec{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer compacted.Close()
+	doc, err := compacted.DocumentById("doc-00000042")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(doc.Body) != `{"abc":123}` {
+		t.Errorf("expected body {\"abc\":123}, got %s", doc.Body)
+	}
+}
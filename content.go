@@ -0,0 +1,100 @@
+//  Copyright (c) 2014 Marty Schoch
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package gouchstore
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+// JSONMode controls whether documents are checked for JSON when they are saved.
+type JSONMode int
+
+const (
+	// JSON_MODE_OFF stores the ContentMeta exactly as given.
+	JSON_MODE_OFF JSONMode = iota
+	// JSON_MODE_DETECT sets the datatype from the body, tagging invalid documents.
+	JSON_MODE_DETECT
+	// JSON_MODE_VALIDATE is like JSON_MODE_DETECT, but refuses to save invalid documents.
+	JSON_MODE_VALIDATE
+)
+
+// DatatypeString returns a readable name for a ContentMeta datatype.
+func DatatypeString(datatype byte) string {
+	switch datatype &^ DOC_IS_COMPRESSED {
+	case DOC_IS_JSON:
+		return "json"
+	case DOC_INVALID_JSON:
+		return "invalid_json"
+	case DOC_INVALID_JSON_KEY:
+		return "invalid_json_key"
+	case DOC_NON_JSON_MODE:
+		return "non_json_mode"
+	}
+	return "unknown"
+}
+
+// detectDatatype classifies a document body the way couchstore does.
+// Bodies which are not JSON are DOC_INVALID_JSON, JSON objects with
+// top-level keys starting with an underscore (which are reserved)
+// are DOC_INVALID_JSON_KEY.
+func detectDatatype(body []byte) byte {
+	if !json.Valid(body) {
+		return DOC_INVALID_JSON
+	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	token, err := decoder.Token()
+	if err != nil {
+		return DOC_INVALID_JSON
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '{' {
+		return DOC_IS_JSON
+	}
+	for decoder.More() {
+		token, err = decoder.Token()
+		if err != nil {
+			return DOC_INVALID_JSON
+		}
+		if key, ok := token.(string); ok && strings.HasPrefix(key, "_") {
+			return DOC_INVALID_JSON_KEY
+		}
+		var value json.RawMessage
+		err = decoder.Decode(&value)
+		if err != nil {
+			return DOC_INVALID_JSON
+		}
+	}
+	return DOC_IS_JSON
+}
+
+// applyJSONMode sets the datatype of the documents about to be saved,
+// nothing is modified if the handle is validating and a document is invalid.
+func (g *Gouchstore) applyJSONMode(docs []*Document, docInfos []*DocumentInfo) error {
+	if g.jsonMode == JSON_MODE_OFF {
+		return nil
+	}
+	datatypes := make([]byte, len(docs))
+	for i, doc := range docs {
+		if doc == nil {
+			continue
+		}
+		datatypes[i] = detectDatatype(doc.Body)
+		if g.jsonMode == JSON_MODE_VALIDATE && datatypes[i] != DOC_IS_JSON {
+			return ErrInvalidJSON
+		}
+	}
+	for i, doc := range docs {
+		if doc != nil {
+			docInfos[i].SetDatatype(datatypes[i])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+//  Copyright (c) 2014 Marty Schoch
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package gouchstore
+
+import (
+	"os"
+	"testing"
+)
+
+func TestDatatypeAccessors(t *testing.T) {
+	docInfo := &DocumentInfo{}
+	docInfo.SetDatatype(DOC_INVALID_JSON_KEY)
+	docInfo.SetCompressed(true)
+	if docInfo.ContentMeta != DOC_INVALID_JSON_KEY|DOC_IS_COMPRESSED {
+		t.Errorf("expected content meta %d, got %d", DOC_INVALID_JSON_KEY|DOC_IS_COMPRESSED, docInfo.ContentMeta)
+	}
+	if docInfo.Datatype() != DOC_INVALID_JSON_KEY {
+		t.Errorf("expected datatype %d, got %d", DOC_INVALID_JSON_KEY, docInfo.Datatype())
+	}
+	docInfo.SetDatatype(DOC_IS_JSON)
+	if !docInfo.Compressed() {
+		t.Errorf("expected setting the datatype to keep the compressed flag")
+	}
+	docInfo.SetCompressed(false)
+	if docInfo.ContentMeta != DOC_IS_JSON {
+		t.Errorf("expected content meta %d, got %d", DOC_IS_JSON, docInfo.ContentMeta)
+	}
+}
+
+func TestDetectDatatype(t *testing.T) {
+	tests := []struct {
+		body     string
+		datatype byte
+	}{
+		{`{"abc":123}`, DOC_IS_JSON},
+		{`[1,2,3]`, DOC_IS_JSON},
+		{`"string"`, DOC_IS_JSON},
+		{`{"a":{"_nested":true}}`, DOC_IS_JSON},
+		{`{"_id":"abc"}`, DOC_INVALID_JSON_KEY},
+		{`{"a":1,"_b":2}`, DOC_INVALID_JSON_KEY},
+		{`{"abc":`, DOC_INVALID_JSON},
+		{`not json`, DOC_INVALID_JSON},
+		{``, DOC_INVALID_JSON},
+	}
+	for _, test := range tests {
+		datatype := detectDatatype([]byte(test.body))
+		if datatype != test.datatype {
+			t.Errorf("expected %s for %q, got %s", DatatypeString(test.datatype), test.body, DatatypeString(datatype))
+		}
+	}
+}
+
+func TestJSONDetectOnSave(t *testing.T) {
+	defer os.Remove("test.couch")
+	db, err := Open("test.couch", OPEN_CREATE|OPEN_JSON_DETECT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	bodies := map[string]string{
+		"json":    `{"abc":123}`,
+		"invalid": `abc`,
+		"key":     `{"_abc":123}`,
+	}
+	for id, body := range bodies {
+		err = db.SaveDocument(&Document{ID: id, Body: []byte(body)}, &DocumentInfo{ID: id, Rev: 1, ContentMeta: DOC_IS_COMPRESSED | DOC_NON_JSON_MODE})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expectedDatatypes := map[string]byte{
+		"json":    DOC_IS_JSON,
+		"invalid": DOC_INVALID_JSON,
+		"key":     DOC_INVALID_JSON_KEY,
+	}
+	for id, expectedDatatype := range expectedDatatypes {
+		docInfo, err := db.DocumentInfoById(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if docInfo.Datatype() != expectedDatatype {
+			t.Errorf("expected %s to have datatype %s, got %s", id, DatatypeString(expectedDatatype), DatatypeString(docInfo.Datatype()))
+		}
+		if !docInfo.Compressed() {
+			t.Errorf("expected %s to remain compressed", id)
+		}
+		doc, err := db.DocumentById(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(doc.Body) != bodies[id] {
+			t.Errorf("expected body %s, got %s", bodies[id], doc.Body)
+		}
+	}
+}
+
+func TestJSONValidateOnSave(t *testing.T) {
+	defer os.Remove("test.couch")
+	db, err := Open("test.couch", OPEN_CREATE|OPEN_JSON_VALIDATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	docs := []*Document{
+		&Document{ID: "a", Body: []byte(`{"abc":123}`)},
+		&Document{ID: "b", Body: []byte(`abc`)},
+	}
+	docInfos := []*DocumentInfo{
+		&DocumentInfo{ID: "a", Rev: 1},
+		&DocumentInfo{ID: "b", Rev: 1},
+	}
+	err = db.SaveDocuments(docs, docInfos)
+	if err != ErrInvalidJSON {
+		t.Fatalf("expected invalid json error, got %v", err)
+	}
+	_, err = db.DocumentInfoById("a")
+	if err != ErrNotFound {
+		t.Errorf("expected nothing to be saved from a rejected batch, got %v", err)
+	}
+
+	// deletions have no body to validate
+	err = db.SaveDocuments(docs[:1], docInfos[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.SaveDocument(nil, &DocumentInfo{ID: "a", Rev: 2, Deleted: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenConflictingJSONModes(t *testing.T) {
+	_, err := Open("test.couch", OPEN_CREATE|OPEN_JSON_DETECT|OPEN_JSON_VALIDATE)
+	if err != ErrInvalidArguments {
+		t.Errorf("expected invalid arguments, got %v", err)
+	}
+}
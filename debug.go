@@ -19,6 +19,10 @@ import (
 var matchLikelyKey = regexp.MustCompile(`^[[:print:]]*$`)
 
 func (g *Gouchstore) DebugAddress(w io.Writer, offsetAddress int64, printRawBytes, readLargeChunk bool, indexType int) error {
+	err := g.checkOpen()
+	if err != nil {
+		return err
+	}
 	if offsetAddress%4096 == 0 {
 		fmt.Fprintln(w, "Address is on a 4096 byte boundary...")
 		first := make([]byte, 1)
@@ -72,7 +76,10 @@ func (g *Gouchstore) DebugAddress(w io.Writer, offsetAddress int64, printRawByte
 			fmt.Fprintln(w, "Appears to be a leaf node...")
 			if indexType == -1 {
 				// try to guess the index type, this is just heuristic and will be wrong sometimes
-				k, _, _ := decodeKeyValue(chunk, 1)
+				k, _, _, err := decodeKeyValue(chunk, 1)
+				if err != nil {
+					return err
+				}
 				if matchLikelyKey.Match(k) {
 					indexType = 0
 					fmt.Fprintln(w, "Guessing this node is in the byId index")
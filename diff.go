@@ -0,0 +1,391 @@
+//  Copyright (c) 2014 Marty Schoch
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package gouchstore
+
+import (
+	"bytes"
+	"os"
+)
+
+// DiffType describes how a document differs between two databases.
+type DiffType int
+
+const (
+	// DIFF_ADDED documents are only in the second database.
+	DIFF_ADDED DiffType = iota
+	// DIFF_REMOVED documents are only in the first database.
+	DIFF_REMOVED
+	// DIFF_CHANGED documents are in both, but differ.
+	DIFF_CHANGED
+)
+
+func (t DiffType) String() string {
+	switch t {
+	case DIFF_ADDED:
+		return "added"
+	case DIFF_REMOVED:
+		return "removed"
+	case DIFF_CHANGED:
+		return "changed"
+	}
+	return "unknown"
+}
+
+// DiffCallback is invoked by Diff for each document which differs, with its
+// info in the first database, before, and in the second, after.  before is
+// nil for added documents, after is nil for removed ones.
+type DiffCallback func(diffType DiffType, before, after *DocumentInfo, userContext interface{}) error
+
+// DiffOptions controls what Diff compares.
+type DiffOptions struct {
+	// CompareBodies also reports documents with the same revision but
+	// different bodies, which means reading the body of every document.
+	CompareBodies bool
+}
+
+// Diff reports the documents which were added, removed or changed going
+// from database a to database b, in ID order.  Documents are changed when
+// their revision, revision meta-data or deleted flag differ.
+func Diff(a, b *Gouchstore, cb DiffCallback, userContext interface{}) error {
+	return DiffWithOptions(a, b, nil, cb, userContext)
+}
+
+// DiffWithOptions is Diff, comparing as described by options, which may be
+// nil.
+//
+// The by-id trees are walked in lockstep.  When a and b are handles on the
+// same file, such as two snapshots of it, the subtrees they share are
+// skipped without being read.  So are subtrees with the same content hash,
+// when both files have them and bodies are not compared.
+func DiffWithOptions(a, b *Gouchstore, options *DiffOptions, cb DiffCallback, userContext interface{}) error {
+	if a == nil || b == nil || cb == nil {
+		return ErrInvalidArguments
+	}
+	if options == nil {
+		options = &DiffOptions{}
+	}
+	return diffByIds(a, b, options, cb, userContext, nil)
+}
+
+// KeyRange is a range of document IDs, from Start to End inclusive.
+type KeyRange struct {
+	Start string
+	End   string
+}
+
+// DiffRanges returns the ranges of IDs in which a and b differ, each
+// covering a run of documents which differ, as Diff would report them, with
+// none the same in between.  Only the subtrees whose content hashes differ
+// are read, so when both databases maintain them, see Options.ContentHash,
+// this costs about the number of ranges times the height of the trees.
+// Like Diff without DiffOptions.CompareBodies, documents with the same
+// revision and RevMeta count as the same even if their bodies differ.
+func DiffRanges(a, b *Gouchstore) ([]KeyRange, error) {
+	if a == nil || b == nil {
+		return nil, ErrInvalidArguments
+	}
+	var rv []KeyRange
+	open := false
+	err := diffByIds(a, b, &DiffOptions{}, func(diffType DiffType, before, after *DocumentInfo, userContext interface{}) error {
+		id := ""
+		if before != nil {
+			id = before.ID
+		} else {
+			id = after.ID
+		}
+		if open {
+			rv[len(rv)-1].End = id
+		} else {
+			rv = append(rv, KeyRange{Start: id, End: id})
+			open = true
+		}
+		return nil
+	}, nil, func() {
+		open = false
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rv, nil
+}
+
+// ContentHash returns a hash of the documents in the database, the same for
+// any two databases holding the same revisions of the same documents, or
+// nil if the database does not maintain them for all of its documents.
+func (g *Gouchstore) ContentHash() []byte {
+	if g.header.byIdRoot == nil {
+		if g.contentHash {
+			return make([]byte, gs_BY_ID_HASH_SIZE)
+		}
+		return nil
+	}
+	hash := decodeByIdReduceHash(g.header.byIdRoot.reducedValue)
+	if hash == nil {
+		return nil
+	}
+	return append([]byte{}, hash...)
+}
+
+// diffByIds walks the by-id trees of a and b, calling cb for the documents
+// which differ, and same, if not nil, for documents or subtrees which do not.
+func diffByIds(a, b *Gouchstore, options *DiffOptions, cb DiffCallback, userContext interface{}, same func()) error {
+	sameFile, err := a.sameFile(b)
+	if err != nil {
+		return err
+	}
+	ac := newTreeCursor(a, a.header.byIdRoot)
+	bc := newTreeCursor(b, b.header.byIdRoot)
+
+	for ac.item != nil || bc.item != nil {
+		ai, bi := ac.item, bc.item
+		switch {
+		case ai != nil && ai.pointer != nil && bi != nil && bi.pointer != nil:
+			if (sameFile && ai.pointer.pointer == bi.pointer.pointer) ||
+				(!options.CompareBodies && sameContent(ai.pointer, bi.pointer)) {
+				if same != nil {
+					same()
+				}
+				err = ac.next()
+				if err == nil {
+					err = bc.next()
+				}
+				break
+			}
+			// descend into the subtree reaching further, the other may
+			// still line up with one of its children
+			cmp := compareSubtreeKeys(ai.key, bi.key)
+			if cmp >= 0 {
+				err = ac.descend()
+			}
+			if err == nil && cmp <= 0 {
+				err = bc.descend()
+			}
+		case ai != nil && ai.pointer != nil:
+			err = ac.descend()
+		case bi != nil && bi.pointer != nil:
+			err = bc.descend()
+		default:
+			cmp := 1
+			if ai != nil && bi != nil {
+				cmp = gouchstoreIdComparator(ai.key, bi.key)
+			} else if ai != nil {
+				cmp = -1
+			}
+			err = diffLeafItems(a, b, sameFile, options, ai, bi, cmp, cb, userContext, same)
+			if err == nil && cmp <= 0 {
+				err = ac.next()
+			}
+			if err == nil && cmp >= 0 {
+				err = bc.next()
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// diffLeafItems reports the difference between the leaf items ai and bi, of
+// which only the lesser is considered unless cmp is 0.
+func diffLeafItems(a, b *Gouchstore, sameFile bool, options *DiffOptions, ai, bi *treeCursorItem, cmp int, cb DiffCallback, userContext interface{}, same func()) error {
+	var before, after *DocumentInfo
+	if cmp <= 0 {
+		before = &DocumentInfo{ID: string(ai.key)}
+		err := decodeByIdValue(before, ai.value)
+		if err != nil {
+			return err
+		}
+	}
+	if cmp >= 0 {
+		after = &DocumentInfo{ID: string(bi.key)}
+		err := decodeByIdValue(after, bi.value)
+		if err != nil {
+			return err
+		}
+	}
+	if cmp < 0 {
+		return cb(DIFF_REMOVED, before, nil, userContext)
+	} else if cmp > 0 {
+		return cb(DIFF_ADDED, nil, after, userContext)
+	}
+
+	changed := before.Rev != after.Rev || before.Deleted != after.Deleted || !bytes.Equal(before.RevMeta, after.RevMeta)
+	if !changed && options.CompareBodies && !before.Deleted &&
+		!(sameFile && before.bodyPosition == after.bodyPosition) {
+		beforeDoc, err := a.DocumentByDocumentInfo(before)
+		if err != nil {
+			return err
+		}
+		afterDoc, err := b.DocumentByDocumentInfo(after)
+		if err != nil {
+			return err
+		}
+		changed = !bytes.Equal(beforeDoc.Body, afterDoc.Body)
+	}
+	if changed {
+		return cb(DIFF_CHANGED, before, after, userContext)
+	}
+	if same != nil {
+		same()
+	}
+	return nil
+}
+
+// sameContent reports whether two subtrees hold the same documents, as far
+// as their content hashes and counts tell.
+func sameContent(a, b *nodePointer) bool {
+	aHash := decodeByIdReduceHash(a.reducedValue)
+	bHash := decodeByIdReduceHash(b.reducedValue)
+	if aHash == nil || bHash == nil {
+		return false
+	}
+	aNotDeleted, aDeleted, _ := decodeByIdReduce(a.reducedValue)
+	bNotDeleted, bDeleted, _ := decodeByIdReduce(b.reducedValue)
+	return aNotDeleted == bNotDeleted && aDeleted == bDeleted && bytes.Equal(aHash, bHash)
+}
+
+// compareSubtreeKeys compares the last keys of two subtrees, the nil key of
+// a root reaches past every other.
+func compareSubtreeKeys(a, b []byte) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return 1
+	case b == nil:
+		return -1
+	}
+	return gouchstoreIdComparator(a, b)
+}
+
+// sameFile reports whether g and other are handles on the same file, so
+// that their pointers refer to the same data.
+func (g *Gouchstore) sameFile(other *Gouchstore) (bool, error) {
+	gi, err := g.file.Stat()
+	if err != nil {
+		return false, err
+	}
+	oi, err := other.file.Stat()
+	if err != nil {
+		return false, err
+	}
+	return os.SameFile(gi, oi), nil
+}
+
+// treeCursorItem is either a subtree, with its pointer, or a leaf key and
+// value.
+type treeCursorItem struct {
+	key     []byte
+	value   []byte
+	pointer *nodePointer
+}
+
+type treeCursorFrame struct {
+	pos  int64
+	leaf bool
+	kvi  *keyValueIterator
+}
+
+// treeCursor steps through a btree in key order, one item at a time, only
+// reading the subtrees it is asked to descend into.
+type treeCursor struct {
+	g     *Gouchstore
+	stack []*treeCursorFrame
+	item  *treeCursorItem
+}
+
+func newTreeCursor(g *Gouchstore, root *nodePointer) *treeCursor {
+	rv := &treeCursor{g: g}
+	if root != nil {
+		rv.item = &treeCursorItem{pointer: root}
+	}
+	return rv
+}
+
+// next moves past the current item, item is nil at the end of the tree.
+func (c *treeCursor) next() error {
+	c.item = nil
+	for len(c.stack) > 0 {
+		top := c.stack[len(c.stack)-1]
+		k, v := top.kvi.Next()
+		if k == nil {
+			if top.kvi.Err() != nil {
+				return corruptNode(top.pos, top.kvi.Err())
+			}
+			c.stack = c.stack[:len(c.stack)-1]
+			continue
+		}
+		if top.leaf {
+			c.item = &treeCursorItem{key: k, value: v}
+			return nil
+		}
+		pointer, err := decodeNodePointer(v)
+		if err != nil {
+			return corruptNode(top.pos, err)
+		}
+		pointer.key = k
+		c.item = &treeCursorItem{key: k, pointer: pointer}
+		return nil
+	}
+	return nil
+}
+
+// descend replaces the current subtree with the first of its items.
+func (c *treeCursor) descend() error {
+	pos := int64(c.item.pointer.pointer)
+	nodeData, err := c.g.readNodeAt(pos)
+	if err != nil {
+		return err
+	}
+	if nodeData[0] != gs_BTREE_INTERIOR && nodeData[0] != gs_BTREE_LEAF {
+		return corruptAt(pos, CHUNK_TYPE_NODE, ErrBadNodeType)
+	}
+	c.stack = append(c.stack, &treeCursorFrame{
+		pos:  pos,
+		leaf: nodeData[0] == gs_BTREE_LEAF,
+		kvi:  newKeyValueIterator(nodeData[1:]),
+	})
+	return c.next()
+}
+
+// Snapshot opens a second, read only, handle on the database as it was when
+// the header at headerPosition was written, such as one reported earlier by
+// DatabaseInfo.  The snapshot must be closed, and does not see later changes.
+func (g *Gouchstore) Snapshot(headerPosition uint64) (*Gouchstore, error) {
+	pos := int64(headerPosition)
+	if pos%gs_BLOCK_SIZE != 0 || pos > g.pos {
+		return nil, ErrInvalidArguments
+	}
+	marker := make([]byte, gs_BLOCK_MARKER_SIZE)
+	_, err := g.ops.ReadAt(g.file, marker, pos)
+	if err != nil {
+		return nil, err
+	}
+	if marker[0] != gs_BLOCK_HEADER {
+		return nil, corruptAt(pos, CHUNK_TYPE_HEADER, ErrNoHeader)
+	}
+	h, err := g.readHeaderAt(pos)
+	if err != nil {
+		return nil, err
+	}
+	h.position = headerPosition
+
+	options := g.options
+	options.Create = false
+	options.ReadOnly = true
+	rv, err := OpenWithOptions(g.filename, &options)
+	if err != nil {
+		return nil, err
+	}
+	rv.header = h
+	rv.setCommitted()
+	return rv, nil
+}
@@ -0,0 +1,339 @@
+//  Copyright (c) 2014 Marty Schoch
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package gouchstore
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sync/atomic"
+	"testing"
+)
+
+type readCountingGouchOps struct {
+	*BaseGouchOps
+	reads     int32
+	bytesRead int64
+}
+
+func (g *readCountingGouchOps) ReadAt(f *os.File, b []byte, off int64) (int, error) {
+	atomic.AddInt32(&g.reads, 1)
+	atomic.AddInt64(&g.bytesRead, int64(len(b)))
+	return g.BaseGouchOps.ReadAt(f, b, off)
+}
+
+// collectDiff returns the differences between a and b, as "type id" strings.
+func collectDiff(a, b *Gouchstore, options *DiffOptions) ([]string, error) {
+	var rv []string
+	err := DiffWithOptions(a, b, options, func(diffType DiffType, before, after *DocumentInfo, userContext interface{}) error {
+		switch diffType {
+		case DIFF_ADDED:
+			rv = append(rv, fmt.Sprintf("%v %s", diffType, after.ID))
+		case DIFF_REMOVED:
+			rv = append(rv, fmt.Sprintf("%v %s", diffType, before.ID))
+		default:
+			if before.ID != after.ID {
+				return fmt.Errorf("expected the same document, got %s and %s", before.ID, after.ID)
+			}
+			rv = append(rv, fmt.Sprintf("%v %s", diffType, before.ID))
+		}
+		return nil
+	}, nil)
+	return rv, err
+}
+
+func TestDiff(t *testing.T) {
+	defer os.Remove("test.couch")
+	defer os.Remove("test2.couch")
+
+	ops := &readCountingGouchOps{BaseGouchOps: NewBaseGouchOps()}
+	db, err := OpenEx("test.couch", OPEN_CREATE, ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var docs []*Document
+	var docInfos []*DocumentInfo
+	for i := 0; i < 5000; i++ {
+		id := fmt.Sprintf("doc-%04d", i)
+		docs = append(docs, &Document{ID: id, Body: []byte(fmt.Sprintf(`{"i":%d}`, i))})
+		docInfos = append(docInfos, &DocumentInfo{ID: id, Rev: 1})
+	}
+	err = db.SaveDocuments(docs, docInfos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := db.DatabaseInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := info.HeaderPosition
+
+	err = db.SaveDocument(&Document{ID: "doc-0100", Body: []byte(`{}`)}, &DocumentInfo{ID: "doc-0100", Rev: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.SaveDocument(nil, &DocumentInfo{ID: "doc-0200", Rev: 2, Deleted: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.SaveDocument(&Document{ID: "doc-9999", Body: []byte(`{}`)}, &DocumentInfo{ID: "doc-9999", Rev: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// same revision, different body
+	err = db.SaveDocument(&Document{ID: "doc-0300", Body: []byte(`{}`)}, &DocumentInfo{ID: "doc-0300", Rev: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot, err := db.Snapshot(before)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snapshot.Close()
+	_, err = snapshot.DocumentInfoById("doc-9999")
+	if err != ErrNotFound {
+		t.Errorf("expected the snapshot not to see later changes, got %v", err)
+	}
+
+	expected := []string{"changed doc-0100", "changed doc-0200", "added doc-9999"}
+	atomic.StoreInt32(&ops.reads, 0)
+	diff, err := collectDiff(snapshot, db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(diff, expected) {
+		t.Errorf("expected %v, got %v", expected, diff)
+	}
+	diffReads := atomic.LoadInt32(&ops.reads)
+	atomic.StoreInt32(&ops.reads, 0)
+	err = db.AllDocuments("", "", func(g *Gouchstore, docInfo *DocumentInfo, userContext interface{}) error {
+		return nil
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if walkReads := atomic.LoadInt32(&ops.reads); diffReads*4 > walkReads {
+		t.Errorf("expected shared subtrees to be skipped, diff read %d times, a walk %d", diffReads, walkReads)
+	}
+
+	expectedBodies := []string{"changed doc-0100", "changed doc-0200", "changed doc-0300", "added doc-9999"}
+	diff, err = collectDiff(snapshot, db, &DiffOptions{CompareBodies: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(diff, expectedBodies) {
+		t.Errorf("expected %v, got %v", expectedBodies, diff)
+	}
+
+	// a different file, laid out differently
+	err = db.Compact("test2.couch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	compacted, err := Open("test2.couch", OPEN_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer compacted.Close()
+	diff, err = collectDiff(snapshot, compacted, &DiffOptions{CompareBodies: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(diff, expectedBodies) {
+		t.Errorf("expected %v, got %v", expectedBodies, diff)
+	}
+	diff, err = collectDiff(compacted, snapshot, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{"changed doc-0100", "changed doc-0200", "removed doc-9999"}
+	if !reflect.DeepEqual(diff, expected) {
+		t.Errorf("expected %v, got %v", expected, diff)
+	}
+	diff, err = collectDiff(db, compacted, &DiffOptions{CompareBodies: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diff) != 0 {
+		t.Errorf("expected no differences after compaction, got %v", diff)
+	}
+
+	_, err = db.Snapshot(before + 1)
+	if err != ErrInvalidArguments {
+		t.Errorf("expected ErrInvalidArguments, got %v", err)
+	}
+}
+
+func TestContentHash(t *testing.T) {
+	defer os.Remove("test.couch")
+	defer os.Remove("test2.couch")
+	defer os.Remove("test3.couch")
+	defer os.Remove("test4.couch")
+
+	db, err := OpenWithOptions("test.couch", &Options{Create: true, ContentHash: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if !reflect.DeepEqual(db.ContentHash(), make([]byte, gs_BY_ID_HASH_SIZE)) {
+		t.Errorf("expected the empty hash, got % x", db.ContentHash())
+	}
+	for i := 0; i < 5000; i += 100 {
+		var docs []*Document
+		var docInfos []*DocumentInfo
+		for j := i; j < i+100; j++ {
+			id := fmt.Sprintf("doc-%04d", (j*7)%5000)
+			docs = append(docs, &Document{ID: id, Body: []byte(`{}`)})
+			docInfos = append(docInfos, &DocumentInfo{ID: id, Rev: 1})
+		}
+		err = db.SaveDocuments(docs, docInfos)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = db.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := db.ContentHash()
+	if len(hash) != gs_BY_ID_HASH_SIZE {
+		t.Fatalf("expected a content hash, got % x", hash)
+	}
+
+	// compaction keeps the hashes, the same documents hash the same
+	err = db.Compact("test2.couch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Compact("test3.couch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	a, err := Open("test2.couch", OPEN_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	if !reflect.DeepEqual(a.ContentHash(), hash) {
+		t.Errorf("expected hash % x after compaction, got % x", hash, a.ContentHash())
+	}
+
+	// the hashes are kept up to date without the option
+	ops := &readCountingGouchOps{BaseGouchOps: NewBaseGouchOps()}
+	b, err := OpenEx("test3.couch", 0, ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	for _, id := range []string{"doc-0100", "doc-0101", "doc-3000"} {
+		err = b.SaveDocument(&Document{ID: id, Body: []byte(`{}`)}, &DocumentInfo{ID: id, Rev: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = b.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.ContentHash() == nil || reflect.DeepEqual(b.ContentHash(), hash) {
+		t.Errorf("expected the content hash to change, got % x", b.ContentHash())
+	}
+
+	atomic.StoreInt32(&ops.reads, 0)
+	ranges, err := DiffRanges(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []KeyRange{{"doc-0100", "doc-0101"}, {"doc-3000", "doc-3000"}}
+	if !reflect.DeepEqual(ranges, expected) {
+		t.Errorf("expected %v, got %v", expected, ranges)
+	}
+	diffReads := atomic.LoadInt32(&ops.reads)
+	atomic.StoreInt32(&ops.reads, 0)
+	err = b.AllDocuments("", "", func(g *Gouchstore, docInfo *DocumentInfo, userContext interface{}) error {
+		return nil
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if walkReads := atomic.LoadInt32(&ops.reads); diffReads*4 > walkReads {
+		t.Errorf("expected subtrees with the same hash to be skipped, read %d times, a walk %d", diffReads, walkReads)
+	}
+
+	// putting the documents back gives back the hash
+	for _, id := range []string{"doc-0100", "doc-0101", "doc-3000"} {
+		err = b.SaveDocument(&Document{ID: id, Body: []byte(`{}`)}, &DocumentInfo{ID: id, Rev: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !reflect.DeepEqual(b.ContentHash(), hash) {
+		t.Errorf("expected hash % x, got % x", hash, b.ContentHash())
+	}
+
+	// bodies are not hashed, only comparing them finds a body changed in place
+	err = b.SaveDocument(&Document{ID: "doc-0200", Body: []byte(`{"changed":true}`)}, &DocumentInfo{ID: "doc-0200", Rev: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ranges, err = DiffRanges(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ranges) != 0 {
+		t.Errorf("expected the body change to be missed, got %v", ranges)
+	}
+	var changed []string
+	err = DiffWithOptions(a, b, &DiffOptions{CompareBodies: true}, func(diffType DiffType, before, after *DocumentInfo, userContext interface{}) error {
+		changed = append(changed, after.ID)
+		return nil
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(changed, []string{"doc-0200"}) {
+		t.Errorf("expected doc-0200 to differ, got %v", changed)
+	}
+
+	// without hashes every document is compared
+	plain, err := Open("test4.couch", OPEN_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	for i := 0; i < 5000; i++ {
+		id := fmt.Sprintf("doc-%04d", i)
+		err = plain.SaveDocument(&Document{ID: id, Body: []byte(`{}`)}, &DocumentInfo{ID: id, Rev: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if plain.ContentHash() != nil {
+		t.Errorf("expected no content hash, got % x", plain.ContentHash())
+	}
+	ranges, err = DiffRanges(plain, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ranges) != 0 {
+		t.Errorf("expected no differences, got %v", ranges)
+	}
+}
@@ -10,19 +10,92 @@
 package gouchstore
 
 import (
+	"errors"
 	"fmt"
 )
 
-var gs_ERROR_INVALID_ARGUMENTS = fmt.Errorf("invalid arguments")
-var gs_ERROR_INVALID_CHUNK_SHORT_PREFIX = fmt.Errorf("invalid chunk, prefix too short")
-var gs_ERROR_INVALID_CHUNK_SIZE_TOO_SMALL = fmt.Errorf("invalid chunk, chunk size too small")
-var gs_ERROR_INVALID_CHUNK_DATA_LESS_THAN_SIZE = fmt.Errorf("invalid chunk, data less than size")
-var gs_ERROR_INVALID_CHUNK_BAD_CRC = fmt.Errorf("invalid chunk, bad crc")
+var ErrInvalidArguments = errors.New("invalid arguments")
+var ErrNotFound = errors.New("document not found")
+var ErrClosed = errors.New("gouchstore is closed")
+var ErrReadOnly = errors.New("gouchstore is read only")
+var ErrLocked = errors.New("gouchstore is locked by another process")
+var ErrKeyTooLarge = errors.New("document id too large")
+var ErrDocumentTooLarge = errors.New("document too large")
+var ErrInvalidJSON = errors.New("document is not valid json")
+var ErrInvalidRevMeta = errors.New("invalid couchbase rev meta")
+var ErrNotEmpty = errors.New("gouchstore is not empty")
+var ErrDuplicateID = errors.New("duplicate document id")
 
-var gs_ERROR_INVALID_HEADER_BAD_SIZE = fmt.Errorf("invalid header, bad size")
+// ErrCorrupt matches every error caused by invalid data in the file, use
+// errors.As with a *CorruptError to find out where the problem is.
+var ErrCorrupt = errors.New("corrupt")
 
-var gs_ERROR_INVALID_BTREE_NODE_TYPE = fmt.Errorf("invalid btree node, bad type")
+// The reasons a chunk may be found corrupt, wrapped in a *CorruptError.
+var ErrChunkShortPrefix = errors.New("invalid chunk, prefix too short")
+var ErrChunkSizeTooSmall = errors.New("invalid chunk, chunk size too small")
+var ErrChunkDataLessThanSize = errors.New("invalid chunk, data less than size")
+var ErrChunkBadCRC = errors.New("invalid chunk, bad crc")
+var ErrChunkBadCompression = errors.New("invalid chunk, bad compression")
+var ErrHeaderBadSize = errors.New("invalid header, bad size")
+var ErrNoHeader = errors.New("no valid header found")
+var ErrBadNodeType = errors.New("invalid btree node, bad type")
+var ErrShortData = errors.New("invalid data, too short")
 
-var gs_ERROR_DOCUMENT_NOT_FOUND = fmt.Errorf("document not found")
+// ChunkType identifies what a chunk in the file holds.
+type ChunkType int
 
-var gs_ERROR_CORRUPT = fmt.Errorf("corrupt")
+const (
+	CHUNK_TYPE_UNKNOWN ChunkType = iota
+	CHUNK_TYPE_DATA
+	CHUNK_TYPE_HEADER
+	CHUNK_TYPE_NODE
+)
+
+func (c ChunkType) String() string {
+	switch c {
+	case CHUNK_TYPE_DATA:
+		return "data"
+	case CHUNK_TYPE_HEADER:
+		return "header"
+	case CHUNK_TYPE_NODE:
+		return "node"
+	}
+	return "unknown"
+}
+
+// CorruptError describes a chunk which could not be read, Err is one of the
+// ErrChunk* reasons.  It matches ErrCorrupt with errors.Is.
+type CorruptError struct {
+	Offset    int64
+	ChunkType ChunkType
+	Err       error
+}
+
+func (e *CorruptError) Error() string {
+	return fmt.Sprintf("corrupt %s chunk at offset %d: %v", e.ChunkType, e.Offset, e.Err)
+}
+
+func (e *CorruptError) Unwrap() error {
+	return e.Err
+}
+
+func (e *CorruptError) Is(target error) bool {
+	return target == ErrCorrupt
+}
+
+// corruptNode attributes a decoding failure to the node the data came from,
+// other errors are returned as they are.
+func corruptNode(pos int64, err error) error {
+	if err == ErrShortData || err == ErrBadNodeType {
+		return corruptAt(pos, CHUNK_TYPE_NODE, err)
+	}
+	return err
+}
+
+func corruptAt(pos int64, chunkType ChunkType, err error) error {
+	return &CorruptError{
+		Offset:    pos,
+		ChunkType: chunkType,
+		Err:       err,
+	}
+}
@@ -0,0 +1,183 @@
+//  Copyright (c) 2014 Marty Schoch
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package gouchstore
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestUseAfterClose(t *testing.T) {
+	defer os.Remove("test.couch")
+	db, err := Open("test.couch", OPEN_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.Close()
+	if err != ErrClosed {
+		t.Errorf("expected closing twice to fail with ErrClosed, got %v", err)
+	}
+	_, err = db.DocumentById("a")
+	if err != ErrClosed {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+	_, err = db.DatabaseInfo()
+	if err != ErrClosed {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+	err = db.SaveDocument(&Document{ID: "a", Body: []byte(`{}`)}, &DocumentInfo{ID: "a", Rev: 1})
+	if err != ErrClosed {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+	err = db.Commit()
+	if err != ErrClosed {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestWriteReadOnly(t *testing.T) {
+	db, err := Open(testFileName, OPEN_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	err = db.SaveDocument(&Document{ID: "a", Body: []byte(`{}`)}, &DocumentInfo{ID: "a", Rev: 1})
+	if err != ErrReadOnly {
+		t.Errorf("expected ErrReadOnly, got %v", err)
+	}
+	err = db.SaveLocalDocument(&LocalDocument{ID: "_local/a", Body: []byte(`{}`)})
+	if err != ErrReadOnly {
+		t.Errorf("expected ErrReadOnly, got %v", err)
+	}
+	err = db.Commit()
+	if err != ErrReadOnly {
+		t.Errorf("expected ErrReadOnly, got %v", err)
+	}
+	err = db.CommitAsync(DURABILITY_DEFAULT).Wait()
+	if err != ErrReadOnly {
+		t.Errorf("expected ErrReadOnly, got %v", err)
+	}
+
+	// the handle is still usable for reads
+	dbInfo, err := db.DatabaseInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dbInfo.LastSeq != 101 {
+		t.Errorf("expected last seq 101, got %d", dbInfo.LastSeq)
+	}
+}
+
+func TestSaveDocumentsInvalidArguments(t *testing.T) {
+	defer os.Remove("test.couch")
+	db, err := Open("test.couch", OPEN_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	docs := []*Document{&Document{ID: "a", Body: []byte(`{}`)}}
+	err = db.SaveDocuments(docs, []*DocumentInfo{})
+	if err != ErrInvalidArguments {
+		t.Errorf("expected ErrInvalidArguments for mismatched lengths, got %v", err)
+	}
+	err = db.SaveDocuments(docs, []*DocumentInfo{nil})
+	if err != ErrInvalidArguments {
+		t.Errorf("expected ErrInvalidArguments for nil document info, got %v", err)
+	}
+	dbInfo, err := db.DatabaseInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dbInfo.LastSeq != 0 {
+		t.Errorf("expected nothing saved, got last seq %d", dbInfo.LastSeq)
+	}
+}
+
+func TestCorruptErrors(t *testing.T) {
+	defer os.Remove("test.couch")
+	db, err := Open("test.couch", OPEN_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	docInfo := &DocumentInfo{ID: "a", Rev: 1}
+	err = db.SaveDocument(&Document{ID: "a", Body: []byte(strings.Repeat("abc", 100))}, docInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	docInfo, err = db.DocumentInfoById("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodePos := int64(db.header.byIdRoot.pointer)
+	db.Close()
+
+	f, err := os.OpenFile("test.couch", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt([]byte{0xff, 0xff}, int64(docInfo.bodyPosition)+20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	db, err = Open("test.couch", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.DocumentByDocumentInfo(docInfo)
+	if !errors.Is(err, ErrCorrupt) || !errors.Is(err, ErrChunkBadCRC) {
+		t.Errorf("expected bad crc, got %v", err)
+	}
+	var corruptErr *CorruptError
+	if !errors.As(err, &corruptErr) {
+		t.Fatalf("expected a *CorruptError, got %T", err)
+	}
+	if corruptErr.Offset != int64(docInfo.bodyPosition) || corruptErr.ChunkType != CHUNK_TYPE_DATA {
+		t.Errorf("expected data chunk at %d, got %v", docInfo.bodyPosition, corruptErr)
+	}
+	db.Close()
+
+	f, err = os.OpenFile("test.couch", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt([]byte{0xff, 0xff}, nodePos+10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	db, err = Open("test.couch", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, err = db.DocumentInfoById("a")
+	if !errors.As(err, &corruptErr) {
+		t.Fatalf("expected a *CorruptError, got %v", err)
+	}
+	if corruptErr.Offset != nodePos || corruptErr.ChunkType != CHUNK_TYPE_NODE {
+		t.Errorf("expected node chunk at %d, got %v", nodePos, corruptErr)
+	}
+}
@@ -0,0 +1,374 @@
+//  Copyright (c) 2014 Marty Schoch
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package gouchstore
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The by-expiry index is an ordinary B-tree keyed by the 32bit expiry time
+// followed by the document ID.  Its root is stored in a local document so
+// files stay readable by couchstore.
+const gs_EXPIRY_ROOT_DOC_ID = "_local/gouchstore-expiry"
+
+var errStopIteration = fmt.Errorf("stop iteration")
+
+func (di *DocumentInfo) expired(now uint32) bool {
+	expiry := di.Expiry()
+	return expiry != 0 && expiry <= now
+}
+
+func expiryNow() uint32 {
+	return uint32(time.Now().Unix())
+}
+
+func expiryKey(expiry uint32, id []byte) []byte {
+	rv := make([]byte, 4+len(id))
+	copy(rv, encode_raw32(expiry))
+	copy(rv[4:], id)
+	return rv
+}
+
+type expiryActionList []modifyAction
+
+func (e expiryActionList) Len() int      { return len(e) }
+func (e expiryActionList) Swap(i, j int) { e[i], e[j] = e[j], e[i] }
+func (e expiryActionList) Less(i, j int) bool {
+	cmp := bytes.Compare(e[i].key, e[j].key)
+	if cmp == 0 {
+		// removes before inserts of the same key
+		return e[i].typ < e[j].typ
+	}
+	return cmp < 0
+}
+
+// updateExpiryIndex applies the removals collected while updating the id
+// tree, plus inserts for the new versions of the documents.
+func (g *Gouchstore) updateExpiryIndex(removes []modifyAction, ids, idvals [][]byte) error {
+	actions := append([]modifyAction{}, removes...)
+	for i, idval := range idvals {
+		docInfo := DocumentInfo{}
+		err := decodeByIdValue(&docInfo, idval)
+		if err != nil {
+			return err
+		}
+		expiry := docInfo.Expiry()
+		if docInfo.Deleted || expiry == 0 {
+			continue
+		}
+		actions = append(actions, modifyAction{
+			typ: gs_ACTION_INSERT,
+			key: expiryKey(expiry, ids[i]),
+		})
+	}
+	return g.modifyExpiryIndex(actions)
+}
+
+func (g *Gouchstore) modifyExpiryIndex(actions []modifyAction) error {
+	if len(actions) == 0 {
+		return nil
+	}
+	sort.Sort(expiryActionList(actions))
+
+	req := &modifyRequest{
+		cmp:              gouchstoreIdComparator,
+		actions:          actions,
+		reduce:           bySeqReduce,
+		rereduce:         bySeqReReduce,
+		kpChunkThreshold: g.thresholds.ById.KP,
+		kvChunkThreshold: g.thresholds.ById.KV,
+	}
+
+	nroot, err := g.modifyBtree(req, g.expiryRoot)
+	if err != nil {
+		return err
+	}
+	if nroot != g.expiryRoot {
+		g.expiryRoot = nroot
+		g.expiryRootDirty = true
+	}
+	return nil
+}
+
+func (g *Gouchstore) loadExpiryRoot() error {
+	localDoc, err := g.LocalDocumentById(gs_EXPIRY_ROOT_DOC_ID)
+	if err == ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	g.expiryRoot, err = decodeRootNodePointer(localDoc.Body)
+	if err != nil {
+		return ErrCorrupt
+	}
+	return nil
+}
+
+// saveExpiryRoot records the current root of the expiry index in its
+// local document, it must be called before the header is written.
+func (g *Gouchstore) saveExpiryRoot() error {
+	if !g.expiryRootDirty {
+		return nil
+	}
+	localDoc := &LocalDocument{
+		ID: gs_EXPIRY_ROOT_DOC_ID,
+	}
+	if g.expiryRoot != nil {
+		localDoc.Body = g.expiryRoot.encodeRoot()
+	} else {
+		localDoc.Deleted = true
+	}
+	err := g.SaveLocalDocument(localDoc)
+	if err != nil {
+		return err
+	}
+	g.expiryRootDirty = false
+	return nil
+}
+
+func expiredKeysCallback(req *lookupRequest, key []byte, value []byte) error {
+	context := req.callbackContext.(*expiredKeysContext)
+	if value == nil {
+		return nil
+	}
+	if len(context.keys) >= context.limit || bytes.Compare(key, context.endKey) >= 0 {
+		return errStopIteration
+	}
+	context.keys = append(context.keys, append([]byte{}, key...))
+	return nil
+}
+
+type expiredKeysContext struct {
+	keys   [][]byte
+	limit  int
+	endKey []byte
+}
+
+// expiredKeys returns up to limit keys of the expiry index, for documents
+// which expired at or before now.  Writes made without OPEN_EXPIRY do not
+// update the index, so the documents may since have changed.
+func (g *Gouchstore) expiredKeys(now uint32, limit int) ([][]byte, error) {
+	if g.expiryRoot == nil {
+		return nil, nil
+	}
+	context := expiredKeysContext{
+		limit:  limit,
+		endKey: encode_raw32(uint32(math.MaxUint32)),
+	}
+	if now < math.MaxUint32 {
+		context.endKey = encode_raw32(now + 1)
+	}
+	lr := lookupRequest{
+		compare:         gouchstoreIdComparator,
+		keys:            [][]byte{[]byte{}, context.endKey},
+		fetchCallback:   expiredKeysCallback,
+		fold:            true,
+		callbackContext: &context,
+	}
+	err := g.btreeLookup(&lr, g.expiryRoot.pointer)
+	if err != nil && err != errStopIteration {
+		return nil, err
+	}
+	return context.keys, nil
+}
+
+// expiredIds returns up to limit IDs of documents which expired at or before now.
+func (g *Gouchstore) expiredIds(now uint32, limit int) ([]string, error) {
+	keys, err := g.expiredKeys(now, limit)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(keys))
+	for i, key := range keys {
+		ids[i] = string(key[4:])
+	}
+	return ids, nil
+}
+
+// ExpireDocuments deletes up to batchSize documents which expired at or
+// before now (seconds since the Unix epoch), and returns how many were
+// deleted.  The handle must have been opened with OPEN_EXPIRY.
+//
+// Index entries left behind by writes made without OPEN_EXPIRY, for
+// documents which have since been deleted or given another expiry, are
+// fixed along the way and do not count towards batchSize.
+//
+// The deletions are not committed.
+func (g *Gouchstore) ExpireDocuments(now uint32, batchSize int) (int, error) {
+	err := g.checkWritable()
+	if err != nil {
+		return 0, err
+	}
+	if !g.expiry || batchSize < 1 {
+		return 0, ErrInvalidArguments
+	}
+	deleted := 0
+	for deleted < batchSize {
+		// every key found is either removed or has its document deleted,
+		// so each round makes progress
+		keys, err := g.expiredKeys(now, batchSize-deleted)
+		if err != nil {
+			return deleted, err
+		}
+		if len(keys) == 0 {
+			break
+		}
+		ids := make([]string, 0, len(keys))
+		seen := make(map[string]bool, len(keys))
+		for _, key := range keys {
+			id := string(key[4:])
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+		docInfos, err := g.rawDocumentInfosByIds(ids)
+		if err != nil {
+			return deleted, err
+		}
+		current := make(map[string]*DocumentInfo, len(docInfos))
+		for _, docInfo := range docInfos {
+			current[docInfo.ID] = docInfo
+		}
+
+		var fixes []modifyAction
+		var expired []*DocumentInfo
+		for _, key := range keys {
+			docInfo := current[string(key[4:])]
+			if docInfo != nil && !docInfo.Deleted && docInfo.Expiry() == decode_raw32(key[0:4]) {
+				docInfo.Rev++
+				expired = append(expired, docInfo)
+				// any other key for it is stale
+				delete(current, docInfo.ID)
+				continue
+			}
+			fixes = append(fixes, modifyAction{typ: gs_ACTION_REMOVE, key: key})
+			if docInfo != nil && !docInfo.Deleted && docInfo.Expiry() != 0 {
+				fixes = append(fixes, modifyAction{typ: gs_ACTION_INSERT, key: expiryKey(docInfo.Expiry(), []byte(docInfo.ID))})
+			}
+		}
+		err = g.modifyExpiryIndex(fixes)
+		if err != nil {
+			return deleted, err
+		}
+		if len(expired) > 0 {
+			err = g.SaveDocuments(make([]*Document, len(expired)), expired)
+			if err != nil {
+				return deleted, err
+			}
+			deleted += len(expired)
+		}
+	}
+	return deleted, nil
+}
+
+// ExpiryPager periodically deletes expired documents in the background.
+type ExpiryPager struct {
+	db        *Gouchstore
+	interval  time.Duration
+	batchSize int
+	lock      sync.Locker
+	quit      chan struct{}
+	done      chan struct{}
+	err       error
+}
+
+// StartExpiryPager starts deleting expired documents every interval, in
+// batches of batchSize documents, committing after each batch.
+//
+// Gouchstore handles are not safe for concurrent use, the pager holds lock
+// while it uses the handle, so callers must hold the same lock whenever they
+// use the handle.
+func (g *Gouchstore) StartExpiryPager(interval time.Duration, batchSize int, lock sync.Locker) *ExpiryPager {
+	rv := &ExpiryPager{
+		db:        g,
+		interval:  interval,
+		batchSize: batchSize,
+		lock:      lock,
+		quit:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go rv.run()
+	return rv
+}
+
+func (p *ExpiryPager) run() {
+	defer close(p.done)
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.quit:
+			return
+		case <-ticker.C:
+			p.err = p.page(expiryNow())
+			if p.err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (p *ExpiryPager) page(now uint32) error {
+	for {
+		p.lock.Lock()
+		n, err := p.db.ExpireDocuments(now, p.batchSize)
+		if err == nil && n > 0 {
+			err = p.db.Commit()
+		}
+		p.lock.Unlock()
+		if err != nil {
+			return err
+		}
+		if n < p.batchSize {
+			return nil
+		}
+		select {
+		case <-p.quit:
+			return nil
+		default:
+		}
+	}
+}
+
+// Stop stops the pager and waits for it to finish.  It returns the error
+// which stopped the pager early, if any.
+func (p *ExpiryPager) Stop() error {
+	select {
+	case <-p.done:
+	default:
+		close(p.quit)
+		<-p.done
+	}
+	return p.err
+}
+
+// expiryCompactHook drops documents which have expired by the time
+// compaction started.  Documents whose RevMeta is not in the Couchbase
+// layout never expire.
+func expiryCompactHook(target *Gouchstore, docInfo *DocumentInfo, context interface{}) (int, error) {
+	if docInfo == nil || docInfo.Deleted {
+		return COMPACT_KEEP_ITEM, nil
+	}
+	revMeta, err := docInfo.CouchbaseRevMeta()
+	if err != nil {
+		return COMPACT_KEEP_ITEM, nil
+	}
+	now := context.(uint32)
+	if revMeta.Expiry != 0 && revMeta.Expiry <= now {
+		return COMPACT_DROP_ITEM, nil
+	}
+	return COMPACT_KEEP_ITEM, nil
+}
@@ -0,0 +1,468 @@
+//  Copyright (c) 2014 Marty Schoch
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package gouchstore
+
+import (
+	"math"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func saveExpiringDocs(t *testing.T, db *Gouchstore, count int, expiry func(i int) uint32) {
+	for i := 0; i < count; i++ {
+		id := "doc-" + strconv.Itoa(i)
+		doc := &Document{
+			ID:   id,
+			Body: []byte(`{"abc":123}`),
+		}
+		docInfo := &DocumentInfo{
+			ID:          id,
+			Rev:         1,
+			ContentMeta: DOC_IS_COMPRESSED,
+		}
+		docInfo.SetExpiry(expiry(i))
+		err := db.SaveDocument(doc, docInfo)
+		if err != nil {
+			t.Fatalf("error saving %d: %v", i, err)
+		}
+	}
+}
+
+func TestExpiredDocumentsNotFound(t *testing.T) {
+	defer os.Remove("test.couch")
+	db, err := Open("test.couch", OPEN_CREATE|OPEN_EXPIRY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	past := uint32(time.Now().Add(-time.Hour).Unix())
+	future := uint32(time.Now().Add(time.Hour).Unix())
+	saveExpiringDocs(t, db, 3, func(i int) uint32 {
+		switch i {
+		case 0:
+			return past
+		case 1:
+			return future
+		}
+		return 0
+	})
+
+	_, err = db.DocumentById("doc-0")
+	if err != ErrNotFound {
+		t.Errorf("expected expired document to be not found, got %v", err)
+	}
+	for _, id := range []string{"doc-1", "doc-2"} {
+		_, err = db.DocumentById(id)
+		if err != nil {
+			t.Errorf("expected to find %s, got %v", id, err)
+		}
+	}
+	docInfos, err := db.DocumentInfosByIds([]string{"doc-0", "doc-1", "doc-2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docInfos) != 2 {
+		t.Errorf("expected 2 unexpired documents, got %d", len(docInfos))
+	}
+}
+
+func TestExpiredDocumentsHiddenFromEveryRead(t *testing.T) {
+	defer os.Remove("test.couch")
+	db, err := Open("test.couch", OPEN_CREATE|OPEN_EXPIRY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	past := uint32(time.Now().Add(-time.Hour).Unix())
+	future := uint32(time.Now().Add(time.Hour).Unix())
+	// doc-0 has expired, at sequence 1
+	saveExpiringDocs(t, db, 3, func(i int) uint32 {
+		switch i {
+		case 0:
+			return past
+		case 1:
+			return future
+		}
+		return 0
+	})
+	err = db.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []string
+	collect := func(g *Gouchstore, docInfo *DocumentInfo, userContext interface{}) error {
+		ids = append(ids, docInfo.ID)
+		return nil
+	}
+	collectKeys := func(g *Gouchstore, id []byte, userContext interface{}) error {
+		ids = append(ids, string(id))
+		return nil
+	}
+	collectDocs := func(g *Gouchstore, docInfo *DocumentInfo, doc *Document, userContext interface{}) error {
+		ids = append(ids, docInfo.ID)
+		return nil
+	}
+	reads := map[string]func() error{
+		"AllDocuments": func() error { return db.AllDocuments("", "", collect, nil) },
+		"ChangesSince": func() error { return db.ChangesSince(0, 0, collect, nil) },
+		"DocumentInfosBySeqs": func() error {
+			docInfos, err := db.DocumentInfosBySeqs([]uint64{1, 2, 3})
+			for _, docInfo := range docInfos {
+				ids = append(ids, docInfo.ID)
+			}
+			return err
+		},
+		"Scan":                  func() error { return db.Scan("", "", nil, collect, nil) },
+		"ScanKeys":              func() error { return db.ScanKeys("", "", nil, collectKeys, nil) },
+		"ScanChanges":           func() error { return db.ScanChanges(0, 0, nil, collect, nil) },
+		"AllDocumentsReadahead": func() error { return db.AllDocumentsReadahead("", "", nil, collectDocs, nil) },
+		"ChangesSinceReadahead": func() error { return db.ChangesSinceReadahead(0, 0, nil, collectDocs, nil) },
+	}
+	for name, read := range reads {
+		ids = nil
+		err = read()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(ids) != 2 || ids[0] != "doc-1" || ids[1] != "doc-2" {
+			t.Errorf("%s: expected doc-1 and doc-2, got %v", name, ids)
+		}
+	}
+
+	_, err = db.DocumentInfoBySeq(1)
+	if err != ErrNotFound {
+		t.Errorf("expected the expired document to be not found by sequence, got %v", err)
+	}
+	docInfos, err := db.rawDocumentInfosByIds([]string{"doc-0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docInfos) != 1 {
+		t.Fatalf("expected the expired document to still be stored")
+	}
+	_, err = db.OpenDocumentReader(docInfos[0])
+	if err != ErrNotFound {
+		t.Errorf("expected no reader for the expired document, got %v", err)
+	}
+
+	// without the expiry index nothing is hidden
+	plain, err := Open("test.couch", OPEN_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	ids = nil
+	err = plain.AllDocuments("", "", collect, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 3 {
+		t.Errorf("expected 3 documents without OPEN_EXPIRY, got %v", ids)
+	}
+}
+
+func TestExpireDocumentsInBatches(t *testing.T) {
+	defer os.Remove("test.couch")
+	db, err := Open("test.couch", OPEN_CREATE|OPEN_EXPIRY)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// even docs expire at 100+i, odd docs never expire
+	saveExpiringDocs(t, db, 100, func(i int) uint32 {
+		if i%2 == 0 {
+			return uint32(100 + i)
+		}
+		return 0
+	})
+	// move doc-0 out of the way, the old index entry must go
+	docInfo := &DocumentInfo{ID: "doc-0", Rev: 2, ContentMeta: DOC_IS_COMPRESSED}
+	docInfo.SetExpiry(1000)
+	err = db.SaveDocument(&Document{ID: "doc-0", Body: []byte(`{}`)}, docInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// the index must survive a reopen
+	db, err = Open("test.couch", OPEN_EXPIRY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	total := 0
+	for {
+		n, err := db.ExpireDocuments(200, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n > 10 {
+			t.Errorf("batch of %d exceeded batch size", n)
+		}
+		total += n
+		if n < 10 {
+			break
+		}
+	}
+	if total != 49 {
+		t.Errorf("expected 49 expired documents, got %d", total)
+	}
+
+	dbInfo, err := db.DatabaseInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dbInfo.DocumentCount != 51 || dbInfo.DeletedCount != 49 {
+		t.Errorf("expected 51 live and 49 deleted documents, got %d and %d", dbInfo.DocumentCount, dbInfo.DeletedCount)
+	}
+
+	n, err := db.ExpireDocuments(200, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("expected nothing left to expire, got %d", n)
+	}
+	n, err = db.ExpireDocuments(1000, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("expected the updated doc-0 to expire, got %d", n)
+	}
+}
+
+func TestExpireDocumentsStaleEntries(t *testing.T) {
+	defer os.Remove("test.couch")
+	db, err := Open("test.couch", OPEN_CREATE|OPEN_EXPIRY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saveExpiringDocs(t, db, 5, func(i int) uint32 {
+		return uint32(100 + i)
+	})
+	err = db.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// writes without OPEN_EXPIRY leave the index behind: doc-0 and doc-1
+	// no longer expire, doc-2 expires later and doc-3 is deleted
+	db, err = Open("test.couch", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, expiry := range []uint32{0, 0, 2000} {
+		id := "doc-" + strconv.Itoa(i)
+		docInfo := &DocumentInfo{ID: id, Rev: 2}
+		docInfo.SetExpiry(expiry)
+		err = db.SaveDocument(&Document{ID: id, Body: []byte(`{}`)}, docInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = db.SaveDocument(nil, &DocumentInfo{ID: "doc-3", Rev: 2, Deleted: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db, err = Open("test.couch", OPEN_EXPIRY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// the stale entries come first, and fill more than a batch
+	n, err := db.ExpireDocuments(1000, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("expected doc-4 to expire past the stale entries, got %d", n)
+	}
+	docInfos, err := db.rawDocumentInfosByIds([]string{"doc-4"})
+	if err != nil || len(docInfos) != 1 || !docInfos[0].Deleted {
+		t.Errorf("expected doc-4 to be deleted, got %v, %v", docInfos, err)
+	}
+	n, err = db.ExpireDocuments(1000, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("expected nothing left to expire, got %d", n)
+	}
+	docInfos, err = db.rawDocumentInfosByIds([]string{"doc-0", "doc-1", "doc-2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, docInfo := range docInfos {
+		if docInfo.Deleted {
+			t.Errorf("expected %s to be kept", docInfo.ID)
+		}
+	}
+
+	// doc-2 was indexed again at its new expiry
+	n, err = db.ExpireDocuments(3000, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("expected doc-2 to expire at its new time, got %d", n)
+	}
+	ids, err := db.expiredIds(math.MaxUint32, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 0 {
+		t.Errorf("expected an empty index, got %v", ids)
+	}
+}
+
+func TestExpiryPager(t *testing.T) {
+	defer os.Remove("test.couch")
+	db, err := Open("test.couch", OPEN_CREATE|OPEN_EXPIRY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	past := uint32(time.Now().Add(-time.Hour).Unix())
+	saveExpiringDocs(t, db, 25, func(i int) uint32 { return past })
+
+	var lock sync.Mutex
+	pager := db.StartExpiryPager(10*time.Millisecond, 10, &lock)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		lock.Lock()
+		ids, err := db.expiredIds(expiryNow(), 100)
+		lock.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ids) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("pager did not expire documents, %d left", len(ids))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	err = pager.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// countingTreeWriterFunc sorts in dir, counting the TreeWriters created.
+func countingTreeWriterFunc(dir string, count *int) TreeWriterFunc {
+	return func(keyCompare btreeKeyComparator, reduce, rereduce reduceFunc, reduceContext interface{}) (TreeWriter, error) {
+		*count++
+		return OnDiskTreeWriterFunc(dir)(keyCompare, reduce, rereduce, reduceContext)
+	}
+}
+
+func TestCompactionDropsExpired(t *testing.T) {
+	defer os.Remove("test.couch")
+	tempDir := t.TempDir()
+	treeWriters := 0
+	db, err := OpenWithOptions("test.couch", &Options{Create: true, Expiry: true, CompactionTreeWriter: countingTreeWriterFunc(tempDir, &treeWriters)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	past := uint32(time.Now().Add(-time.Hour).Unix())
+	future := uint32(time.Now().Add(time.Hour).Unix())
+	saveExpiringDocs(t, db, 10, func(i int) uint32 {
+		if i < 5 {
+			return past
+		}
+		return future
+	})
+	err = db.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.Remove("compacted.couch")
+	err = db.Compact("compacted.couch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the by-expiry index is sorted like the by-id index
+	if treeWriters != 2 {
+		t.Errorf("expected 2 tree writers from the options, got %d", treeWriters)
+	}
+
+	compactedDb, err := Open("compacted.couch", OPEN_EXPIRY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer compactedDb.Close()
+
+	dbInfo, err := compactedDb.DatabaseInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dbInfo.DocumentCount != 5 {
+		t.Errorf("expected 5 documents after compaction, got %d", dbInfo.DocumentCount)
+	}
+	ids, err := compactedDb.expiredIds(future, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 5 {
+		t.Errorf("expected rebuilt expiry index with 5 entries, got %d", len(ids))
+	}
+}
+
+func TestBulkLoadExpiryTreeWriter(t *testing.T) {
+	defer os.Remove("test.couch")
+	treeWriters := 0
+	db, err := OpenWithOptions("test.couch", &Options{Create: true, Expiry: true, CompactionTreeWriter: countingTreeWriterFunc(t.TempDir(), &treeWriters)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	docs := shuffledDocs(100)
+	for i, docInfo := range docs.docInfos {
+		docInfo.SetExpiry(uint32(1000 + i))
+	}
+	err = db.BulkLoad(docs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if treeWriters != 2 {
+		t.Errorf("expected 2 tree writers from the options, got %d", treeWriters)
+	}
+	ids, err := db.expiredIds(math.MaxUint32, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 90 {
+		t.Errorf("expected 90 documents in the expiry index, got %d", len(ids))
+	}
+}
@@ -0,0 +1,414 @@
+//  Copyright (c) 2014 Marty Schoch
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package gouchstore
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+)
+
+const gs_SORT_MEMORY_BUDGET = 64 * 1024 * 1024
+const gs_SORT_BUFFER_SIZE = 256 * 1024
+
+// At most this many runs are merged at once, more are merged in passes.
+const gs_SORT_MAX_MERGE_RUNS = 64
+
+// SortConfig tunes the external sort used to build the by-id index when
+// compacting with an OnDiskTreeWriter.
+type SortConfig struct {
+	TempDir      string // where run files are written, the system temporary directory if empty
+	MemoryBudget int    // bytes of records held in memory, 64MB if zero
+	Parallelism  int    // runs sorted at the same time, GOMAXPROCS if zero
+}
+
+// sortRecord is the key and value of an index entry, stored on disk as a
+// 16 bit key length, a 32 bit value length, the key, then the value.
+type sortRecord struct {
+	key []byte
+	val []byte
+}
+
+func (r sortRecord) size() int {
+	return 6 + len(r.key) + len(r.val)
+}
+
+func readSortRecord(r *bufio.Reader) (sortRecord, error) {
+	var lengths [6]byte
+	_, err := io.ReadFull(r, lengths[:])
+	if err != nil {
+		return sortRecord{}, err
+	}
+	klen := int(binary.BigEndian.Uint16(lengths[0:2]))
+	vlen := int(binary.BigEndian.Uint32(lengths[2:6]))
+	buf := make([]byte, klen+vlen)
+	_, err = io.ReadFull(r, buf)
+	if err == io.EOF {
+		return sortRecord{}, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return sortRecord{}, err
+	}
+	return sortRecord{key: buf[:klen], val: buf[klen:]}, nil
+}
+
+func writeSortRecord(w *bufio.Writer, rec sortRecord) error {
+	var lengths [6]byte
+	binary.BigEndian.PutUint16(lengths[0:2], uint16(len(rec.key)))
+	binary.BigEndian.PutUint32(lengths[2:6], uint32(len(rec.val)))
+	_, err := w.Write(lengths[:])
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(rec.key)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(rec.val)
+	return err
+}
+
+// externalSorter sorts more records than fit in memory.  The records are
+// cut into runs, which are sorted in parallel and written to temporary
+// files, then the runs are merged.  One run is filled while the others are
+// sorted, so each is MemoryBudget/(Parallelism+1) bytes.
+type externalSorter struct {
+	compare      btreeKeyComparator
+	tempDir      string
+	runSize      int
+	parallelism  int
+	maxMergeRuns int
+
+	run      []sortRecord
+	runBytes int
+	runCount int
+	work     chan sortRun
+	wg       sync.WaitGroup
+	m        sync.Mutex
+	names    map[int]string
+	err      error
+	finished bool
+
+	runs          []string
+	inMemory      []sortRecord
+	inMemoryValid bool
+}
+
+type sortRun struct {
+	index   int
+	records []sortRecord
+}
+
+func newExternalSorter(compare btreeKeyComparator, config SortConfig) *externalSorter {
+	budget := config.MemoryBudget
+	if budget <= 0 {
+		budget = gs_SORT_MEMORY_BUDGET
+	}
+	parallelism := config.Parallelism
+	if parallelism <= 0 {
+		parallelism = runtime.GOMAXPROCS(0)
+	}
+	return &externalSorter{
+		compare:      compare,
+		tempDir:      config.TempDir,
+		runSize:      budget / (parallelism + 1),
+		parallelism:  parallelism,
+		maxMergeRuns: gs_SORT_MAX_MERGE_RUNS,
+	}
+}
+
+// split adds all the records read from r, then finishes.
+func (s *externalSorter) split(r io.Reader) error {
+	in := bufio.NewReaderSize(r, gs_SORT_BUFFER_SIZE)
+	for {
+		rec, err := readSortRecord(in)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			s.finish()
+			return err
+		}
+		err = s.add(rec)
+		if err != nil {
+			s.finish()
+			return err
+		}
+	}
+	return s.finish()
+}
+
+// add adds a record, it returns the error of any run written so far.
+func (s *externalSorter) add(rec sortRecord) error {
+	s.run = append(s.run, rec)
+	s.runBytes += rec.size()
+	if s.runBytes >= s.runSize {
+		s.spill()
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.err
+}
+
+// spill hands the current run to the workers, starting them the first time.
+func (s *externalSorter) spill() {
+	if s.work == nil {
+		s.work = make(chan sortRun)
+		s.names = make(map[int]string)
+		for i := 0; i < s.parallelism; i++ {
+			s.wg.Add(1)
+			go s.runWorker()
+		}
+	}
+	s.work <- sortRun{index: s.runCount, records: s.run}
+	s.runCount++
+	s.run = nil
+	s.runBytes = 0
+}
+
+func (s *externalSorter) runWorker() {
+	defer s.wg.Done()
+	for run := range s.work {
+		s.sortRecords(run.records)
+		name, err := s.writeRun(run.records)
+		s.m.Lock()
+		if name != "" {
+			s.names[run.index] = name
+		}
+		if err != nil && s.err == nil {
+			s.err = err
+		}
+		s.m.Unlock()
+	}
+}
+
+// finish sorts what has been added.  If it all fit in one run it is kept
+// in memory, otherwise it waits for every run to be written.
+func (s *externalSorter) finish() error {
+	if s.finished {
+		return s.err
+	}
+	s.finished = true
+	if s.work == nil {
+		// everything fit in a single run, there is no need for files
+		s.sortRecords(s.run)
+		s.inMemory = s.run
+		s.inMemoryValid = true
+		s.run = nil
+		return nil
+	}
+	if len(s.run) > 0 {
+		s.spill()
+	}
+	close(s.work)
+	s.wg.Wait()
+	for i := 0; i < s.runCount; i++ {
+		if name, ok := s.names[i]; ok {
+			s.runs = append(s.runs, name)
+		}
+	}
+	return s.err
+}
+
+func (s *externalSorter) sortRecords(run []sortRecord) {
+	sort.Slice(run, func(i, j int) bool {
+		return s.compare(run[i].key, run[j].key) < 0
+	})
+}
+
+func (s *externalSorter) writeRun(run []sortRecord) (string, error) {
+	file, err := ioutil.TempFile(s.tempDir, "tw-run")
+	if err != nil {
+		return "", err
+	}
+	w := bufio.NewWriterSize(file, gs_SORT_BUFFER_SIZE)
+	for _, rec := range run {
+		err = writeSortRecord(w, rec)
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	cerr := file.Close()
+	if err == nil {
+		err = cerr
+	}
+	return file.Name(), err
+}
+
+// mergeTo writes all the records, in order, to w.
+func (s *externalSorter) mergeTo(w io.Writer) error {
+	out := bufio.NewWriterSize(w, gs_SORT_BUFFER_SIZE)
+	err := s.each(func(rec sortRecord) error {
+		return writeSortRecord(out, rec)
+	})
+	if err != nil {
+		return err
+	}
+	return out.Flush()
+}
+
+// each calls fn with every record, in order, after finish.
+func (s *externalSorter) each(fn func(rec sortRecord) error) error {
+	if s.inMemoryValid {
+		for _, rec := range s.inMemory {
+			err := fn(rec)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// merge in passes until few enough runs are left
+	for len(s.runs) > s.maxMergeRuns {
+		var merged []string
+		for start := 0; start < len(s.runs); start += s.maxMergeRuns {
+			end := start + s.maxMergeRuns
+			if end > len(s.runs) {
+				end = len(s.runs)
+			}
+			name, err := s.mergeToRun(s.runs[start:end])
+			if name != "" {
+				merged = append(merged, name)
+			}
+			if err != nil {
+				s.runs = append(merged, s.runs[start:]...)
+				return err
+			}
+			s.removeRuns(s.runs[start:end])
+		}
+		s.runs = merged
+	}
+	return s.merge(s.runs, fn)
+}
+
+func (s *externalSorter) mergeToRun(runs []string) (string, error) {
+	file, err := ioutil.TempFile(s.tempDir, "tw-run")
+	if err != nil {
+		return "", err
+	}
+	w := bufio.NewWriterSize(file, gs_SORT_BUFFER_SIZE)
+	err = s.merge(runs, func(rec sortRecord) error {
+		return writeSortRecord(w, rec)
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	cerr := file.Close()
+	if err == nil {
+		err = cerr
+	}
+	return file.Name(), err
+}
+
+func (s *externalSorter) merge(runs []string, fn func(rec sortRecord) error) error {
+	h := &mergeHeap{compare: s.compare}
+	defer h.close()
+	if len(runs) == 0 {
+		return nil
+	}
+	bufferSize := gs_SORT_BUFFER_SIZE / len(runs)
+	if bufferSize < 4096 {
+		bufferSize = 4096
+	}
+	for _, name := range runs {
+		file, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		h.files = append(h.files, file)
+		source := &mergeSource{file: file, r: bufio.NewReaderSize(file, bufferSize), index: len(h.files)}
+		rec, err := readSortRecord(source.r)
+		if err == io.EOF {
+			continue
+		} else if err != nil {
+			return err
+		}
+		source.rec = rec
+		h.sources = append(h.sources, source)
+	}
+	heap.Init(h)
+
+	for h.Len() > 0 {
+		source := h.sources[0]
+		err := fn(source.rec)
+		if err != nil {
+			return err
+		}
+		source.rec, err = readSortRecord(source.r)
+		if err == io.EOF {
+			heap.Pop(h)
+		} else if err != nil {
+			return err
+		} else {
+			heap.Fix(h, 0)
+		}
+	}
+	return nil
+}
+
+func (s *externalSorter) removeRuns(runs []string) {
+	for _, name := range runs {
+		os.Remove(name)
+	}
+}
+
+// close removes any run files left.
+func (s *externalSorter) close() {
+	s.finish()
+	s.removeRuns(s.runs)
+	s.runs = nil
+	s.inMemory = nil
+}
+
+type mergeSource struct {
+	file  *os.File
+	r     *bufio.Reader
+	rec   sortRecord
+	index int
+}
+
+// mergeHeap orders the sources by their current record, ties go to the
+// earlier run.
+type mergeHeap struct {
+	compare btreeKeyComparator
+	sources []*mergeSource
+	files   []*os.File
+}
+
+func (h *mergeHeap) Len() int { return len(h.sources) }
+func (h *mergeHeap) Less(i, j int) bool {
+	cmp := h.compare(h.sources[i].rec.key, h.sources[j].rec.key)
+	if cmp == 0 {
+		return h.sources[i].index < h.sources[j].index
+	}
+	return cmp < 0
+}
+func (h *mergeHeap) Swap(i, j int)      { h.sources[i], h.sources[j] = h.sources[j], h.sources[i] }
+func (h *mergeHeap) Push(x interface{}) { h.sources = append(h.sources, x.(*mergeSource)) }
+func (h *mergeHeap) Pop() interface{} {
+	old := h.sources
+	rv := old[len(old)-1]
+	h.sources = old[:len(old)-1]
+	return rv
+}
+
+func (h *mergeHeap) close() {
+	for _, file := range h.files {
+		file.Close()
+	}
+}
@@ -0,0 +1,268 @@
+//  Copyright (c) 2014 Marty Schoch
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package gouchstore
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func shuffledSortRecords(count int) []byte {
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	for _, i := range rand.New(rand.NewSource(1)).Perm(count) {
+		writeSortRecord(w, sortRecord{key: []byte(fmt.Sprintf("doc-%08d", i)), val: []byte(fmt.Sprintf("val-%d", i))})
+	}
+	w.Flush()
+	return buf.Bytes()
+}
+
+func TestExternalSort(t *testing.T) {
+	tests := []struct {
+		config       SortConfig
+		maxMergeRuns int
+		spilled      bool
+	}{
+		// fits in memory
+		{SortConfig{}, gs_SORT_MAX_MERGE_RUNS, false},
+		// many runs, merged at once
+		{SortConfig{MemoryBudget: 30000, Parallelism: 4}, gs_SORT_MAX_MERGE_RUNS, true},
+		// many runs, merged in passes
+		{SortConfig{MemoryBudget: 30000, Parallelism: 2}, 4, true},
+	}
+	for i, test := range tests {
+		tempDir := t.TempDir()
+		test.config.TempDir = tempDir
+		s := newExternalSorter(gouchstoreIdComparator, test.config)
+		s.maxMergeRuns = test.maxMergeRuns
+
+		err := s.split(bytes.NewReader(shuffledSortRecords(10000)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.spilled != (len(s.runs) > s.maxMergeRuns/2) {
+			t.Errorf("%d: expected spilled %t, got %d runs", i, test.spilled, len(s.runs))
+		}
+		var out bytes.Buffer
+		err = s.mergeTo(&out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.close()
+
+		in := bufio.NewReader(&out)
+		count := 0
+		for {
+			rec, err := readSortRecord(in)
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if string(rec.key) != fmt.Sprintf("doc-%08d", count) || string(rec.val) != fmt.Sprintf("val-%d", count) {
+				t.Fatalf("%d: expected record %d, got %s %s", i, count, rec.key, rec.val)
+			}
+			count++
+		}
+		if count != 10000 {
+			t.Errorf("%d: expected 10000 records, got %d", i, count)
+		}
+		entries, err := ioutil.ReadDir(tempDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 0 {
+			t.Errorf("%d: expected the run files to be removed, found %d", i, len(entries))
+		}
+	}
+
+	// a truncated record is an error
+	s := newExternalSorter(gouchstoreIdComparator, SortConfig{TempDir: t.TempDir()})
+	data := shuffledSortRecords(10)
+	err := s.split(bytes.NewReader(data[:len(data)-1]))
+	s.close()
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("expected unexpected EOF, got %v", err)
+	}
+}
+
+func TestCompactExternalSort(t *testing.T) {
+	defer os.Remove("test.couch")
+	defer os.Remove("test-compacted.couch")
+	tempDir := t.TempDir()
+	db, err := OpenWithOptions("test.couch", &Options{
+		Create:               true,
+		CompactionTreeWriter: ExternalSortTreeWriterFunc(SortConfig{TempDir: tempDir, MemoryBudget: 10000, Parallelism: 3}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// saved out of order, so the runs overlap
+	for _, start := range []int{2000, 0, 1000} {
+		err = saveNumberedDocs(db, start, 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = db.Compact("test-compacted.couch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ioutil.ReadDir(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("expected the temporary files to be removed, found %d", len(entries))
+	}
+
+	compacted, err := Open("test-compacted.couch", OPEN_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer compacted.Close()
+	count := 0
+	err = compacted.AllDocuments("", "", func(g *Gouchstore, docInfo *DocumentInfo, userContext interface{}) error {
+		if docInfo.ID != fmt.Sprintf("doc-%08d", count) {
+			return fmt.Errorf("expected doc-%08d, got %s", count, docInfo.ID)
+		}
+		count++
+		return nil
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3000 {
+		t.Errorf("expected 3000 documents, got %d", count)
+	}
+}
+
+func TestOnDiskTreeWriterMergesIntoWrite(t *testing.T) {
+	defer os.Remove("test.couch")
+	db, err := Open("test.couch", OPEN_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	tempDir := t.TempDir()
+	unsorted := filepath.Join(tempDir, "unsorted")
+	err = ioutil.WriteFile(unsorted, nil, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw, err := newOnDiskTreeWriter(SortConfig{TempDir: tempDir, MemoryBudget: 30000, Parallelism: 2}, unsorted, gouchstoreIdComparator, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tw.Close()
+	data := shuffledSortRecords(10000)
+	in := bufio.NewReader(bytes.NewReader(data))
+	for {
+		rec, err := readSortRecord(in)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		err = tw.AddItem(rec.key, rec.val)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	fi, err := os.Stat(unsorted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() >= int64(len(data)) {
+		t.Errorf("expected the items to be buffered, found %d bytes written", fi.Size())
+	}
+
+	err = tw.Sort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the runs are merged by Write, not back into the file
+	written, err := ioutil.ReadFile(unsorted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(written, data) {
+		t.Errorf("expected the file to hold the items as added")
+	}
+	root, err := tw.Write(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	lr := lookupRequest{
+		compare: gouchstoreIdComparator,
+		keys:    [][]byte{[]byte{}},
+		fold:    true,
+		fetchCallback: func(req *lookupRequest, key []byte, value []byte) error {
+			if value == nil {
+				return nil
+			}
+			if string(key) != fmt.Sprintf("doc-%08d", count) {
+				return fmt.Errorf("expected doc-%08d, got %s", count, key)
+			}
+			count++
+			return nil
+		},
+	}
+	err = db.btreeLookup(&lr, root.pointer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 10000 {
+		t.Errorf("expected 10000 items, got %d", count)
+	}
+
+	// duplicates are still found as the runs are merged
+	err = tw.AddItem([]byte("doc-00000001"), []byte("again"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tw.Sort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tw.Write(db)
+	if err != ErrDuplicateID {
+		t.Errorf("expected ErrDuplicateID, got %v", err)
+	}
+}
+
+func BenchmarkExternalSort(b *testing.B) {
+	data := shuffledSortRecords(100000)
+	tempDir := b.TempDir()
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s := newExternalSorter(gouchstoreIdComparator, SortConfig{TempDir: tempDir, MemoryBudget: 256 * 1024})
+		err := s.split(bytes.NewReader(data))
+		if err != nil {
+			b.Fatal(err)
+		}
+		err = s.mergeTo(ioutil.Discard)
+		if err != nil {
+			b.Fatal(err)
+		}
+		s.close()
+	}
+}
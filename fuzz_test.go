@@ -0,0 +1,124 @@
+//  Copyright (c) 2014 Marty Schoch
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package gouchstore
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The fuzz targets only check that decoding never panics, run them with:
+//
+//	go test -fuzz=FuzzDecodeHeader
+//	go test -fuzz=FuzzDecodeNode
+//	go test -fuzz=FuzzReadFile
+
+func FuzzDecodeHeader(f *testing.F) {
+	f.Add(newHeader().toBytes())
+	h := newHeader()
+	h.updateSeq = 7
+	h.byIdRoot = &nodePointer{pointer: 4096, subtreeSize: 100, reducedValue: encodeByIdReduce(1, 2, 3)}
+	h.bySeqRoot = &nodePointer{pointer: 8192, subtreeSize: 100, reducedValue: encode_raw40(uint64(3))}
+	h.localDocsRoot = &nodePointer{pointer: 12288, subtreeSize: 10}
+	f.Add(h.toBytes())
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		h, err := newHeaderFromBytes(data)
+		if err == nil {
+			_ = h.String()
+		}
+	})
+}
+
+func FuzzDecodeNode(f *testing.F) {
+	docInfo := DocumentInfo{ID: "doc", Seq: 3, Rev: 1, Size: 20, RevMeta: []byte{1, 2, 3}}
+	leaf := []byte{gs_BTREE_LEAF}
+	leaf = append(leaf, encodeKeyValue([]byte(docInfo.ID), docInfo.encodeById())...)
+	f.Add(leaf)
+	seqLeaf := []byte{gs_BTREE_LEAF}
+	seqLeaf = append(seqLeaf, encodeKeyValue(encode_raw48(docInfo.Seq), docInfo.encodeBySeq())...)
+	f.Add(seqLeaf)
+	interior := []byte{gs_BTREE_INTERIOR}
+	np := nodePointer{pointer: 4096, subtreeSize: 10, reducedValue: encode_raw40(uint64(1))}
+	interior = append(interior, encodeKeyValue([]byte("doc"), np.encode())...)
+	f.Add(interior)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if len(data) < 1 {
+			return
+		}
+		if data[0] == gs_BTREE_INTERIOR {
+			decodeInteriorBtreeNode(data, gs_INDEX_TYPE_BY_ID)
+		} else {
+			decodeLeafBtreeNode(data, gs_INDEX_TYPE_BY_ID)
+			decodeLeafBtreeNode(data, gs_INDEX_TYPE_BY_SEQ)
+		}
+		kvIterator := newKeyValueIterator(data[1:])
+		for k, v := kvIterator.Next(); k != nil; k, v = kvIterator.Next() {
+			decodeNodePointer(v)
+			decodeRootNodePointer(v)
+		}
+	})
+}
+
+func FuzzReadFile(f *testing.F) {
+	data, err := ioutil.ReadFile(testFileName)
+	if err != nil {
+		f.Fatal(err)
+	}
+	// the header and the nodes it points to are at the end of the file
+	f.Add(data[len(data)-3*int(gs_BLOCK_SIZE):])
+	f.Add(data[:2*gs_BLOCK_SIZE])
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		path := filepath.Join(t.TempDir(), "fuzz.couch")
+		err := ioutil.WriteFile(path, data, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		db, err := Open(path, OPEN_RDONLY)
+		if err != nil {
+			return
+		}
+		defer db.Close()
+		db.DatabaseInfo()
+		db.AllDocuments("", "", func(g *Gouchstore, docInfo *DocumentInfo, userContext interface{}) error {
+			g.DocumentByDocumentInfo(docInfo)
+			return nil
+		}, nil)
+		db.ChangesSince(0, 0, func(g *Gouchstore, docInfo *DocumentInfo, userContext interface{}) error {
+			return nil
+		}, nil)
+		db.WalkLocalDocsTree("", "", func(g *Gouchstore, depth int, documentInfo *DocumentInfo, key []byte, subTreeSize uint64, reducedValue []byte, userContext interface{}) error {
+			return nil
+		}, nil)
+		db.DocumentInfoById("doc")
+	})
+}
+
+func TestOpenWithoutHeader(t *testing.T) {
+	defer os.Remove("test.couch")
+	err := ioutil.WriteFile("test.couch", make([]byte, 3*gs_BLOCK_SIZE), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Open("test.couch", OPEN_RDONLY)
+	if err == nil {
+		t.Fatalf("expected error opening a file with no header")
+	}
+	var corruptErr *CorruptError
+	if !errors.As(err, &corruptErr) || corruptErr.Err != ErrNoHeader {
+		t.Errorf("expected no header found, got %v", err)
+	}
+}
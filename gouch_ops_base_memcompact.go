@@ -18,5 +18,5 @@ func NewMemCompactGouchOps() *MemCompactGouchOps {
 }
 
 func (g *MemCompactGouchOps) CompactionTreeWriter(keyCompare btreeKeyComparator, reduce, rereduce reduceFunc, reduceContext interface{}) (TreeWriter, error) {
-	return NewInMemoryTreeWriter(gouchstoreIdComparator, byIdReduce, byIdReReduce, nil)
+	return NewInMemoryTreeWriter(keyCompare, reduce, rereduce, reduceContext)
 }
@@ -14,6 +14,7 @@ import (
 	"io"
 	"os"
 	"sort"
+	"sync"
 )
 
 // Document represents a document stored in the database.
@@ -60,13 +61,33 @@ func NewDocumentInfo(id string) *DocumentInfo {
 }
 
 // Compressed returns whether or not this document has been compressed for storage.
-func (di *DocumentInfo) compressed() bool {
+func (di *DocumentInfo) Compressed() bool {
 	if di.ContentMeta&DOC_IS_COMPRESSED != 0 {
 		return true
 	}
 	return false
 }
 
+// SetCompressed sets whether or not this document should be compressed for storage.
+func (di *DocumentInfo) SetCompressed(compressed bool) {
+	if compressed {
+		di.ContentMeta |= DOC_IS_COMPRESSED
+	} else {
+		di.ContentMeta &^= DOC_IS_COMPRESSED
+	}
+}
+
+// Datatype returns the datatype part of the content meta-data,
+// one of the DOC_IS_JSON, DOC_INVALID_JSON, DOC_INVALID_JSON_KEY or DOC_NON_JSON_MODE values.
+func (di *DocumentInfo) Datatype() byte {
+	return di.ContentMeta &^ DOC_IS_COMPRESSED
+}
+
+// SetDatatype sets the datatype part of the content meta-data, leaving the compression flag alone.
+func (di *DocumentInfo) SetDatatype(datatype byte) {
+	di.ContentMeta = di.ContentMeta&DOC_IS_COMPRESSED | datatype&^DOC_IS_COMPRESSED
+}
+
 func (di *DocumentInfo) String() string {
 	return fmt.Sprintf("ID: '%s' Seq: %d Rev: %d Deleted: %t Size: %d BodyPosition: %d (0x%x)", di.ID, di.Seq, di.Rev, di.Deleted, di.Size, di.bodyPosition, di.bodyPosition)
 }
@@ -92,69 +113,105 @@ type WalkTreeCallback func(gouchstore *Gouchstore, depth int, documentInfo *Docu
 
 // Gouchstore gives access to a couchstore database file.
 type Gouchstore struct {
-	file   *os.File
-	pos    int64
-	header *header
-	ops    GouchOps
+	filename   string
+	file       *os.File
+	pos        int64
+	header     *header
+	committed  *header // a copy of the header last committed, or loaded
+	options    Options
+	ops        GouchOps
+	codec      Codec
+	logger     Logger
+	nodeCache  *nodeCache
+	durability Durability
+	jsonMode   JSONMode
+	readOnly   bool
+	closed     bool
+	unlock     func() error   // releases the file lock, if one was taken
+	commits    sync.WaitGroup // asynchronous commits still finishing
+
+	expiry          bool
+	expiryRoot      *nodePointer
+	expiryRootDirty bool
+
+	thresholds      treeThresholds
+	thresholdsDirty bool
+
+	contentHash bool
 }
 
 const (
-	OPEN_CREATE int = 1
-	OPEN_RDONLY int = 2
+	OPEN_CREATE                 int = 1
+	OPEN_RDONLY                 int = 2
+	OPEN_DURABILITY_SINGLE_SYNC int = 4
+	OPEN_DURABILITY_NONE        int = 8
+	OPEN_EXPIRY                 int = 16
+	OPEN_JSON_DETECT            int = 32
+	OPEN_JSON_VALIDATE          int = 64
+	OPEN_LOCK_NOWAIT            int = 128
+	OPEN_CONTENT_HASH           int = 256
+	OPEN_LOCK_WAIT              int = 512
+	OPEN_LOCK_NONE              int = 1024
 )
 
 // Open attemps to open an existing couchstore file.
 //
+// The file is locked against other processes, and opening a file another
+// process has locked fails with ErrLocked.  Earlier versions did not lock,
+// pass OPEN_LOCK_NONE to keep that behaviour, or OPEN_LOCK_WAIT to wait for
+// the lock.  See LockMode.
+//
 // All Gouchstore files successfully opened should be closed with the Close() method.
 func Open(filename string, options int) (*Gouchstore, error) {
 	return OpenEx(filename, options, NewBaseGouchOps())
 }
 
+// OpenEx opens a couchstore file with the OPEN_* flags in options, using ops
+// for the low-level operations.  It locks the file as Open does.
 func OpenEx(filename string, options int, ops GouchOps) (*Gouchstore, error) {
-	// sanity check options
-	if options&OPEN_CREATE != 0 && options&OPEN_RDONLY != 0 {
-		return nil, gs_ERROR_INVALID_ARGUMENTS
-	}
-
-	var openFlags int
-	if options&OPEN_RDONLY != 0 {
-		openFlags = os.O_RDONLY
-	} else {
-		openFlags = os.O_RDWR
-	}
-
-	if options&OPEN_CREATE != 0 {
-		openFlags |= os.O_CREATE
-	}
-
-	rv := Gouchstore{
-		ops: ops,
-	}
-
-	file, err := rv.ops.OpenFile(filename, openFlags, 0666)
+	opts, err := optionsFromFlags(options, ops)
 	if err != nil {
 		return nil, err
 	}
-	rv.file = file
+	return OpenWithOptions(filename, opts)
+}
 
-	rv.pos, err = rv.ops.GotoEOF(rv.file)
+// load finds the most recent header, new files get an initial header.
+func (g *Gouchstore) load() error {
+	var err error
+	g.pos, err = g.ops.GotoEOF(g.file)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if rv.pos == 0 {
-		rv.header = newHeader()
-		err = rv.writeHeader(rv.header)
+	if g.pos == 0 {
+		g.header = newHeader()
+		err = g.writeHeader(g.header)
 		if err != nil {
-			return nil, err
+			return err
 		}
 	} else {
-		err = rv.findLastHeader()
+		err = g.findLastHeader()
 		if err != nil {
-			return nil, err
+			return err
+		}
+		if g.header.byIdRoot != nil && decodeByIdReduceHash(g.header.byIdRoot.reducedValue) != nil {
+			g.contentHash = true
 		}
 	}
 
-	return &rv, nil
+	err = g.loadThresholds()
+	if err != nil {
+		return err
+	}
+
+	if g.expiry {
+		err = g.loadExpiryRoot()
+		if err != nil {
+			return err
+		}
+	}
+	g.setCommitted()
+	return nil
 }
 
 func gouchstoreFetchSingleCallback(g *Gouchstore, docInfo *DocumentInfo, userContext interface{}) error {
@@ -177,8 +234,12 @@ func gouchstoreFetchCallback(g *Gouchstore, docInfo *DocumentInfo, userContext i
 }
 
 func (g *Gouchstore) DocumentInfoByIdNoAlloc(id string, docInfo *DocumentInfo) error {
+	err := g.checkOpen()
+	if err != nil {
+		return err
+	}
 	if g.header.byIdRoot == nil {
-		return gs_ERROR_DOCUMENT_NOT_FOUND
+		return ErrNotFound
 	}
 
 	// convert it to a slice of byte slices
@@ -201,7 +262,7 @@ func (g *Gouchstore) DocumentInfoByIdNoAlloc(id string, docInfo *DocumentInfo) e
 		callbackContext: &lc,
 	}
 
-	err := g.btreeLookup(&lr, g.header.byIdRoot.pointer)
+	err = g.btreeLookup(&lr, g.header.byIdRoot.pointer)
 	if err != nil {
 		return err
 	}
@@ -209,7 +270,7 @@ func (g *Gouchstore) DocumentInfoByIdNoAlloc(id string, docInfo *DocumentInfo) e
 	if resultList[0].ID != "" {
 		return nil
 	}
-	return gs_ERROR_DOCUMENT_NOT_FOUND
+	return ErrNotFound
 }
 
 // DocumentInfoById returns DocumentInfo for a single document with the specified ID.
@@ -228,6 +289,19 @@ func (g *Gouchstore) DocumentInfoById(id string) (*DocumentInfo, error) {
 // NOTE: contents of the result slice will be in ascending ID order, not the order they
 // appeared in the argument list.
 func (g *Gouchstore) DocumentInfosByIds(identifiers []string) ([]*DocumentInfo, error) {
+	err := g.checkOpen()
+	if err != nil {
+		return nil, err
+	}
+	return g.documentInfosByIds(identifiers, false)
+}
+
+// rawDocumentInfosByIds is like DocumentInfosByIds but includes expired documents.
+func (g *Gouchstore) rawDocumentInfosByIds(identifiers []string) ([]*DocumentInfo, error) {
+	return g.documentInfosByIds(identifiers, true)
+}
+
+func (g *Gouchstore) documentInfosByIds(identifiers []string, includeExpired bool) ([]*DocumentInfo, error) {
 	ids := sort.StringSlice(identifiers)
 	// we need the ids in sorted order
 	sort.Sort(ids)
@@ -248,6 +322,7 @@ func (g *Gouchstore) DocumentInfosByIds(identifiers []string) ([]*DocumentInfo,
 		documentInfoCallback: gouchstoreFetchCallback,
 		callbackContext:      &resultList,
 		indexType:            gs_INDEX_TYPE_BY_ID,
+		includeExpired:       includeExpired,
 	}
 
 	lr := lookupRequest{
@@ -273,13 +348,20 @@ func lookupCallback(req *lookupRequest, key []byte, value []byte) error {
 
 	context := req.callbackContext.(*lookupContext)
 
+	var err error
 	docinfo := DocumentInfo{}
 	if context.indexType == gs_INDEX_TYPE_BY_ID {
 		docinfo.ID = string(key)
-		decodeByIdValue(&docinfo, value)
+		err = decodeByIdValue(&docinfo, value)
 	} else if context.indexType == gs_INDEX_TYPE_BY_SEQ {
 		docinfo.Seq = decode_raw48(key)
-		decodeBySeqValue(&docinfo, value)
+		err = decodeBySeqValue(&docinfo, value)
+	}
+	if err != nil {
+		return err
+	}
+	if context.hides(&docinfo) {
+		return nil
 	}
 
 	if context.walkTreeCallback != nil {
@@ -296,15 +378,29 @@ func lookupCallback(req *lookupRequest, key []byte, value []byte) error {
 	return nil
 }
 
+// hides reports whether docInfo has expired, and must not be passed on.
+func (context *lookupContext) hides(docInfo *DocumentInfo) bool {
+	if !context.gouchstore.expiry || context.includeExpired || context.indexType == gs_INDEX_TYPE_LOCAL_DOCS {
+		return false
+	}
+	if context.now == 0 {
+		context.now = expiryNow()
+	}
+	return docInfo.expired(context.now)
+}
+
 func walkNodeCallback(req *lookupRequest, key []byte, value []byte) error {
 	context := req.callbackContext.(*lookupContext)
 	if value == nil {
 		context.depth--
 		return nil
 	} else {
-		valueNodePointer := decodeNodePointer(value)
+		valueNodePointer, err := decodeNodePointer(value)
+		if err != nil {
+			return err
+		}
 		valueNodePointer.key = key
-		err := context.walkTreeCallback(context.gouchstore, context.depth, nil, key, valueNodePointer.subtreeSize, valueNodePointer.reducedValue, context.callbackContext)
+		err = context.walkTreeCallback(context.gouchstore, context.depth, nil, key, valueNodePointer.subtreeSize, valueNodePointer.reducedValue, context.callbackContext)
 		context.depth++
 		return err
 	}
@@ -319,7 +415,7 @@ func (g *Gouchstore) DocumentInfoBySeq(seq uint64) (*DocumentInfo, error) {
 	if len(docInfos) == 1 {
 		return docInfos[0], nil
 	}
-	return nil, gs_ERROR_DOCUMENT_NOT_FOUND
+	return nil, ErrNotFound
 }
 
 // DocumentInfosBySeqs returns DocumentInfo objects for the specified document sequence numbers.
@@ -328,7 +424,10 @@ func (g *Gouchstore) DocumentInfoBySeq(seq uint64) (*DocumentInfo, error) {
 // NOTE: contents of the result slice will be in ascending sequence order, not the order they
 // appeared in the argument list.
 func (g *Gouchstore) DocumentInfosBySeqs(sequences []uint64) ([]*DocumentInfo, error) {
-
+	err := g.checkOpen()
+	if err != nil {
+		return nil, err
+	}
 	seqs := seqList(sequences)
 	// we need the ids in sorted order
 	sort.Sort(seqs)
@@ -359,7 +458,7 @@ func (g *Gouchstore) DocumentInfosBySeqs(sequences []uint64) ([]*DocumentInfo, e
 		callbackContext: &lc,
 	}
 
-	err := g.btreeLookup(&lr, g.header.bySeqRoot.pointer)
+	err = g.btreeLookup(&lr, g.header.bySeqRoot.pointer)
 	if err != nil {
 		return nil, err
 	}
@@ -386,7 +485,10 @@ func (g *Gouchstore) AllDocuments(startId, endId string, cb DocumentInfoCallback
 }
 
 func (g *Gouchstore) WalkIdTree(startId, endId string, wtcb WalkTreeCallback, userContext interface{}) error {
-
+	err := g.checkOpen()
+	if err != nil {
+		return err
+	}
 	if g.header.byIdRoot == nil {
 		return nil
 	}
@@ -414,7 +516,7 @@ func (g *Gouchstore) WalkIdTree(startId, endId string, wtcb WalkTreeCallback, us
 		callbackContext: &lc,
 	}
 
-	err := g.btreeLookup(&lr, g.header.byIdRoot.pointer)
+	err = g.btreeLookup(&lr, g.header.byIdRoot.pointer)
 	if err != nil {
 		return err
 	}
@@ -431,17 +533,33 @@ func (g *Gouchstore) WalkIdTree(startId, endId string, wtcb WalkTreeCallback, us
 //
 // If endId is 0, the iteration will continue to the last document.
 func (g *Gouchstore) ChangesSince(since uint64, till uint64, cb DocumentInfoCallback, userContext interface{}) error {
+	return g.changesSince(since, till, cb, userContext, false)
+}
+
+// rawChangesSince is like ChangesSince but includes expired documents.
+func (g *Gouchstore) rawChangesSince(since uint64, till uint64, cb DocumentInfoCallback, userContext interface{}) error {
+	return g.changesSince(since, till, cb, userContext, true)
+}
+
+func (g *Gouchstore) changesSince(since uint64, till uint64, cb DocumentInfoCallback, userContext interface{}, includeExpired bool) error {
 	wtCallback := func(gouchstore *Gouchstore, depth int, documentInfo *DocumentInfo, key []byte, subTreeSize uint64, reducedValue []byte, userContext interface{}) error {
 		if documentInfo != nil {
 			return cb(gouchstore, documentInfo, userContext)
 		}
 		return nil
 	}
-	return g.WalkSeqTree(since, till, wtCallback, userContext)
+	return g.walkSeqTree(since, till, wtCallback, userContext, includeExpired)
 }
 
 func (g *Gouchstore) WalkSeqTree(since uint64, till uint64, wtcb WalkTreeCallback, userContext interface{}) error {
+	return g.walkSeqTree(since, till, wtcb, userContext, false)
+}
 
+func (g *Gouchstore) walkSeqTree(since uint64, till uint64, wtcb WalkTreeCallback, userContext interface{}, includeExpired bool) error {
+	err := g.checkOpen()
+	if err != nil {
+		return err
+	}
 	if g.header.bySeqRoot == nil {
 		return nil
 	}
@@ -453,6 +571,7 @@ func (g *Gouchstore) WalkSeqTree(since uint64, till uint64, wtcb WalkTreeCallbac
 		walkTreeCallback: wtcb,
 		callbackContext:  userContext,
 		indexType:        gs_INDEX_TYPE_BY_SEQ,
+		includeExpired:   includeExpired,
 	}
 
 	keys := [][]byte{encode_raw48(since)}
@@ -469,7 +588,7 @@ func (g *Gouchstore) WalkSeqTree(since uint64, till uint64, wtcb WalkTreeCallbac
 		callbackContext: &lc,
 	}
 
-	err := g.btreeLookup(&lr, g.header.bySeqRoot.pointer)
+	err = g.btreeLookup(&lr, g.header.bySeqRoot.pointer)
 	if err != nil {
 		return err
 	}
@@ -477,6 +596,8 @@ func (g *Gouchstore) WalkSeqTree(since uint64, till uint64, wtcb WalkTreeCallbac
 	return nil
 }
 
+// DocumentBodyById returns the body of the document with the specified
+// identifier, or ErrNotFound if it is missing or deleted.
 func (g *Gouchstore) DocumentBodyById(id string) ([]byte, error) {
 	var doc Document
 	err := g.DocumentByIdNoAlloc(id, &doc)
@@ -492,6 +613,9 @@ func (g *Gouchstore) DocumentByIdNoAlloc(id string, doc *Document) error {
 	if err != nil {
 		return err
 	}
+	if docInfo.Deleted {
+		return ErrNotFound
+	}
 	err = g.DocumentByDocumentInfoNoAlloc(&docInfo, doc)
 	if err != nil {
 		return err
@@ -499,18 +623,33 @@ func (g *Gouchstore) DocumentByIdNoAlloc(id string, doc *Document) error {
 	return nil
 }
 
-// DocumentById returns the Document with the specified identifier.
+// DocumentById returns the Document with the specified identifier, or
+// ErrNotFound if it is missing or deleted.  The info of deleted documents is
+// still returned by DocumentInfoById.
 func (g *Gouchstore) DocumentById(id string) (*Document, error) {
 	docInfo, err := g.DocumentInfoById(id)
 	if err != nil {
 		return nil, err
 	}
+	if docInfo.Deleted {
+		return nil, ErrNotFound
+	}
 	return g.DocumentByDocumentInfo(docInfo)
 }
 
 func (g *Gouchstore) DocumentByDocumentInfoNoAlloc(docInfo *DocumentInfo, doc *Document) error {
-	var err error
-	if docInfo.compressed() {
+	err := g.checkOpen()
+	if err != nil {
+		return err
+	}
+	if docInfo == nil || doc == nil {
+		return ErrInvalidArguments
+	}
+	// deleted documents usually have no body
+	if docInfo.bodyPosition == 0 {
+		return ErrNotFound
+	}
+	if docInfo.Compressed() {
 		doc.Body, err = g.readCompressedDataChunkAt(int64(docInfo.bodyPosition))
 		if err != nil {
 			return err
@@ -527,7 +666,8 @@ func (g *Gouchstore) DocumentByDocumentInfoNoAlloc(docInfo *DocumentInfo, doc *D
 
 // DocumentByDocumentInfo returns the Document using the provided DocumentInfo.
 // The provided DocumentInfo should be valid, such as one received by one of the
-// DocumentInfo*() methods, on the current couchstore file.
+// DocumentInfo*() methods, on the current couchstore file.  Documents without
+// a body, such as most deleted ones, return ErrNotFound.
 func (g *Gouchstore) DocumentByDocumentInfo(docInfo *DocumentInfo) (*Document, error) {
 	var rv Document
 	err := g.DocumentByDocumentInfoNoAlloc(docInfo, &rv)
@@ -544,6 +684,18 @@ func (g *Gouchstore) SaveDocument(doc *Document, docInfo *DocumentInfo) error {
 
 // SaveDocuments stores multiple documents at a time
 func (g *Gouchstore) SaveDocuments(docs []*Document, docInfos []*DocumentInfo) error {
+	err := g.checkWritable()
+	if err != nil {
+		return err
+	}
+	err = g.checkDocuments(docs, docInfos)
+	if err != nil {
+		return err
+	}
+	err = g.applyJSONMode(docs, docInfos)
+	if err != nil {
+		return err
+	}
 
 	numDocs := len(docs)
 	seqklist := make([][]byte, numDocs)
@@ -566,7 +718,7 @@ func (g *Gouchstore) SaveDocuments(docs []*Document, docInfos []*DocumentInfo) e
 		idvlist[i] = idval
 	}
 
-	err := g.updateIndexes(seqklist, seqvlist, idklist, idvlist)
+	err = g.updateIndexes(seqklist, seqvlist, idklist, idvlist)
 	if err != nil {
 		return err
 	}
@@ -582,45 +734,14 @@ func (g *Gouchstore) SaveDocuments(docs []*Document, docInfos []*DocumentInfo) e
 	return nil
 }
 
-func (g *Gouchstore) Commit() error {
-	curPos := g.pos
-	var seqRootSize, idRootSize, localRootSize int64
-	if g.header.bySeqRoot != nil {
-		seqRootSize = gs_ROOT_BASE_SIZE + int64(len(g.header.bySeqRoot.reducedValue))
-	}
-	if g.header.byIdRoot != nil {
-		idRootSize = gs_ROOT_BASE_SIZE + int64(len(g.header.byIdRoot.reducedValue))
-	}
-	if g.header.localDocsRoot != nil {
-		localRootSize = gs_ROOT_BASE_SIZE + int64(len(g.header.localDocsRoot.reducedValue))
-	}
-	//g.pos += int64(gs_HEADER_BASE_SIZE) + seqRootSize + idRootSize + localRootSize
-	//Extend file size to where end of header will land before we do first sync
-	//g.writeAt([]byte{0x0}, g.pos, true)
-	dummyHeader := make([]byte, int(gs_HEADER_BASE_SIZE+seqRootSize+idRootSize+localRootSize))
-	g.writeChunk(dummyHeader, true)
-
-	err := g.ops.Sync(g.file)
-	if err != nil {
-		return err
-	}
-
-	//Set the pos back to where it was when we started to write the real header.
-	g.pos = curPos
-
-	err = g.writeHeader(g.header)
-	if err != nil {
-		return err
-	}
-
-	err = g.ops.Sync(g.file)
-	return err
-}
-
 // DatabaseInfo returns information describing the database itself.
 func (g *Gouchstore) DatabaseInfo() (*DatabaseInfo, error) {
+	err := g.checkOpen()
+	if err != nil {
+		return nil, err
+	}
 	rv := DatabaseInfo{
-		FileName:       g.file.Name(),
+		FileName:       g.filename,
 		LastSeq:        g.header.updateSeq,
 		FileSize:       uint64(g.pos),
 		HeaderPosition: g.header.position,
@@ -647,7 +768,7 @@ func localLookupCallback(req *lookupRequest, key []byte, value []byte) error {
 	}
 
 	(*localDocPointer).ID = string(key)
-	(*localDocPointer).Body = value
+	(*localDocPointer).Body = append([]byte{}, value...)
 	(*localDocPointer).Deleted = false
 
 	return nil
@@ -655,8 +776,12 @@ func localLookupCallback(req *lookupRequest, key []byte, value []byte) error {
 
 // LocalDocumentById returns the LocalDocument with the specified identifier.
 func (g *Gouchstore) LocalDocumentById(id string) (*LocalDocument, error) {
+	err := g.checkOpen()
+	if err != nil {
+		return nil, err
+	}
 	if g.header.localDocsRoot == nil {
-		return nil, gs_ERROR_DOCUMENT_NOT_FOUND
+		return nil, ErrNotFound
 	}
 
 	resultDocPointer := &LocalDocument{}
@@ -669,13 +794,13 @@ func (g *Gouchstore) LocalDocumentById(id string) (*LocalDocument, error) {
 		callbackContext: resultDocPointer,
 	}
 
-	err := g.btreeLookup(&lr, g.header.localDocsRoot.pointer)
+	err = g.btreeLookup(&lr, g.header.localDocsRoot.pointer)
 	if err != nil {
 		return nil, err
 	}
 
 	if resultDocPointer.ID == "" {
-		return nil, gs_ERROR_DOCUMENT_NOT_FOUND
+		return nil, ErrNotFound
 	}
 
 	return resultDocPointer, nil
@@ -683,6 +808,16 @@ func (g *Gouchstore) LocalDocumentById(id string) (*LocalDocument, error) {
 
 // SaveLocalDocument stores local documents in the database
 func (g *Gouchstore) SaveLocalDocument(localDoc *LocalDocument) error {
+	err := g.checkWritable()
+	if err != nil {
+		return err
+	}
+	if len(localDoc.ID) > gs_MAX_ID_LENGTH {
+		return ErrKeyTooLarge
+	}
+	if int64(len(localDoc.Body)) > gs_MAX_DOC_DISK_SIZE {
+		return ErrDocumentTooLarge
+	}
 	ldUpdate := modifyAction{
 		key:   []byte(localDoc.ID),
 		value: localDoc.Body,
@@ -703,8 +838,8 @@ func (g *Gouchstore) SaveLocalDocument(localDoc *LocalDocument) error {
 		enablePurging:    false,
 		purgeKP:          nil,
 		purgeKV:          nil,
-		kpChunkThreshold: gs_DB_CHUNK_THRESHOLD,
-		kvChunkThreshold: gs_DB_CHUNK_THRESHOLD,
+		kpChunkThreshold: g.thresholds.Local.KP,
+		kvChunkThreshold: g.thresholds.Local.KV,
 	}
 
 	nroot, err := g.modifyBtree(req, g.header.localDocsRoot)
@@ -719,7 +854,10 @@ func (g *Gouchstore) SaveLocalDocument(localDoc *LocalDocument) error {
 }
 
 func (g *Gouchstore) WalkLocalDocsTree(startId, endId string, wtcb WalkTreeCallback, userContext interface{}) error {
-
+	err := g.checkOpen()
+	if err != nil {
+		return err
+	}
 	if g.header.localDocsRoot == nil {
 		return nil
 	}
@@ -747,7 +885,7 @@ func (g *Gouchstore) WalkLocalDocsTree(startId, endId string, wtcb WalkTreeCallb
 		callbackContext: &lc,
 	}
 
-	err := g.btreeLookup(&lr, g.header.localDocsRoot.pointer)
+	err = g.btreeLookup(&lr, g.header.localDocsRoot.pointer)
 	if err != nil {
 		return err
 	}
@@ -757,13 +895,46 @@ func (g *Gouchstore) WalkLocalDocsTree(startId, endId string, wtcb WalkTreeCallb
 
 // Close will close the underlying file handle and release any resources associated with the Gouchstore object.
 func (g *Gouchstore) Close() error {
-	return g.ops.Close(g.file)
+	if g.closed {
+		return ErrClosed
+	}
+	g.closed = true
+	// asynchronous commits still use the file
+	g.commits.Wait()
+	err := g.ops.Close(g.file)
+	if g.unlock != nil {
+		unlockErr := g.unlock()
+		if err == nil {
+			err = unlockErr
+		}
+	}
+	return err
+}
+
+// checkOpen guards every operation against use after Close.
+func (g *Gouchstore) checkOpen() error {
+	if g.closed {
+		return ErrClosed
+	}
+	return nil
+}
+
+// checkWritable guards every operation which modifies the file.
+func (g *Gouchstore) checkWritable() error {
+	if g.closed {
+		return ErrClosed
+	}
+	if g.readOnly {
+		return ErrReadOnly
+	}
+	return nil
 }
 
+// ContentMeta flags, the low bits hold the datatype, the high bit the compression flag.
 const (
-	gs_DOC_IS_JSON               = 0
-	gs_DOC_INVALID_JSON          = 1
-	gs_DOC_INVALID_JSON_KEY      = 2
-	gs_DOC_NON_JSON_MODE         = 3
-	DOC_IS_COMPRESSED       byte = 128
+	DOC_IS_JSON          byte = 0
+	DOC_INVALID_JSON     byte = 1
+	DOC_INVALID_JSON_KEY byte = 2
+	DOC_NON_JSON_MODE    byte = 3
+	DOC_IS_COMPRESSED    byte = 128
 )
@@ -315,7 +315,7 @@ func TestGouchstoreDocumentByDocumentInfo(t *testing.T) {
 
 func TestOpenInvalidArguments(t *testing.T) {
 	_, err := Open("", OPEN_CREATE|OPEN_RDONLY)
-	if err != gs_ERROR_INVALID_ARGUMENTS {
+	if err != ErrInvalidArguments {
 		t.Errorf("expected invalid arguments, got %v", err)
 	}
 }
@@ -378,13 +378,13 @@ func TestAddDocumentToEmpty(t *testing.T) {
 
 	// test that another non-existant docs dont exist
 	_, err = db.DocumentInfoById("does-not-exist")
-	if err != gs_ERROR_DOCUMENT_NOT_FOUND {
+	if err != ErrNotFound {
 		t.Errorf("expected document not found for key `does-not-exist`")
 	}
 
 	// test that another non-existant docs dont exist
 	_, err = db.DocumentInfoBySeq(255)
-	if err != gs_ERROR_DOCUMENT_NOT_FOUND {
+	if err != ErrNotFound {
 		t.Errorf("expected document not found for seq 255")
 	}
 }
@@ -1215,13 +1215,13 @@ func TestAddDocumentNoCompressionToEmpty(t *testing.T) {
 
 	// test that another non-existant docs dont exist
 	_, err = db.DocumentInfoById("does-not-exist")
-	if err != gs_ERROR_DOCUMENT_NOT_FOUND {
+	if err != ErrNotFound {
 		t.Errorf("expected document not found for key `does-not-exist`")
 	}
 
 	// test that another non-existant docs dont exist
 	_, err = db.DocumentInfoBySeq(255)
-	if err != gs_ERROR_DOCUMENT_NOT_FOUND {
+	if err != ErrNotFound {
 		t.Errorf("expected document not found for seq 255")
 	}
 }
@@ -1234,7 +1234,7 @@ func TestLocalDocs(t *testing.T) {
 	defer db.Close()
 
 	actualLocalDoc, err := db.LocalDocumentById("doesnotexist")
-	if err != gs_ERROR_DOCUMENT_NOT_FOUND {
+	if err != ErrNotFound {
 		t.Errorf("local document doesnotexist should be not found error, got: %v", err)
 	}
 	if actualLocalDoc != nil {
@@ -1267,7 +1267,7 @@ func TestLocalDocsFull(t *testing.T) {
 
 	// look for non-existant doc
 	actualLocalDoc, err := db.LocalDocumentById("doesnotexist")
-	if err != gs_ERROR_DOCUMENT_NOT_FOUND {
+	if err != ErrNotFound {
 		t.Errorf("local document doesnotexist should be not found error, got: %v", err)
 	}
 	if actualLocalDoc != nil {
@@ -1319,7 +1319,7 @@ func TestLocalDocsFull(t *testing.T) {
 
 	// now verify we cant find it
 	actualLocalDoc, err = db.LocalDocumentById(localDoc.ID)
-	if err != gs_ERROR_DOCUMENT_NOT_FOUND {
+	if err != ErrNotFound {
 		t.Errorf("deleted local document should be not found error, got: %v", err)
 	}
 	if actualLocalDoc != nil {
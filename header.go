@@ -12,6 +12,7 @@ package gouchstore
 import (
 	"bytes"
 	"fmt"
+	"hash/crc32"
 )
 
 const gs_DISK_VERSION = 11
@@ -74,7 +75,7 @@ func (h *header) String() string {
 	if h.bySeqRoot != nil {
 		rv += fmt.Sprintf("By Sequence Pointer: %d (0x%x)\n", h.bySeqRoot.pointer, h.bySeqRoot.pointer)
 		rv += fmt.Sprintf("By Sequence Subtree Size: %d (0x%x)\n", h.bySeqRoot.subtreeSize, h.bySeqRoot.subtreeSize)
-		count := decode_raw40(h.bySeqRoot.reducedValue)
+		count := decode_raw40(h.bySeqRoot.reducedValue[0:gs_BY_SEQ_REDUCE_SIZE])
 		rv += fmt.Sprintf("By Sequence Reduced Count: %d\n", count)
 	} else {
 		rv += fmt.Sprintf("By Sequence Pointer: nil\n")
@@ -106,6 +107,9 @@ func newHeader() *header {
 
 func newHeaderFromBytes(data []byte) (*header, error) {
 
+	if len(data) < int(gs_HEADER_BASE_SIZE) {
+		return nil, ErrHeaderBadSize
+	}
 	rv := header{}
 
 	rv.diskVersion = uint64(decode_raw08(data[0:1]))
@@ -117,21 +121,37 @@ func newHeaderFromBytes(data []byte) (*header, error) {
 	byIdRootSize := decode_raw16(data[21:23])
 	localDocRootSize := decode_raw16(data[23:25])
 
-	if len(data) != int(gs_HEADER_BASE_SIZE)+int(bySeqRootSize+byIdRootSize+localDocRootSize) {
-		return nil, gs_ERROR_INVALID_HEADER_BAD_SIZE
+	if len(data) != int(gs_HEADER_BASE_SIZE)+int(bySeqRootSize)+int(byIdRootSize)+int(localDocRootSize) {
+		return nil, ErrHeaderBadSize
 	}
 
+	var err error
 	pointerOffset := int(gs_HEADER_BASE_SIZE)
 	if bySeqRootSize > 0 {
-		rv.bySeqRoot = decodeRootNodePointer(data[pointerOffset : pointerOffset+int(bySeqRootSize)])
+		rv.bySeqRoot, err = decodeRootNodePointer(data[pointerOffset : pointerOffset+int(bySeqRootSize)])
+		if err != nil {
+			return nil, err
+		}
+		if len(rv.bySeqRoot.reducedValue) < gs_BY_SEQ_REDUCE_SIZE {
+			return nil, ErrShortData
+		}
 	}
 	pointerOffset += int(bySeqRootSize)
 	if byIdRootSize > 0 {
-		rv.byIdRoot = decodeRootNodePointer(data[pointerOffset : pointerOffset+int(byIdRootSize)])
+		rv.byIdRoot, err = decodeRootNodePointer(data[pointerOffset : pointerOffset+int(byIdRootSize)])
+		if err != nil {
+			return nil, err
+		}
+		if len(rv.byIdRoot.reducedValue) < gs_BY_ID_REDUCE_SIZE {
+			return nil, ErrShortData
+		}
 	}
 	pointerOffset += int(byIdRootSize)
 	if localDocRootSize > 0 {
-		rv.localDocsRoot = decodeRootNodePointer(data[pointerOffset : pointerOffset+int(localDocRootSize)])
+		rv.localDocsRoot, err = decodeRootNodePointer(data[pointerOffset : pointerOffset+int(localDocRootSize)])
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	return &rv, nil
@@ -144,7 +164,7 @@ func (g *Gouchstore) readHeaderAt(pos int64) (*header, error) {
 	}
 	header, err := newHeaderFromBytes(chunk)
 	if err != nil {
-		return nil, err
+		return nil, corruptAt(pos, CHUNK_TYPE_HEADER, err)
 	}
 	return header, nil
 }
@@ -161,6 +181,7 @@ func (g *Gouchstore) findLastHeader() error {
 		}
 		h, err = g.readHeaderAt(headerPos)
 		if err != nil {
+			g.logf("gouchstore: skipping invalid header at %d: %v", headerPos, err)
 			pos = headerPos - 1
 		}
 	}
@@ -169,6 +190,12 @@ func (g *Gouchstore) findLastHeader() error {
 	return nil
 }
 
+// setCommitted records the current header as the last one committed.
+func (g *Gouchstore) setCommitted() {
+	h := *g.header
+	g.committed = &h
+}
+
 func (g *Gouchstore) writeHeader(h *header) error {
 	headerBytes := h.toBytes()
 	_, _, err := g.writeChunk(headerBytes, true)
@@ -177,3 +204,17 @@ func (g *Gouchstore) writeHeader(h *header) error {
 	}
 	return nil
 }
+
+// writeHeaderBytesAt writes an encoded header at the first block boundary
+// at or after pos, without moving the end of file position.
+func (g *Gouchstore) writeHeaderBytesAt(headerBytes []byte, pos int64) error {
+	if pos%gs_BLOCK_SIZE != 0 {
+		pos += gs_BLOCK_SIZE - (pos % gs_BLOCK_SIZE)
+	}
+	buf := new(bytes.Buffer)
+	buf.Write(encode_raw32(uint32(len(headerBytes)) + uint32(gs_CHUNK_CRC_SIZE)))
+	buf.Write(encode_raw32(crc32.ChecksumIEEE(headerBytes)))
+	buf.Write(headerBytes)
+	_, err := g.writeAt(buf.Bytes(), pos, true)
+	return err
+}
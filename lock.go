@@ -0,0 +1,56 @@
+//  Copyright (c) 2014 Marty Schoch
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package gouchstore
+
+import (
+	"os"
+	"time"
+)
+
+// LockMode controls the advisory lock taken when a file is opened.
+// Writers take an exclusive lock, read only handles a shared lock, so any
+// number of readers or a single writer may have the file open.  Handles in
+// the same process share the lock, so a process may read a file it is
+// writing, but only one of its handles may write it.
+type LockMode int
+
+const (
+	// LOCK_NOWAIT fails with ErrLocked if the file is locked, the default.
+	LOCK_NOWAIT LockMode = iota
+	// LOCK_WAIT waits for the lock, at most Options.LockTimeout if set.
+	LOCK_WAIT
+	// LOCK_NONE does not lock the file.
+	LOCK_NONE
+)
+
+const gs_LOCK_RETRY_INTERVAL = 10 * time.Millisecond
+
+// lockFile takes the lock described by mode and timeout, a zero timeout
+// waits for as long as it takes.  It returns the function releasing the
+// lock.
+func lockFile(f *os.File, exclusive bool, mode LockMode, timeout time.Duration) (func() error, error) {
+	if mode == LOCK_NONE {
+		return nil, nil
+	}
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	for {
+		unlock, err := tryLockFile(f, exclusive)
+		if err != ErrLocked || mode == LOCK_NOWAIT {
+			return unlock, err
+		}
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return nil, ErrLocked
+		}
+		time.Sleep(gs_LOCK_RETRY_INTERVAL)
+	}
+}
@@ -0,0 +1,119 @@
+//  Copyright (c) 2014 Marty Schoch
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package gouchstore
+
+import (
+	"os"
+	"sync"
+	"syscall"
+)
+
+type fileLockKey struct {
+	dev uint64
+	ino uint64
+}
+
+// processLock is the flock this process holds on a file, shared by all of
+// its handles on the file.  It is held through a duplicate of the first
+// handle's descriptor, so it outlives that handle.
+type processLock struct {
+	file    *os.File
+	writer  bool
+	readers int
+}
+
+var processLocks = struct {
+	sync.Mutex
+	m map[fileLockKey]*processLock
+}{m: make(map[fileLockKey]*processLock)}
+
+// tryLockFile takes an advisory lock on the whole file without waiting,
+// it returns ErrLocked if another process holds a conflicting lock, or
+// another handle in this process is writing the file.
+func tryLockFile(f *os.File, exclusive bool) (func() error, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil, nil
+	}
+	key := fileLockKey{dev: uint64(st.Dev), ino: uint64(st.Ino)}
+
+	processLocks.Lock()
+	defer processLocks.Unlock()
+	l := processLocks.m[key]
+	if l == nil {
+		fd, err := syscall.Dup(int(f.Fd()))
+		if err != nil {
+			return nil, err
+		}
+		l = &processLock{file: os.NewFile(uintptr(fd), f.Name())}
+		err = flock(l.file, exclusive)
+		if err != nil {
+			l.file.Close()
+			return nil, err
+		}
+		processLocks.m[key] = l
+	} else if exclusive {
+		if l.writer {
+			return nil, ErrLocked
+		}
+		err = flock(l.file, true)
+		if err != nil {
+			// converting a lock is not atomic, take back the shared one
+			flock(l.file, false)
+			return nil, err
+		}
+	}
+	if exclusive {
+		l.writer = true
+	} else {
+		l.readers++
+	}
+
+	return func() error {
+		processLocks.Lock()
+		defer processLocks.Unlock()
+		if exclusive {
+			l.writer = false
+		} else {
+			l.readers--
+		}
+		if !l.writer && l.readers == 0 {
+			delete(processLocks.m, key)
+			return l.file.Close()
+		}
+		if exclusive {
+			return flock(l.file, false)
+		}
+		return nil
+	}, nil
+}
+
+// flock takes or converts the lock on f without waiting.
+func flock(f *os.File, exclusive bool) error {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	for {
+		err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB)
+		if err == syscall.EINTR {
+			continue
+		} else if err == syscall.EWOULDBLOCK {
+			return ErrLocked
+		}
+		return err
+	}
+}
@@ -0,0 +1,191 @@
+//  Copyright (c) 2014 Marty Schoch
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package gouchstore
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+// TestLockHelperProcess is not a real test, it is run in a second process
+// by openInOtherProcess, and reports how opening the file went in its
+// exit code.
+func TestLockHelperProcess(t *testing.T) {
+	filename := os.Getenv("GOUCHSTORE_LOCK_TEST_FILE")
+	if filename == "" {
+		return
+	}
+	options := &Options{
+		ReadOnly: os.Getenv("GOUCHSTORE_LOCK_TEST_RDONLY") != "",
+		Lock:     LOCK_NOWAIT,
+	}
+	db, err := OpenWithOptions(filename, options)
+	if err == ErrLocked {
+		os.Exit(3)
+	} else if err != nil {
+		os.Exit(1)
+	}
+	db.Close()
+	os.Exit(0)
+}
+
+// openInOtherProcess returns ErrLocked if another process cannot open the file.
+func openInOtherProcess(t *testing.T, filename string, readOnly bool) error {
+	cmd := exec.Command(os.Args[0], "-test.run=^TestLockHelperProcess$")
+	cmd.Env = append(os.Environ(), "GOUCHSTORE_LOCK_TEST_FILE="+filename)
+	if readOnly {
+		cmd.Env = append(cmd.Env, "GOUCHSTORE_LOCK_TEST_RDONLY=1")
+	}
+	err := cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 3 {
+		return ErrLocked
+	} else if err != nil {
+		t.Fatalf("helper process failed: %v", err)
+	}
+	return nil
+}
+
+func TestLockOtherProcess(t *testing.T) {
+	defer os.Remove("test.couch")
+	db, err := Open("test.couch", OPEN_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = openInOtherProcess(t, "test.couch", false)
+	if err != ErrLocked {
+		t.Errorf("expected a second writer to be locked out, got %v", err)
+	}
+	err = openInOtherProcess(t, "test.couch", true)
+	if err != ErrLocked {
+		t.Errorf("expected a reader to be locked out by a writer, got %v", err)
+	}
+	db.Close()
+
+	db, err = Open("test.couch", OPEN_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = openInOtherProcess(t, "test.couch", true)
+	if err != nil {
+		t.Errorf("expected readers to share the file, got %v", err)
+	}
+	err = openInOtherProcess(t, "test.couch", false)
+	if err != ErrLocked {
+		t.Errorf("expected a writer to be locked out by a reader, got %v", err)
+	}
+	db.Close()
+
+	err = openInOtherProcess(t, "test.couch", false)
+	if err != nil {
+		t.Errorf("expected the lock to be released on close, got %v", err)
+	}
+}
+
+func TestLockTimeout(t *testing.T) {
+	defer os.Remove("test.couch")
+	db, err := Open("test.couch", OPEN_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	_, err = Open("test.couch", 0)
+	if err != ErrLocked {
+		t.Errorf("expected ErrLocked, got %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("expected not to wait by default, waited %v", time.Since(start))
+	}
+
+	// OPEN_LOCK_NONE opens without locking, as before locking was added
+	unlocked, err := Open("test.couch", OPEN_LOCK_NONE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlocked.Close()
+	_, err = Open("test.couch", OPEN_LOCK_NONE|OPEN_LOCK_WAIT)
+	if err != ErrInvalidArguments {
+		t.Errorf("expected ErrInvalidArguments for two lock modes, got %v", err)
+	}
+
+	start = time.Now()
+	_, err = OpenWithOptions("test.couch", &Options{Lock: LOCK_WAIT, LockTimeout: 50 * time.Millisecond})
+	if err != ErrLocked {
+		t.Errorf("expected ErrLocked, got %v", err)
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Errorf("expected to wait for the timeout, waited %v", time.Since(start))
+	}
+
+	// waiting succeeds once the lock is released
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		db.Close()
+	}()
+	db2, err := OpenWithOptions("test.couch", &Options{Lock: LOCK_WAIT, LockTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db2.Close()
+}
+
+func TestLockSameProcess(t *testing.T) {
+	defer os.Remove("test.couch")
+	db, err := Open("test.couch", OPEN_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// readers in the same process share the writer's lock
+	reader, err := Open("test.couch", OPEN_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Open("test.couch", 0)
+	if err != ErrLocked {
+		t.Errorf("expected a second writer to be locked out, got %v", err)
+	}
+	err = openInOtherProcess(t, "test.couch", true)
+	if err != ErrLocked {
+		t.Errorf("expected a reader in another process to be locked out, got %v", err)
+	}
+
+	// closing the writer first leaves the readers' shared lock
+	db.Close()
+	err = openInOtherProcess(t, "test.couch", true)
+	if err != nil {
+		t.Errorf("expected readers to share the file, got %v", err)
+	}
+	err = openInOtherProcess(t, "test.couch", false)
+	if err != ErrLocked {
+		t.Errorf("expected a writer to be locked out by a reader, got %v", err)
+	}
+
+	// a writer can join a reader in the same process
+	db, err = Open("test.couch", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = openInOtherProcess(t, "test.couch", true)
+	if err != ErrLocked {
+		t.Errorf("expected a reader in another process to be locked out, got %v", err)
+	}
+	reader.Close()
+	db.Close()
+	err = openInOtherProcess(t, "test.couch", false)
+	if err != nil {
+		t.Errorf("expected the lock to be released on close, got %v", err)
+	}
+}
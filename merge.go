@@ -0,0 +1,265 @@
+//  Copyright (c) 2014 Marty Schoch
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package gouchstore
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// MergeResolver chooses between two versions of a document with the same
+// ID, found in different files.  It returns true if candidate, from a later
+// source, should replace current.
+type MergeResolver func(current, candidate *DocumentInfo) bool
+
+// HighestRevision keeps the version with the highest revision number, then
+// the highest revision meta-data, and the later source when they are equal.
+func HighestRevision(current, candidate *DocumentInfo) bool {
+	if candidate.Rev != current.Rev {
+		return candidate.Rev > current.Rev
+	}
+	return bytes.Compare(candidate.RevMeta, current.RevMeta) >= 0
+}
+
+// MergeOptions controls a merge.
+type MergeOptions struct {
+	// Resolver picks the version kept when sources share a document ID,
+	// HighestRevision is used if it is nil.
+	Resolver MergeResolver
+
+	// Options is how the sources and the target are opened, Create and
+	// ReadOnly are set as needed.  The bodies are copied as they are, so
+	// every file must use the same Codec.
+	Options *Options
+
+	// Sort tunes the sorts which find the versions to keep.
+	Sort SortConfig
+}
+
+// Merge writes every document from the databases srcs into the new
+// database dst, see MergeWithOptions.
+func Merge(dst string, srcs ...string) error {
+	return MergeWithOptions(dst, nil, srcs...)
+}
+
+// MergeWithOptions writes every document from the databases srcs into the
+// new, or empty, database dst.  When a document ID is in more than one
+// source, the version chosen by options.Resolver is kept.  The documents are
+// given new sequence numbers, following the order of srcs and then the
+// sequence numbers in each source, and their bodies are copied without
+// being decoded.  Local documents are not merged.
+//
+// If the merge fails a new dst is removed.  dst may not be one of srcs.
+func MergeWithOptions(dst string, options *MergeOptions, srcs ...string) error {
+	mergeOptions := MergeOptions{}
+	if options != nil {
+		mergeOptions = *options
+	}
+	if mergeOptions.Resolver == nil {
+		mergeOptions.Resolver = HighestRevision
+	}
+	openOptions := Options{}
+	if mergeOptions.Options != nil {
+		openOptions = *mergeOptions.Options
+	}
+	for _, src := range srcs {
+		if sameFileName(dst, src) {
+			return ErrInvalidArguments
+		}
+	}
+
+	sources := make([]*Gouchstore, 0, len(srcs))
+	defer func() {
+		for _, source := range sources {
+			source.Close()
+		}
+	}()
+	sourceOptions := openOptions
+	sourceOptions.Create = false
+	sourceOptions.ReadOnly = true
+	for _, src := range srcs {
+		source, err := OpenWithOptions(src, &sourceOptions)
+		if err != nil {
+			return err
+		}
+		sources = append(sources, source)
+	}
+
+	_, err := os.Stat(dst)
+	created := os.IsNotExist(err)
+	targetOptions := openOptions
+	targetOptions.Create = true
+	targetOptions.ReadOnly = false
+	target, err := OpenWithOptions(dst, &targetOptions)
+	if err != nil {
+		return err
+	}
+	err = target.mergeFrom(sources, &mergeOptions)
+	if err == nil {
+		err = target.Commit()
+	}
+	cerr := target.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err != nil && created {
+		os.Remove(dst)
+	}
+	return err
+}
+
+// mergeFrom fills the empty database g with the winning versions of the
+// documents in sources.
+func (g *Gouchstore) mergeFrom(sources []*Gouchstore, options *MergeOptions) error {
+	builder, err := g.newIndexBuilder()
+	if err != nil {
+		return err
+	}
+	defer builder.close()
+
+	// sort every version by ID, each keeping the source and sequence number
+	byId := newExternalSorter(gouchstoreIdComparator, options.Sort)
+	defer byId.close()
+	for i, source := range sources {
+		err = source.rawChangesSince(0, 0, func(source *Gouchstore, docInfo *DocumentInfo, userContext interface{}) error {
+			val := append(encode_raw32(uint32(i)), encode_raw48(docInfo.Seq)...)
+			val = append(val, docInfo.encodeBySeq()...)
+			return byId.add(sortRecord{key: []byte(docInfo.ID), val: val})
+		}, nil)
+		if err != nil {
+			return err
+		}
+	}
+	err = byId.finish()
+	if err != nil {
+		return err
+	}
+
+	// resolve each ID, and sort the winners back into source and sequence order
+	winners := newExternalSorter(compareMergeKeys, options.Sort)
+	defer winners.close()
+	var group []sortRecord
+	resolve := func() error {
+		if len(group) == 0 {
+			return nil
+		}
+		// the sort does not keep the source order
+		sort.Slice(group, func(i, j int) bool {
+			return bytes.Compare(group[i].val[0:4], group[j].val[0:4]) < 0
+		})
+		winner := group[0]
+		winnerInfo, err := decodeMergeRecord(winner.val)
+		if err != nil {
+			return err
+		}
+		for _, rec := range group[1:] {
+			info, err := decodeMergeRecord(rec.val)
+			if err != nil {
+				return err
+			}
+			if options.Resolver(winnerInfo, info) {
+				winner, winnerInfo = rec, info
+			}
+		}
+		group = group[:0]
+		return winners.add(sortRecord{key: winner.val[0:10], val: winner.val[10:]})
+	}
+	err = byId.each(func(rec sortRecord) error {
+		if len(group) > 0 && !bytes.Equal(group[0].key, rec.key) {
+			err := resolve()
+			if err != nil {
+				return err
+			}
+		}
+		group = append(group, rec)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = resolve()
+	if err != nil {
+		return err
+	}
+	err = winners.finish()
+	if err != nil {
+		return err
+	}
+
+	// copy the winners, with new sequence numbers
+	var seq uint64
+	err = winners.each(func(rec sortRecord) error {
+		source := sources[decode_raw32(rec.key[0:4])]
+		info := &DocumentInfo{}
+		err := decodeBySeqValue(info, rec.val)
+		if err != nil {
+			return err
+		}
+		if info.bodyPosition != 0 {
+			err = source.copyBody(g, info)
+			if err != nil {
+				return err
+			}
+		}
+		seq++
+		info.Seq = seq
+		return builder.add(encode_raw48(seq), info.encodeBySeq(), []byte(info.ID), info.encodeById(), info.Expiry(), info.Deleted)
+	})
+	if err != nil {
+		return err
+	}
+	err = builder.finish()
+	if err != nil {
+		return err
+	}
+	builder.apply()
+	g.logf("gouchstore: merged %d files into %s", len(sources), g.filename)
+	return nil
+}
+
+// decodeMergeRecord decodes the document info of a version being merged,
+// stored as the 32 bit source index, the 48 bit sequence number, then the
+// by-seq value.
+func decodeMergeRecord(val []byte) (*DocumentInfo, error) {
+	if len(val) < 10 {
+		return nil, ErrShortData
+	}
+	info := &DocumentInfo{}
+	err := decodeBySeqValue(info, val[10:])
+	if err != nil {
+		return nil, err
+	}
+	info.Seq = decode_raw48(val[4:10])
+	return info, nil
+}
+
+// compareMergeKeys orders the source index and sequence number keys.
+func compareMergeKeys(a, b []byte) int {
+	return bytes.Compare(a, b)
+}
+
+// sameFileName reports whether a and b name the same file, or the same path
+// if either does not exist yet.
+func sameFileName(a, b string) bool {
+	if filepath.Clean(a) == filepath.Clean(b) {
+		return true
+	}
+	aInfo, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	bInfo, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(aInfo, bInfo)
+}
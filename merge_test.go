@@ -0,0 +1,166 @@
+//  Copyright (c) 2014 Marty Schoch
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package gouchstore
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+// createMergeSource creates filename holding the documents ids, each at rev,
+// with a body naming the file.
+func createMergeSource(filename string, rev uint64, deleted bool, ids ...string) error {
+	db, err := Open(filename, OPEN_CREATE)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	for _, id := range ids {
+		docInfo := &DocumentInfo{ID: id, Rev: rev, Deleted: deleted}
+		var doc *Document
+		if !deleted {
+			doc = &Document{ID: id, Body: []byte(fmt.Sprintf(`{"from":"%s"}`, filename))}
+		}
+		err = db.SaveDocument(doc, docInfo)
+		if err != nil {
+			return err
+		}
+	}
+	err = db.SaveLocalDocument(&LocalDocument{ID: "_local/vbstate", Body: []byte(`{}`)})
+	if err != nil {
+		return err
+	}
+	return db.Commit()
+}
+
+func TestMerge(t *testing.T) {
+	defer os.Remove("test-a.couch")
+	defer os.Remove("test-b.couch")
+	defer os.Remove("test-c.couch")
+	defer os.Remove("test.couch")
+
+	var ids []string
+	for i := 0; i < 1000; i++ {
+		ids = append(ids, fmt.Sprintf("doc-%04d", i))
+	}
+	// a has 0-599 at rev 2, b has 400-999 at rev 1, c deletes 900-999 at rev 3
+	err := createMergeSource("test-a.couch", 2, false, ids[:600]...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = createMergeSource("test-b.couch", 1, false, ids[400:]...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = createMergeSource("test-c.couch", 3, true, ids[900:]...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = MergeWithOptions("test.couch", &MergeOptions{Sort: SortConfig{MemoryBudget: 10000, Parallelism: 2}},
+		"test-a.couch", "test-b.couch", "test-c.couch")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := Open("test.couch", OPEN_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	info, err := db.DatabaseInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.LastSeq != 1000 || info.DocumentCount != 900 || info.DeletedCount != 100 {
+		t.Errorf("expected 900 documents and 100 deleted at seq 1000, got %d, %d, %d", info.DocumentCount, info.DeletedCount, info.LastSeq)
+	}
+	from := func(i int) (string, uint64) {
+		switch {
+		case i < 600:
+			return "test-a.couch", 2
+		case i < 900:
+			return "test-b.couch", 1
+		}
+		return "test-c.couch", 3
+	}
+	// the sequence numbers follow the sources in order
+	seq := uint64(0)
+	err = db.ChangesSince(0, 0, func(g *Gouchstore, docInfo *DocumentInfo, userContext interface{}) error {
+		seq++
+		i := int(seq - 1)
+		filename, rev := from(i)
+		if docInfo.ID != ids[i] || docInfo.Seq != seq || docInfo.Rev != rev {
+			return fmt.Errorf("expected %s rev %d at %d, got %s rev %d at %d", ids[i], rev, seq, docInfo.ID, docInfo.Rev, docInfo.Seq)
+		}
+		if docInfo.Deleted {
+			return nil
+		}
+		doc, err := g.DocumentByDocumentInfo(docInfo)
+		if err != nil {
+			return err
+		}
+		if string(doc.Body) != fmt.Sprintf(`{"from":"%s"}`, filename) {
+			return fmt.Errorf("expected %s from %s, got %s", docInfo.ID, filename, doc.Body)
+		}
+		return nil
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq != 1000 {
+		t.Errorf("expected 1000 changes, got %d", seq)
+	}
+	_, err = db.LocalDocumentById("_local/vbstate")
+	if err != ErrNotFound {
+		t.Errorf("expected local documents not to be merged, got %v", err)
+	}
+	db.Close()
+
+	// a resolver keeping the first version seen
+	os.Remove("test.couch")
+	err = MergeWithOptions("test.couch", &MergeOptions{
+		Resolver: func(current, candidate *DocumentInfo) bool {
+			return false
+		},
+	}, "test-b.couch", "test-a.couch", "test-c.couch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open("test.couch", OPEN_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	docInfo, err := db.DocumentInfoById("doc-0500")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if docInfo.Rev != 1 || docInfo.Seq != 101 {
+		t.Errorf("expected rev 1 from the first source at seq 101, got rev %d at %d", docInfo.Rev, docInfo.Seq)
+	}
+	db.Close()
+
+	// an existing database is not merged into, nor removed
+	err = Merge("test.couch", "test-a.couch")
+	if err != ErrNotEmpty {
+		t.Errorf("expected ErrNotEmpty, got %v", err)
+	}
+	if _, err := os.Stat("test.couch"); err != nil {
+		t.Errorf("expected the existing file to be kept, got %v", err)
+	}
+
+	// nor merged into one of the sources
+	err = Merge("test-a.couch", "test-b.couch", "./test-a.couch")
+	if err != ErrInvalidArguments {
+		t.Errorf("expected ErrInvalidArguments, got %v", err)
+	}
+}
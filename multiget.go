@@ -0,0 +1,262 @@
+//  Copyright (c) 2014 Marty Schoch
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package gouchstore
+
+import (
+	"hash/crc32"
+	"io"
+	"sort"
+	"sync"
+)
+
+const gs_MULTIGET_MAX_GAP = 16 * 1024
+const gs_MULTIGET_MAX_READ_SIZE = 1024 * 1024
+
+// MultiGetOptions tunes how DocumentsByIdsWithOptions reads the bodies.
+type MultiGetOptions struct {
+	// MaxGap is the most unwanted bytes read between two bodies to fetch
+	// them with one read, 16KB if zero.
+	MaxGap int64
+	// MaxReadSize limits the size of one read, 1MB if zero.  Bodies larger
+	// than this are still read whole.
+	MaxReadSize int64
+	// Parallelism is the number of goroutines decompressing bodies, if
+	// zero or one they are decompressed by the caller.
+	Parallelism int
+}
+
+// DocumentsByIds returns the Documents with the specified IDs, leaving out
+// those which are missing or deleted.  The bodies are read in file order,
+// with nearby bodies fetched by a single read.
+//
+// NOTE: contents of the result slice will be in ascending ID order, not the order they
+// appeared in the argument list.
+func (g *Gouchstore) DocumentsByIds(identifiers []string) ([]*Document, error) {
+	return g.DocumentsByIdsWithOptions(identifiers, nil)
+}
+
+// DocumentsByIdsWithOptions is DocumentsByIds, with the reads tuned by
+// options, which may be nil.
+func (g *Gouchstore) DocumentsByIdsWithOptions(identifiers []string, options *MultiGetOptions) ([]*Document, error) {
+	if options == nil {
+		options = &MultiGetOptions{}
+	}
+	if options.MaxGap < 0 || options.MaxReadSize < 0 || options.Parallelism < 0 {
+		return nil, ErrInvalidArguments
+	}
+	maxGap := options.MaxGap
+	if maxGap == 0 {
+		maxGap = gs_MULTIGET_MAX_GAP
+	}
+	maxReadSize := options.MaxReadSize
+	if maxReadSize == 0 {
+		maxReadSize = gs_MULTIGET_MAX_READ_SIZE
+	}
+
+	docInfos, err := g.DocumentInfosByIds(identifiers)
+	if err != nil {
+		return nil, err
+	}
+	live := docInfos[:0]
+	for _, docInfo := range docInfos {
+		if !docInfo.Deleted && docInfo.bodyPosition != 0 {
+			live = append(live, docInfo)
+		}
+	}
+	docInfos = live
+
+	chunks := make([][]byte, len(docInfos))
+	err = g.readChunks(docInfos, chunks, maxGap, maxReadSize)
+	if err != nil {
+		return nil, err
+	}
+
+	err = g.decodeChunks(docInfos, chunks, options.Parallelism)
+	if err != nil {
+		return nil, err
+	}
+	rv := make([]*Document, len(docInfos))
+	for i, docInfo := range docInfos {
+		rv[i] = &Document{ID: docInfo.ID, Body: chunks[i]}
+	}
+	return rv, nil
+}
+
+// readChunks reads the body chunks of docInfos into chunks, in file order,
+// fetching bodies no more than maxGap bytes apart with a single read of up
+// to maxReadSize bytes.
+func (g *Gouchstore) readChunks(docInfos []*DocumentInfo, chunks [][]byte, maxGap, maxReadSize int64) error {
+	byPosition := make([]int, len(docInfos))
+	for i := range byPosition {
+		byPosition[i] = i
+	}
+	sort.Slice(byPosition, func(i, j int) bool {
+		return docInfos[byPosition[i]].bodyPosition < docInfos[byPosition[j]].bodyPosition
+	})
+	for start := 0; start < len(byPosition); {
+		from := int64(docInfos[byPosition[start]].bodyPosition)
+		to := g.chunkEnd(docInfos[byPosition[start]])
+		end := start + 1
+		for ; end < len(byPosition); end++ {
+			pos := int64(docInfos[byPosition[end]].bodyPosition)
+			next := g.chunkEnd(docInfos[byPosition[end]])
+			if pos-to > maxGap || next-from > maxReadSize {
+				break
+			}
+			if next > to {
+				to = next
+			}
+		}
+
+		buf := make([]byte, to-from)
+		n, err := g.ops.ReadAt(g.file, buf, from)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		blocks := blockBuffer{buf: buf[:n], pos: from}
+		for _, i := range byPosition[start:end] {
+			chunks[i], err = g.readBufferedChunkAt(&blocks, int64(docInfos[i].bodyPosition))
+			if err != nil {
+				return err
+			}
+		}
+		start = end
+	}
+	return nil
+}
+
+// chunkEnd estimates where the body chunk of docInfo ends from its recorded
+// size, the chunk is read again by itself if it turns out to be larger.
+func (g *Gouchstore) chunkEnd(docInfo *DocumentInfo) int64 {
+	pos := int64(docInfo.bodyPosition)
+	size := int64(docInfo.Size)
+	if minimum := chunkDiskSize(pos, 0); size < minimum {
+		size = minimum
+	}
+	if pos+size > g.pos {
+		return g.pos
+	}
+	return pos + size
+}
+
+// blockBuffer holds bytes read from the file starting at pos, block markers
+// included.
+type blockBuffer struct {
+	buf []byte
+	pos int64
+}
+
+// readAt is like Gouchstore.readAt, but copies from the buffer.  It returns
+// the position following the bytes copied, and false if they are not all in
+// the buffer.
+func (b *blockBuffer) readAt(dst []byte, pos int64) (int64, bool) {
+	copied := 0
+	for copied < len(dst) {
+		if pos%gs_BLOCK_SIZE == 0 {
+			pos++
+		}
+		if pos < b.pos || pos >= b.pos+int64(len(b.buf)) {
+			return pos, false
+		}
+		n := gs_BLOCK_SIZE - pos%gs_BLOCK_SIZE
+		if n > int64(len(dst)-copied) {
+			n = int64(len(dst) - copied)
+		}
+		n = int64(copy(dst[copied:copied+int(n)], b.buf[pos-b.pos:]))
+		copied += int(n)
+		pos += n
+	}
+	return pos, true
+}
+
+// readBufferedChunkAt is like readChunkAt for a data chunk, but reads it
+// from the buffer if it is there.
+func (g *Gouchstore) readBufferedChunkAt(b *blockBuffer, pos int64) ([]byte, error) {
+	data, ok, err := bufferedChunkAt(b, pos, g.pos)
+	if err != nil || ok {
+		return data, err
+	}
+	return g.readChunkAt(pos, false)
+}
+
+// bufferedChunkAt parses the data chunk at pos from the buffer, in a file
+// of size end.  It returns false if the chunk is not all in the buffer.
+func bufferedChunkAt(b *blockBuffer, pos int64, end int64) ([]byte, bool, error) {
+	chunkPrefix := make([]byte, gs_CHUNK_LENGTH_SIZE+gs_CHUNK_CRC_SIZE)
+	dataPos, ok := b.readAt(chunkPrefix, pos)
+	if !ok {
+		return nil, false, nil
+	}
+	size := decode_raw31(chunkPrefix[0:gs_CHUNK_LENGTH_SIZE])
+	crc := decode_raw32(chunkPrefix[gs_CHUNK_LENGTH_SIZE : gs_CHUNK_LENGTH_SIZE+gs_CHUNK_CRC_SIZE])
+	if int64(size) > end-pos {
+		return nil, false, corruptAt(pos, CHUNK_TYPE_DATA, ErrChunkDataLessThanSize)
+	}
+	data := make([]byte, size)
+	_, ok = b.readAt(data, dataPos)
+	if !ok {
+		return nil, false, nil
+	}
+	if crc32.ChecksumIEEE(data) != crc {
+		return nil, false, corruptAt(pos, CHUNK_TYPE_DATA, ErrChunkBadCRC)
+	}
+	return data, true, nil
+}
+
+// decodeChunks decompresses the chunks of compressed documents in place,
+// using up to parallelism goroutines.
+func (g *Gouchstore) decodeChunks(docInfos []*DocumentInfo, chunks [][]byte, parallelism int) error {
+	decode := func(i int) error {
+		if !docInfos[i].Compressed() {
+			return nil
+		}
+		decoded, err := g.codec.Decode(nil, chunks[i])
+		if err != nil {
+			return corruptAt(int64(docInfos[i].bodyPosition), CHUNK_TYPE_DATA, ErrChunkBadCompression)
+		}
+		chunks[i] = decoded
+		return nil
+	}
+	if parallelism <= 1 {
+		for i := range chunks {
+			err := decode(i)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	work := make(chan int)
+	errs := make([]error, parallelism)
+	var wg sync.WaitGroup
+	for w := 0; w < parallelism; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := range work {
+				if errs[w] == nil {
+					errs[w] = decode(i)
+				}
+			}
+		}(w)
+	}
+	for i := range chunks {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
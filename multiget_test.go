@@ -0,0 +1,158 @@
+//  Copyright (c) 2014 Marty Schoch
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package gouchstore
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"reflect"
+	"sync/atomic"
+	"testing"
+)
+
+func TestDocumentsByIds(t *testing.T) {
+	defer os.Remove("test.couch")
+
+	ops := &readCountingGouchOps{BaseGouchOps: NewBaseGouchOps()}
+	db, err := OpenEx("test.couch", OPEN_CREATE, ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// every third document compressed, every tenth deleted and every 50th
+	// large enough to cross several blocks
+	for i := 0; i < 500; i++ {
+		id := fmt.Sprintf("doc-%03d", i)
+		body := []byte(fmt.Sprintf(`{"i":%d}`, i))
+		if i%50 == 0 {
+			body = bytes.Repeat([]byte(fmt.Sprintf("%03d", i)), 4000)
+		}
+		docInfo := &DocumentInfo{ID: id, Rev: 1}
+		if i%3 == 0 {
+			docInfo.ContentMeta = DOC_IS_COMPRESSED
+		}
+		err = db.SaveDocument(&Document{ID: id, Body: body}, docInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 5; i < 500; i += 10 {
+		id := fmt.Sprintf("doc-%03d", i)
+		err = db.SaveDocument(nil, &DocumentInfo{ID: id, Rev: 2, Deleted: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = db.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// ask in reverse order, for some which are missing
+	var ids []string
+	var expected []*Document
+	for i := 499; i >= 0; i -= 2 {
+		ids = append(ids, fmt.Sprintf("doc-%03d", i))
+	}
+	ids = append(ids, "missing")
+	for i := 1; i < 500; i += 2 {
+		doc, err := db.DocumentById(fmt.Sprintf("doc-%03d", i))
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected = append(expected, doc)
+	}
+	if len(expected) != 200 {
+		t.Fatalf("expected 200 live documents, got %d", len(expected))
+	}
+
+	atomic.StoreInt32(&ops.reads, 0)
+	docs, err := db.DocumentsByIds(ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(docs, expected) {
+		t.Errorf("expected the same documents as DocumentById")
+	}
+	multiGetReads := atomic.LoadInt32(&ops.reads)
+	atomic.StoreInt32(&ops.reads, 0)
+	for _, doc := range expected {
+		_, err = db.DocumentById(doc.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if singleReads := atomic.LoadInt32(&ops.reads); multiGetReads*4 > singleReads {
+		t.Errorf("expected coalesced reads, multi-get read %d times, single gets %d", multiGetReads, singleReads)
+	}
+
+	// including the large bodies
+	ids = nil
+	expected = nil
+	for i := 0; i < 500; i += 20 {
+		id := fmt.Sprintf("doc-%03d", i)
+		ids = append(ids, id)
+		doc, err := db.DocumentById(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected = append(expected, doc)
+	}
+	for i, options := range []*MultiGetOptions{
+		nil,
+		{Parallelism: 4},
+		{MaxGap: 1, MaxReadSize: 1},
+		{MaxReadSize: 10000, Parallelism: 2},
+	} {
+		docs, err = db.DocumentsByIdsWithOptions(ids, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(docs, expected) {
+			t.Errorf("%d: expected the same documents as DocumentById", i)
+		}
+	}
+
+	_, err = db.DocumentsByIdsWithOptions(ids, &MultiGetOptions{MaxGap: -1})
+	if err != ErrInvalidArguments {
+		t.Errorf("expected ErrInvalidArguments, got %v", err)
+	}
+}
+
+func TestBlockBuffer(t *testing.T) {
+	// bytes 4090 to 4106 of a file, the marker at 4096 is 0xff
+	buf := make([]byte, 16)
+	for i := range buf {
+		buf[i] = byte(i)
+	}
+	buf[6] = 0xff
+	b := blockBuffer{buf: buf, pos: 4090}
+
+	dst := make([]byte, 10)
+	next, ok := b.readAt(dst, 4092)
+	if !ok || next != 4103 {
+		t.Fatalf("expected to read up to 4103, got %d, %v", next, ok)
+	}
+	if !reflect.DeepEqual(dst, []byte{2, 3, 4, 5, 7, 8, 9, 10, 11, 12}) {
+		t.Errorf("expected the marker to be skipped, got %v", dst)
+	}
+	_, ok = b.readAt(dst, 4100)
+	if ok {
+		t.Errorf("expected a read past the buffer to fail")
+	}
+	_, ok = b.readAt(dst, 4080)
+	if ok {
+		t.Errorf("expected a read before the buffer to fail")
+	}
+}
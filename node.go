@@ -90,21 +90,30 @@ func (np *nodePointer) encode() []byte {
 	return buf.Bytes()
 }
 
-func decodeRootNodePointer(data []byte) *nodePointer {
+func decodeRootNodePointer(data []byte) (*nodePointer, error) {
+	if len(data) < gs_ROOT_BASE_SIZE {
+		return nil, ErrShortData
+	}
 	n := nodePointer{}
 	n.pointer = decode_raw48(data[0:6])
 	n.subtreeSize = decode_raw48(data[6:12])
 	n.reducedValue = data[gs_ROOT_BASE_SIZE:]
-	return &n
+	return &n, nil
 }
 
-func decodeNodePointer(data []byte) *nodePointer {
+func decodeNodePointer(data []byte) (*nodePointer, error) {
+	if len(data) < 14 {
+		return nil, ErrShortData
+	}
 	n := nodePointer{}
 	n.pointer = decode_raw48(data[0:6])
 	n.subtreeSize = decode_raw48(data[6:12])
-	reduceValueSize := decode_raw16(data[12:14])
+	reduceValueSize := int(decode_raw16(data[12:14]))
+	if len(data) < 14+reduceValueSize {
+		return nil, ErrShortData
+	}
 	n.reducedValue = data[14 : 14+reduceValueSize]
-	return &n
+	return &n, nil
 }
 
 func (np *nodePointer) String() string {
@@ -122,8 +131,14 @@ func decodeInteriorBtreeNode(nodeData []byte, indexType int) (*node, error) {
 	bufPos := 1
 	resultNode := newInteriorNode()
 	for bufPos < len(nodeData) {
-		key, value, end := decodeKeyValue(nodeData, bufPos)
-		valueNodePointer := decodeNodePointer(value)
+		key, value, end, err := decodeKeyValue(nodeData, bufPos)
+		if err != nil {
+			return nil, err
+		}
+		valueNodePointer, err := decodeNodePointer(value)
+		if err != nil {
+			return nil, err
+		}
 		valueNodePointer.key = key
 		resultNode.pointers = append(resultNode.pointers, valueNodePointer)
 		bufPos = end
@@ -135,14 +150,20 @@ func decodeLeafBtreeNode(nodeData []byte, indexType int) (*node, error) {
 	bufPos := 1
 	resultNode := newLeafNode()
 	for bufPos < len(nodeData) {
-		key, value, end := decodeKeyValue(nodeData, bufPos)
+		key, value, end, err := decodeKeyValue(nodeData, bufPos)
+		if err != nil {
+			return nil, err
+		}
 		docinfo := DocumentInfo{}
 		if indexType == gs_INDEX_TYPE_BY_ID {
 			docinfo.ID = string(key)
-			decodeByIdValue(&docinfo, value)
+			err = decodeByIdValue(&docinfo, value)
 		} else if indexType == gs_INDEX_TYPE_BY_SEQ {
 			docinfo.Seq = decode_raw48(key)
-			decodeBySeqValue(&docinfo, value)
+			err = decodeBySeqValue(&docinfo, value)
+		}
+		if err != nil {
+			return nil, err
 		}
 
 		resultNode.documents = append(resultNode.documents, &docinfo)
@@ -151,13 +172,17 @@ func decodeLeafBtreeNode(nodeData []byte, indexType int) (*node, error) {
 	return resultNode, nil
 }
 
-func decodeByIdValue(docinfo *DocumentInfo, value []byte) {
+func decodeByIdValue(docinfo *DocumentInfo, value []byte) error {
+	if len(value) < 23 {
+		return ErrShortData
+	}
 	docinfo.Seq = decode_raw48(value[0:6])
 	docinfo.Size = uint64(decode_raw32(value[6:10]))
 	docinfo.Deleted, docinfo.bodyPosition = decode_raw_1_47_split(value[10:16])
 	docinfo.Rev = decode_raw48(value[16:22])
 	docinfo.ContentMeta = decode_raw08(value[22:23])
-	docinfo.RevMeta = value[23:]
+	docinfo.RevMeta = append([]byte{}, value[23:]...)
+	return nil
 }
 
 func (d DocumentInfo) encodeById() []byte {
@@ -171,14 +196,21 @@ func (d DocumentInfo) encodeById() []byte {
 	return buf.Bytes()
 }
 
-func decodeBySeqValue(docinfo *DocumentInfo, value []byte) {
+func decodeBySeqValue(docinfo *DocumentInfo, value []byte) error {
+	if len(value) < 18 {
+		return ErrShortData
+	}
 	idSize, docSize := decode_raw_12_28_split(value[0:5])
+	if len(value) < 18+int(idSize) {
+		return ErrShortData
+	}
 	docinfo.Size = uint64(docSize)
 	docinfo.Deleted, docinfo.bodyPosition = decode_raw_1_47_split(value[5:12])
 	docinfo.Rev = decode_raw48(value[11:17])
 	docinfo.ContentMeta = decode_raw08(value[17:18])
 	docinfo.ID = string(value[18 : 18+idSize])
-	docinfo.RevMeta = value[18+idSize:]
+	docinfo.RevMeta = append([]byte{}, value[18+idSize:]...)
+	return nil
 }
 
 func (d DocumentInfo) encodeBySeq() []byte {
@@ -192,15 +224,21 @@ func (d DocumentInfo) encodeBySeq() []byte {
 	return buf.Bytes()
 }
 
-func decodeKeyValue(nodeData []byte, bufPos int) ([]byte, []byte, int) {
-	keyLength, valueLength := decode_raw_12_28_split(nodeData[bufPos : bufPos+5])
-	keyStart := bufPos + 5
+func decodeKeyValue(nodeData []byte, bufPos int) ([]byte, []byte, int, error) {
+	if bufPos < 0 || len(nodeData)-bufPos < gs_KEY_VALUE_LEN {
+		return nil, nil, 0, ErrShortData
+	}
+	keyLength, valueLength := decode_raw_12_28_split(nodeData[bufPos : bufPos+gs_KEY_VALUE_LEN])
+	keyStart := bufPos + gs_KEY_VALUE_LEN
 	keyEnd := keyStart + int(keyLength)
-	key := nodeData[keyStart:keyEnd]
 	valueStart := keyEnd
 	valueEnd := valueStart + int(valueLength)
+	if valueEnd > len(nodeData) {
+		return nil, nil, 0, ErrShortData
+	}
+	key := nodeData[keyStart:keyEnd]
 	value := nodeData[valueStart:valueEnd]
-	return key, value, valueEnd
+	return key, value, valueEnd, nil
 }
 
 func encodeKeyValue(key, value []byte) []byte {
@@ -216,6 +254,7 @@ func encodeKeyValue(key, value []byte) []byte {
 type keyValueIterator struct {
 	data []byte
 	pos  int
+	err  error
 }
 
 func newKeyValueIterator(data []byte) *keyValueIterator {
@@ -224,11 +263,21 @@ func newKeyValueIterator(data []byte) *keyValueIterator {
 	}
 }
 
+// Next returns the next key and value, or nil at the end of the data
+// or when it is invalid, in which case Err returns the reason.
 func (kvi *keyValueIterator) Next() ([]byte, []byte) {
-	if kvi.pos < len(kvi.data) {
-		key, value, end := decodeKeyValue(kvi.data, kvi.pos)
+	if kvi.err == nil && kvi.pos < len(kvi.data) {
+		key, value, end, err := decodeKeyValue(kvi.data, kvi.pos)
+		if err != nil {
+			kvi.err = err
+			return nil, nil
+		}
 		kvi.pos = end
 		return key, value
 	}
 	return nil, nil
 }
+
+func (kvi *keyValueIterator) Err() error {
+	return kvi.err
+}
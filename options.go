@@ -0,0 +1,251 @@
+//  Copyright (c) 2014 Marty Schoch
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package gouchstore
+
+import (
+	"os"
+	"time"
+)
+
+// Codec compresses document bodies and btree nodes.  Couchstore files are
+// always snappy compressed, a file written with any other codec can only be
+// read back using the same codec.
+type Codec interface {
+	Encode(dst, src []byte) []byte
+	Decode(dst, src []byte) ([]byte, error)
+}
+
+// opsCodec is the default codec, it uses the snappy implementation of the ops.
+type opsCodec struct {
+	ops GouchOps
+}
+
+func (c opsCodec) Encode(dst, src []byte) []byte {
+	return c.ops.SnappyEncode(dst, src)
+}
+
+func (c opsCodec) Decode(dst, src []byte) ([]byte, error) {
+	return c.ops.SnappyDecode(dst, src)
+}
+
+// Logger receives diagnostic messages, a *log.Logger satisfies it.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// TreeWriterFunc creates the TreeWriters used to build the by-id and
+// by-expiry indexes during compaction and BulkLoad.
+type TreeWriterFunc func(keyCompare btreeKeyComparator, reduce, rereduce reduceFunc, reduceContext interface{}) (TreeWriter, error)
+
+// InMemoryTreeWriterFunc sorts the by-id index in memory during compaction.
+func InMemoryTreeWriterFunc(keyCompare btreeKeyComparator, reduce, rereduce reduceFunc, reduceContext interface{}) (TreeWriter, error) {
+	return NewInMemoryTreeWriter(keyCompare, reduce, rereduce, reduceContext)
+}
+
+// OnDiskTreeWriterFunc sorts the by-id index using temporary files in dir
+// during compaction, the system temporary directory is used if dir is empty.
+func OnDiskTreeWriterFunc(dir string) TreeWriterFunc {
+	return ExternalSortTreeWriterFunc(SortConfig{TempDir: dir})
+}
+
+// ExternalSortTreeWriterFunc sorts the by-id index on disk during
+// compaction, as configured by config.
+func ExternalSortTreeWriterFunc(config SortConfig) TreeWriterFunc {
+	return func(keyCompare btreeKeyComparator, reduce, rereduce reduceFunc, reduceContext interface{}) (TreeWriter, error) {
+		return newOnDiskTreeWriter(config, "", keyCompare, reduce, rereduce, reduceContext)
+	}
+}
+
+// Options controls how a database is opened, the zero value opens an
+// existing file for reading and writing with full durability.
+type Options struct {
+	Create     bool       // create the file if it does not exist
+	ReadOnly   bool       // open the file for reading only
+	Durability Durability // how commits are synced, DURABILITY_DEFAULT means DURABILITY_FULL
+	Expiry     bool       // maintain the expiry index, and hide expired documents from every read
+	JSONMode   JSONMode   // check document bodies for JSON when saving
+
+	// ContentHash maintains a hash of the documents in each by-id subtree,
+	// so that files can be compared without reading every document, see
+	// ContentHash and DiffRanges.  Files which already have the hashes keep
+	// them up to date regardless, and compaction keeps them.  Only the ID,
+	// revision, RevMeta and deleted flag are hashed, not the body, its size
+	// or ContentMeta, so a body changed without a new revision goes
+	// unnoticed, use Diff with DiffOptions.CompareBodies to find those.
+	ContentHash bool
+
+	// Lock is how to lock the file against other processes, writers need
+	// an exclusive lock and readers a shared one.  By default opening a
+	// locked file fails with ErrLocked, LOCK_WAIT waits for the lock, at
+	// most LockTimeout, or forever if it is zero.  LOCK_NONE does not lock,
+	// as before locking was added.
+	Lock        LockMode
+	LockTimeout time.Duration
+
+	// NodeCacheSize is the number of decoded btree nodes kept in memory,
+	// zero disables the cache.
+	NodeCacheSize int
+
+	// ChunkThreshold is the size in bytes at which btree nodes are split.
+	// The per tree thresholds override it, anything left zero uses what
+	// the file was written with, or the couchstore default.  Thresholds
+	// are recorded in the file, and kept by compaction.
+	ChunkThreshold      int
+	IdTreeThresholds    ChunkThresholds
+	SeqTreeThresholds   ChunkThresholds
+	LocalTreeThresholds ChunkThresholds
+
+	Codec                Codec          // defaults to snappy, using Ops
+	CompactionTreeWriter TreeWriterFunc // defaults to the CompactionTreeWriter of Ops
+	Logger               Logger         // defaults to no logging
+	Ops                  GouchOps       // defaults to NewBaseGouchOps()
+}
+
+// Validate returns ErrInvalidArguments if the options conflict or are out of range.
+func (o *Options) Validate() error {
+	if o.Create && o.ReadOnly {
+		return ErrInvalidArguments
+	}
+	if o.Durability < DURABILITY_DEFAULT || o.Durability > DURABILITY_NONE {
+		return ErrInvalidArguments
+	}
+	if o.JSONMode < JSON_MODE_OFF || o.JSONMode > JSON_MODE_VALIDATE {
+		return ErrInvalidArguments
+	}
+	if o.Lock < LOCK_NOWAIT || o.Lock > LOCK_NONE || o.LockTimeout < 0 {
+		return ErrInvalidArguments
+	}
+	if o.NodeCacheSize < 0 || o.ChunkThreshold < 0 {
+		return ErrInvalidArguments
+	}
+	if !o.IdTreeThresholds.valid() || !o.SeqTreeThresholds.valid() || !o.LocalTreeThresholds.valid() {
+		return ErrInvalidArguments
+	}
+	return nil
+}
+
+// optionsFromFlags converts the OPEN_* flags accepted by OpenEx.
+func optionsFromFlags(options int, ops GouchOps) (*Options, error) {
+	if options&OPEN_DURABILITY_SINGLE_SYNC != 0 && options&OPEN_DURABILITY_NONE != 0 {
+		return nil, ErrInvalidArguments
+	}
+	locks := options & (OPEN_LOCK_NOWAIT | OPEN_LOCK_WAIT | OPEN_LOCK_NONE)
+	if locks&(locks-1) != 0 {
+		// more than one lock mode
+		return nil, ErrInvalidArguments
+	}
+	if options&OPEN_JSON_DETECT != 0 && options&OPEN_JSON_VALIDATE != 0 {
+		return nil, ErrInvalidArguments
+	}
+	rv := Options{
+		Create:      options&OPEN_CREATE != 0,
+		ReadOnly:    options&OPEN_RDONLY != 0,
+		Expiry:      options&OPEN_EXPIRY != 0,
+		ContentHash: options&OPEN_CONTENT_HASH != 0,
+		Ops:         ops,
+	}
+	if options&OPEN_DURABILITY_SINGLE_SYNC != 0 {
+		rv.Durability = DURABILITY_SINGLE_SYNC
+	} else if options&OPEN_DURABILITY_NONE != 0 {
+		rv.Durability = DURABILITY_NONE
+	}
+	if options&OPEN_LOCK_WAIT != 0 {
+		rv.Lock = LOCK_WAIT
+	} else if options&OPEN_LOCK_NONE != 0 {
+		rv.Lock = LOCK_NONE
+	}
+	if options&OPEN_JSON_DETECT != 0 {
+		rv.JSONMode = JSON_MODE_DETECT
+	} else if options&OPEN_JSON_VALIDATE != 0 {
+		rv.JSONMode = JSON_MODE_VALIDATE
+	}
+	return &rv, nil
+}
+
+// OpenWithOptions opens a couchstore file as described by options, a nil
+// options opens an existing file with the defaults.
+//
+// All Gouchstore files successfully opened should be closed with the Close() method.
+func OpenWithOptions(filename string, options *Options) (*Gouchstore, error) {
+	var opts Options
+	if options != nil {
+		opts = *options
+	}
+	err := opts.Validate()
+	if err != nil {
+		return nil, err
+	}
+	if opts.Ops == nil {
+		opts.Ops = NewBaseGouchOps()
+	}
+	if opts.Durability == DURABILITY_DEFAULT {
+		opts.Durability = DURABILITY_FULL
+	}
+	if opts.Codec == nil {
+		opts.Codec = opsCodec{ops: opts.Ops}
+	}
+	if opts.CompactionTreeWriter == nil {
+		opts.CompactionTreeWriter = opts.Ops.CompactionTreeWriter
+	}
+
+	openFlags := os.O_RDWR
+	if opts.ReadOnly {
+		openFlags = os.O_RDONLY
+	}
+	if opts.Create {
+		openFlags |= os.O_CREATE
+	}
+
+	rv := Gouchstore{
+		filename:   filename,
+		options:    opts,
+		ops:        opts.Ops,
+		codec:      opts.Codec,
+		logger:     opts.Logger,
+		durability: opts.Durability,
+		jsonMode:   opts.JSONMode,
+		readOnly:   opts.ReadOnly,
+		expiry:     opts.Expiry,
+
+		contentHash: opts.ContentHash,
+	}
+	if opts.NodeCacheSize > 0 {
+		rv.nodeCache = newNodeCache(opts.NodeCacheSize)
+	}
+
+	file, err := rv.ops.OpenFile(filename, openFlags, 0666)
+	if err != nil {
+		return nil, err
+	}
+	rv.file = file
+
+	rv.unlock, err = lockFile(file, !opts.ReadOnly, opts.Lock, opts.LockTimeout)
+	if err != nil {
+		rv.ops.Close(rv.file)
+		return nil, err
+	}
+
+	err = rv.load()
+	if err != nil {
+		rv.ops.Close(rv.file)
+		if rv.unlock != nil {
+			rv.unlock()
+		}
+		return nil, err
+	}
+
+	return &rv, nil
+}
+
+func (g *Gouchstore) logf(format string, v ...interface{}) {
+	if g.logger != nil {
+		g.logger.Printf(format, v...)
+	}
+}
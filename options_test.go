@@ -0,0 +1,182 @@
+//  Copyright (c) 2014 Marty Schoch
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package gouchstore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+// xorCodec is not compression, but it makes sure the codec is used for
+// everything which is read and written.
+type xorCodec struct {
+	encoded int
+}
+
+func (c *xorCodec) Encode(dst, src []byte) []byte {
+	c.encoded++
+	rv := make([]byte, len(src))
+	for i := range src {
+		rv[i] = src[i] ^ 0x5a
+	}
+	return rv
+}
+
+func (c *xorCodec) Decode(dst, src []byte) ([]byte, error) {
+	rv := make([]byte, len(src))
+	for i := range src {
+		rv[i] = src[i] ^ 0x5a
+	}
+	return rv, nil
+}
+
+func TestOptionsValidate(t *testing.T) {
+	tests := []struct {
+		options Options
+		valid   bool
+	}{
+		{Options{}, true},
+		{Options{Create: true, Durability: DURABILITY_NONE, JSONMode: JSON_MODE_VALIDATE, NodeCacheSize: 10, ChunkThreshold: 100}, true},
+		{Options{Create: true, ReadOnly: true}, false},
+		{Options{Durability: DURABILITY_NONE + 1}, false},
+		{Options{JSONMode: JSON_MODE_VALIDATE + 1}, false},
+		{Options{NodeCacheSize: -1}, false},
+		{Options{ChunkThreshold: -1}, false},
+	}
+	for i, test := range tests {
+		err := test.options.Validate()
+		if test.valid && err != nil {
+			t.Errorf("%d: expected valid, got %v", i, err)
+		} else if !test.valid && err != ErrInvalidArguments {
+			t.Errorf("%d: expected invalid arguments, got %v", i, err)
+		}
+	}
+
+	_, err := OpenWithOptions("test.couch", &Options{Create: true, ReadOnly: true})
+	if err != ErrInvalidArguments {
+		t.Errorf("expected invalid arguments, got %v", err)
+	}
+}
+
+func TestOpenWithOptionsDefaults(t *testing.T) {
+	db, err := OpenWithOptions(testFileName, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if db.durability != DURABILITY_FULL {
+		t.Errorf("expected full durability, got %v", db.durability)
+	}
+	if db.thresholds != uniformThresholds(gs_DB_CHUNK_THRESHOLD) {
+		t.Errorf("expected default chunk thresholds, got %v", db.thresholds)
+	}
+	doc, err := db.DocumentById("lion_brewery_ceylon_ltd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.Body) == 0 {
+		t.Errorf("expected a document body")
+	}
+}
+
+func TestOpenWithOptions(t *testing.T) {
+	defer os.Remove("test.couch")
+	defer os.Remove("test-compacted.couch")
+
+	codec := &xorCodec{}
+	var logged bytes.Buffer
+	options := &Options{
+		Create:               true,
+		Durability:           DURABILITY_NONE,
+		NodeCacheSize:        16,
+		ChunkThreshold:       128,
+		Codec:                codec,
+		CompactionTreeWriter: InMemoryTreeWriterFunc,
+		Logger:               log.New(&logged, "", 0),
+	}
+	db, err := OpenWithOptions("test.couch", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs := make([]*Document, 100)
+	docInfos := make([]*DocumentInfo, 100)
+	for i := range docs {
+		id := fmt.Sprintf("doc-%03d", i)
+		docs[i] = &Document{ID: id, Body: []byte(strings.Repeat(id, 10))}
+		docInfos[i] = NewDocumentInfo(id)
+		docInfos[i].Rev = 1
+	}
+	err = db.SaveDocuments(docs, docInfos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if codec.encoded == 0 {
+		t.Errorf("expected the codec to be used")
+	}
+
+	// a small threshold makes for a deeper tree
+	depth := 0
+	err = db.WalkIdTree("", "", func(g *Gouchstore, d int, documentInfo *DocumentInfo, key []byte, subTreeSize uint64, reducedValue []byte, userContext interface{}) error {
+		if d > depth {
+			depth = d
+		}
+		return nil
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if depth < 2 {
+		t.Errorf("expected a tree deeper than 2 with a small chunk threshold, got %d", depth)
+	}
+	if db.nodeCache.len() == 0 || db.nodeCache.len() > 16 {
+		t.Errorf("expected between 1 and 16 cached nodes, got %d", db.nodeCache.len())
+	}
+
+	err = db.Compact("test-compacted.couch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if !strings.Contains(logged.String(), "compacted") {
+		t.Errorf("expected compaction to be logged, got %q", logged.String())
+	}
+
+	// the compacted file was written with the same codec
+	options.Create = false
+	for _, filename := range []string{"test.couch", "test-compacted.couch"} {
+		db, err = OpenWithOptions(filename, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		doc, err := db.DocumentById("doc-042")
+		if err != nil {
+			t.Fatalf("%s: %v", filename, err)
+		}
+		if string(doc.Body) != strings.Repeat("doc-042", 10) {
+			t.Errorf("%s: expected body %s, got %s", filename, strings.Repeat("doc-042", 10), doc.Body)
+		}
+		db.Close()
+	}
+
+	// but cannot be read without it, the recorded thresholds are read on open
+	_, err = Open("test-compacted.couch", 0)
+	if !errors.Is(err, ErrChunkBadCompression) {
+		t.Errorf("expected bad compression without the codec, got %v", err)
+	}
+}
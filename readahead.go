@@ -0,0 +1,264 @@
+//  Copyright (c) 2014 Marty Schoch
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package gouchstore
+
+import (
+	"io"
+)
+
+const gs_READAHEAD_WINDOW = 256
+const gs_READAHEAD_READ_SIZE = 256 * 1024
+
+// Bodies of a window at most gs_READAHEAD_MAX_GAP bytes apart are read
+// together.  It is kept small, as the window often holds bodies from all
+// over the file.
+const gs_READAHEAD_MAX_GAP = gs_BLOCK_SIZE
+
+// ReadaheadOptions bounds how far a readahead walk gets ahead of its
+// callback.
+type ReadaheadOptions struct {
+	// Window is the number of documents whose bodies are fetched together,
+	// 256 if zero.  Up to two windows are held ahead of the callback.
+	Window int
+	// ReadSize is the size of each read from the file, 256KB if zero.
+	// Nodes are read through a buffer of this size, and the bodies of a
+	// window are read in file order, nearby ones with a single read of up
+	// to this size.
+	ReadSize int64
+}
+
+// DocumentCallback is invoked by the readahead walks with the info of each
+// document and its body, doc is nil for deleted documents and those without
+// a body.
+type DocumentCallback func(gouchstore *Gouchstore, documentInfo *DocumentInfo, doc *Document, userContext interface{}) error
+
+// AllDocumentsReadahead is like AllDocuments, but also passes each
+// document's body to cb.  The tree is walked in a background goroutine,
+// which reads nodes in large sequential reads, and the bodies of each
+// options.Window documents sorted by position, so bodies laid out in another
+// order than the IDs are not read more than once.  The database must not be
+// written to until it returns.
+func (g *Gouchstore) AllDocumentsReadahead(startId, endId string, options *ReadaheadOptions, cb DocumentCallback, userContext interface{}) error {
+	err := g.checkOpen()
+	if err != nil {
+		return err
+	}
+	if g.header.byIdRoot == nil {
+		return nil
+	}
+	keys := [][]byte{[]byte(startId)}
+	if endId != "" {
+		keys = append(keys, []byte(endId))
+	}
+	return g.walkReadahead(gouchstoreIdComparator, gs_INDEX_TYPE_BY_ID, keys, g.header.byIdRoot.pointer, options, cb, userContext)
+}
+
+// ChangesSinceReadahead is like ChangesSince, but also passes each
+// document's body to cb, read ahead as by AllDocumentsReadahead.  Bodies
+// are mostly written in sequence order, so this reads the file almost
+// sequentially.
+func (g *Gouchstore) ChangesSinceReadahead(since uint64, till uint64, options *ReadaheadOptions, cb DocumentCallback, userContext interface{}) error {
+	err := g.checkOpen()
+	if err != nil {
+		return err
+	}
+	if g.header.bySeqRoot == nil {
+		return nil
+	}
+	keys := [][]byte{encode_raw48(since)}
+	if till != 0 {
+		keys = append(keys, encode_raw48(till))
+	}
+	return g.walkReadahead(gouchstoreSeqComparator, gs_INDEX_TYPE_BY_SEQ, keys, g.header.bySeqRoot.pointer, options, cb, userContext)
+}
+
+type readaheadItem struct {
+	docInfo *DocumentInfo
+	doc     *Document
+}
+
+func (g *Gouchstore) walkReadahead(compare btreeKeyComparator, indexType int, keys [][]byte, rootPointer uint64, options *ReadaheadOptions, cb DocumentCallback, userContext interface{}) error {
+	if options == nil {
+		options = &ReadaheadOptions{}
+	}
+	if options.Window < 0 || options.ReadSize < 0 {
+		return ErrInvalidArguments
+	}
+	window := options.Window
+	if window == 0 {
+		window = gs_READAHEAD_WINDOW
+	}
+	readSize := options.ReadSize
+	if readSize == 0 {
+		readSize = gs_READAHEAD_READ_SIZE
+	}
+	nodes := &readaheadReader{g: g, readSize: readSize, end: g.pos}
+
+	batches := make(chan []readaheadItem)
+	done := make(chan struct{})
+	var walkErr error
+	go func() {
+		defer close(batches)
+		var batch []*DocumentInfo
+		send := func() error {
+			items, err := g.readaheadBodies(batch, readSize)
+			batch = nil
+			if err != nil {
+				return err
+			}
+			select {
+			case batches <- items:
+				return nil
+			case <-done:
+				return errStopScan
+			}
+		}
+		lc := lookupContext{
+			gouchstore: g,
+			documentInfoCallback: func(g *Gouchstore, docInfo *DocumentInfo, userContext interface{}) error {
+				batch = append(batch, docInfo)
+				if len(batch) == window {
+					return send()
+				}
+				return nil
+			},
+			indexType: indexType,
+		}
+		lr := lookupRequest{
+			compare:         compare,
+			keys:            keys,
+			fetchCallback:   lookupCallback,
+			fold:            true,
+			callbackContext: &lc,
+			readNode:        nodes.nodeAt,
+		}
+		walkErr = g.btreeLookup(&lr, rootPointer)
+		if walkErr == nil && len(batch) > 0 {
+			walkErr = send()
+		}
+	}()
+
+	for items := range batches {
+		for _, item := range items {
+			err := cb(g, item.docInfo, item.doc, userContext)
+			if err != nil {
+				close(done)
+				for range batches {
+				}
+				return err
+			}
+		}
+	}
+	return walkErr
+}
+
+// readaheadBodies fetches the bodies of a window of documents.
+func (g *Gouchstore) readaheadBodies(docInfos []*DocumentInfo, readSize int64) ([]readaheadItem, error) {
+	rv := make([]readaheadItem, len(docInfos))
+	var live []*DocumentInfo
+	var liveItems []int
+	for i, docInfo := range docInfos {
+		rv[i].docInfo = docInfo
+		if !docInfo.Deleted && docInfo.bodyPosition != 0 {
+			live = append(live, docInfo)
+			liveItems = append(liveItems, i)
+		}
+	}
+	chunks := make([][]byte, len(live))
+	err := g.readChunks(live, chunks, gs_READAHEAD_MAX_GAP, readSize)
+	if err != nil {
+		return nil, err
+	}
+	err = g.decodeChunks(live, chunks, 0)
+	if err != nil {
+		return nil, err
+	}
+	for j, i := range liveItems {
+		rv[i].doc = &Document{ID: live[j].ID, Body: chunks[j]}
+	}
+	return rv, nil
+}
+
+// readaheadReader reads chunks through a buffer, refilled with the bytes
+// following a chunk which is not in it.  While the chunks are read in file
+// order the refills double in size up to readSize, otherwise chunks are read
+// by themselves.
+type readaheadReader struct {
+	g        *Gouchstore
+	readSize int64
+	end      int64 // the file size when the walk began
+	next     int64 // where the last read ended
+	size     int64 // the size of the next refill, 0 to read chunks alone
+	blocks   blockBuffer
+}
+
+func (r *readaheadReader) chunkAt(pos int64) ([]byte, error) {
+	data, ok, err := bufferedChunkAt(&r.blocks, pos, r.end)
+	if err != nil || ok {
+		return data, err
+	}
+	if pos < r.next || pos-r.next > gs_MULTIGET_MAX_GAP {
+		r.size = 0
+	} else if r.size < r.readSize {
+		r.size = 2*r.size + gs_MULTIGET_MAX_GAP
+		if r.size > r.readSize {
+			r.size = r.readSize
+		}
+	}
+	if r.size == 0 {
+		data, err = r.g.readChunkAt(pos, false)
+		if err == nil {
+			r.next = pos + chunkDiskSize(pos, int64(len(data)))
+		}
+		return data, err
+	}
+	size := r.size
+	if pos+size > r.end {
+		size = r.end - pos
+	}
+	if size > 0 {
+		// chunks are copied out of the buffer, so it can be reused
+		buf := r.blocks.buf[:cap(r.blocks.buf)]
+		if int64(len(buf)) < size {
+			buf = make([]byte, size)
+		}
+		n, err := r.g.ops.ReadAt(r.g.file, buf[:size], pos)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		r.blocks = blockBuffer{buf: buf[:n], pos: pos}
+		r.next = pos + int64(n)
+		data, ok, err = bufferedChunkAt(&r.blocks, pos, r.end)
+		if err != nil || ok {
+			return data, err
+		}
+	}
+	// larger than the buffer
+	return r.g.readChunkAt(pos, false)
+}
+
+// nodeAt is like readNodeAt, without the node cache.
+func (r *readaheadReader) nodeAt(pos int64) ([]byte, error) {
+	chunk, err := r.chunkAt(pos)
+	if cerr, ok := err.(*CorruptError); ok {
+		cerr.ChunkType = CHUNK_TYPE_NODE
+	}
+	if err != nil {
+		return nil, err
+	}
+	nodeData, err := r.g.codec.Decode(nil, chunk)
+	if err != nil {
+		return nil, corruptAt(pos, CHUNK_TYPE_NODE, ErrChunkBadCompression)
+	}
+	if len(nodeData) < 1 {
+		return nil, corruptAt(pos, CHUNK_TYPE_NODE, ErrBadNodeType)
+	}
+	return nodeData, nil
+}
@@ -0,0 +1,350 @@
+//  Copyright (c) 2014 Marty Schoch
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package gouchstore
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"reflect"
+	"sync/atomic"
+	"testing"
+)
+
+// saveReadaheadDocs saves n documents, every third compressed, every tenth
+// deleted and every 100th large enough to cross several blocks.
+func saveReadaheadDocs(db *Gouchstore, n int) error {
+	for i := 0; i < n; i += 100 {
+		var docs []*Document
+		var docInfos []*DocumentInfo
+		for j := i; j < i+100 && j < n; j++ {
+			id := fmt.Sprintf("doc-%05d", j)
+			body := []byte(fmt.Sprintf(`{"i":%d,"padding":"%0100d"}`, j, j))
+			if j%100 == 0 {
+				body = bytes.Repeat([]byte(fmt.Sprintf("%05d", j)), 3000)
+			}
+			docInfo := &DocumentInfo{ID: id, Rev: 1}
+			if j%3 == 0 {
+				docInfo.ContentMeta = DOC_IS_COMPRESSED
+			}
+			doc := &Document{ID: id, Body: body}
+			if j%10 == 5 {
+				docInfo.Deleted = true
+				doc = nil
+			}
+			docs = append(docs, doc)
+			docInfos = append(docInfos, docInfo)
+		}
+		err := db.SaveDocuments(docs, docInfos)
+		if err != nil {
+			return err
+		}
+	}
+	return db.Commit()
+}
+
+// saveShuffledDocs saves n documents in a random ID order, so their bodies
+// are laid out in another order than their IDs.
+func saveShuffledDocs(db *Gouchstore, n int) error {
+	for _, i := range rand.New(rand.NewSource(1)).Perm(n) {
+		id := fmt.Sprintf("doc-%05d", i)
+		err := db.SaveDocument(&Document{ID: id, Body: []byte(fmt.Sprintf(`{"i":%d,"padding":"%0500d"}`, i, i))}, &DocumentInfo{ID: id, Rev: 1})
+		if err != nil {
+			return err
+		}
+	}
+	return db.Commit()
+}
+
+// allDocumentsWithBodies fetches each body after AllDocuments, one at a time.
+func allDocumentsWithBodies(db *Gouchstore, cb DocumentCallback) error {
+	return db.AllDocuments("", "", func(g *Gouchstore, docInfo *DocumentInfo, userContext interface{}) error {
+		var doc *Document
+		if !docInfo.Deleted {
+			var err error
+			doc, err = g.DocumentByDocumentInfo(docInfo)
+			if err != nil {
+				return err
+			}
+		}
+		return cb(g, docInfo, doc, userContext)
+	}, nil)
+}
+
+// changesWithBodies fetches each body after ChangesSince, one at a time.
+func changesWithBodies(db *Gouchstore, since, till uint64, cb DocumentCallback) error {
+	return db.ChangesSince(since, till, func(g *Gouchstore, docInfo *DocumentInfo, userContext interface{}) error {
+		var doc *Document
+		if !docInfo.Deleted {
+			var err error
+			doc, err = g.DocumentByDocumentInfo(docInfo)
+			if err != nil {
+				return err
+			}
+		}
+		return cb(g, docInfo, doc, userContext)
+	}, nil)
+}
+
+func TestReadahead(t *testing.T) {
+	defer os.Remove("test.couch")
+
+	ops := &readCountingGouchOps{BaseGouchOps: NewBaseGouchOps()}
+	db, err := OpenEx("test.couch", OPEN_CREATE, ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = saveReadaheadDocs(db, 3000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type result struct {
+		ID   string
+		Seq  uint64
+		Body []byte
+	}
+	collect := func(results *[]result) DocumentCallback {
+		return func(g *Gouchstore, docInfo *DocumentInfo, doc *Document, userContext interface{}) error {
+			r := result{ID: docInfo.ID, Seq: docInfo.Seq}
+			if doc != nil {
+				if doc.ID != docInfo.ID {
+					return fmt.Errorf("expected the body of %s, got %s", docInfo.ID, doc.ID)
+				}
+				r.Body = doc.Body
+			}
+			*results = append(*results, r)
+			return nil
+		}
+	}
+
+	var expected []result
+	atomic.StoreInt32(&ops.reads, 0)
+	err = changesWithBodies(db, 0, 0, collect(&expected))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lookupReads := atomic.LoadInt32(&ops.reads)
+	if len(expected) != 3000 {
+		t.Fatalf("expected 3000 changes, got %d", len(expected))
+	}
+
+	for i, options := range []*ReadaheadOptions{
+		nil,
+		{Window: 1},
+		{ReadSize: 4096},
+		{Window: 10000, ReadSize: 100},
+	} {
+		var actual []result
+		atomic.StoreInt32(&ops.reads, 0)
+		err = db.ChangesSinceReadahead(0, 0, options, collect(&actual), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("%d: expected the same changes and bodies as ChangesSince", i)
+		}
+		if options == nil {
+			if readaheadReads := atomic.LoadInt32(&ops.reads); readaheadReads*10 > lookupReads {
+				t.Errorf("expected far fewer reads, readahead read %d times, ChangesSince %d", readaheadReads, lookupReads)
+			}
+		}
+	}
+
+	// a range of changes
+	var actual []result
+	err = db.ChangesSinceReadahead(101, 200, nil, collect(&actual), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(actual, expected[100:200]) {
+		t.Errorf("expected changes 101 to 200, got %d", len(actual))
+	}
+
+	// by id, after updating some documents so the bodies are out of order
+	for i := 0; i < 3000; i += 7 {
+		id := fmt.Sprintf("doc-%05d", i)
+		err = db.SaveDocument(&Document{ID: id, Body: []byte(`{"updated":true}`)}, &DocumentInfo{ID: id, Rev: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = db.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	err = db.AllDocumentsReadahead("doc-01000", "doc-01999", nil, func(g *Gouchstore, docInfo *DocumentInfo, doc *Document, userContext interface{}) error {
+		expected, err := g.DocumentById(docInfo.ID)
+		if err == ErrNotFound {
+			if doc != nil {
+				return fmt.Errorf("expected no body for deleted %s", docInfo.ID)
+			}
+		} else if err != nil {
+			return err
+		} else if doc == nil || !bytes.Equal(doc.Body, expected.Body) {
+			return fmt.Errorf("expected the body of %s", docInfo.ID)
+		}
+		ids = append(ids, docInfo.ID)
+		return nil
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1000 || ids[0] != "doc-01000" || ids[999] != "doc-01999" {
+		t.Errorf("expected doc-01000 to doc-01999, got %d", len(ids))
+	}
+
+	// errors from the callback end the walk
+	stop := fmt.Errorf("stop")
+	count := 0
+	err = db.ChangesSinceReadahead(0, 0, &ReadaheadOptions{Window: 4}, func(g *Gouchstore, docInfo *DocumentInfo, doc *Document, userContext interface{}) error {
+		count++
+		if count == 5 {
+			return stop
+		}
+		return nil
+	}, nil)
+	if err != stop || count != 5 {
+		t.Errorf("expected the callback error after 5 documents, got %v after %d", err, count)
+	}
+
+	err = db.ChangesSinceReadahead(0, 0, &ReadaheadOptions{Window: -1}, func(g *Gouchstore, docInfo *DocumentInfo, doc *Document, userContext interface{}) error {
+		return nil
+	}, nil)
+	if err != ErrInvalidArguments {
+		t.Errorf("expected ErrInvalidArguments, got %v", err)
+	}
+}
+
+func TestReadaheadById(t *testing.T) {
+	defer os.Remove("test.couch")
+
+	ops := &readCountingGouchOps{BaseGouchOps: NewBaseGouchOps()}
+	db, err := OpenEx("test.couch", OPEN_CREATE, ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = saveShuffledDocs(db, 2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var expected []string
+	atomic.StoreInt64(&ops.bytesRead, 0)
+	err = allDocumentsWithBodies(db, func(g *Gouchstore, docInfo *DocumentInfo, doc *Document, userContext interface{}) error {
+		expected = append(expected, docInfo.ID+string(doc.Body))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lookupBytes := atomic.LoadInt64(&ops.bytesRead)
+
+	var actual []string
+	atomic.StoreInt64(&ops.bytesRead, 0)
+	err = db.AllDocumentsReadahead("", "", nil, func(g *Gouchstore, docInfo *DocumentInfo, doc *Document, userContext interface{}) error {
+		actual = append(actual, docInfo.ID+string(doc.Body))
+		return nil
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected the same documents and bodies as AllDocuments")
+	}
+	// bodies out of ID order are not read over and over
+	if readaheadBytes := atomic.LoadInt64(&ops.bytesRead); readaheadBytes > 2*lookupBytes {
+		t.Errorf("expected readahead to read no more than twice as much, read %d bytes, AllDocuments %d", readaheadBytes, lookupBytes)
+	}
+}
+
+// BenchmarkReadahead compares reading every change and its body with
+// ChangesSinceReadahead against ChangesSince followed by
+// DocumentByDocumentInfo, and every document of a file written in random ID
+// order with AllDocumentsReadahead against AllDocuments.
+func BenchmarkReadahead(b *testing.B) {
+	defer os.Remove("bench.couch")
+	db, err := OpenWithOptions("bench.couch", &Options{Create: true, Durability: DURABILITY_NONE})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+	err = saveReadaheadDocs(db, 20000)
+	if err != nil {
+		b.Fatal(err)
+	}
+	info, err := db.DatabaseInfo()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	count := func(g *Gouchstore, docInfo *DocumentInfo, doc *Document, userContext interface{}) error {
+		return nil
+	}
+	b.Run("lookup", func(b *testing.B) {
+		b.SetBytes(int64(info.FileSize))
+		for i := 0; i < b.N; i++ {
+			err := changesWithBodies(db, 0, 0, count)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	for _, window := range []int{16, 256, 4096} {
+		b.Run(fmt.Sprintf("readahead-%d", window), func(b *testing.B) {
+			b.SetBytes(int64(info.FileSize))
+			for i := 0; i < b.N; i++ {
+				err := db.ChangesSinceReadahead(0, 0, &ReadaheadOptions{Window: window}, count, nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+
+	defer os.Remove("bench-shuffled.couch")
+	shuffled, err := OpenWithOptions("bench-shuffled.couch", &Options{Create: true, Durability: DURABILITY_NONE})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer shuffled.Close()
+	err = saveShuffledDocs(shuffled, 20000)
+	if err != nil {
+		b.Fatal(err)
+	}
+	info, err = shuffled.DatabaseInfo()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Run("by-id-lookup", func(b *testing.B) {
+		b.SetBytes(int64(info.FileSize))
+		for i := 0; i < b.N; i++ {
+			err := allDocumentsWithBodies(shuffled, count)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	for _, window := range []int{16, 256, 4096} {
+		b.Run(fmt.Sprintf("by-id-readahead-%d", window), func(b *testing.B) {
+			b.SetBytes(int64(info.FileSize))
+			for i := 0; i < b.N; i++ {
+				err := shuffled.AllDocumentsReadahead("", "", &ReadaheadOptions{Window: window}, count, nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -11,42 +11,92 @@ package gouchstore
 
 import (
 	"bytes"
+	"encoding/binary"
+	"hash/fnv"
 )
 
+const gs_BY_ID_REDUCE_SIZE = 16
+const gs_BY_ID_HASH_SIZE = 16
+const gs_BY_SEQ_REDUCE_SIZE = 5
+
 type reduceFunc func(leaflist *nodeList, count int, context interface{}) ([]byte, error)
 
 func byIdReduce(leaflist *nodeList, count int, context interface{}) ([]byte, error) {
+	return reduceByIdLeaves(leaflist, count, false)
+}
+
+func byIdReReduce(leaflist *nodeList, count int, context interface{}) ([]byte, error) {
+	return reReduceByIdPointers(leaflist, count, false)
+}
+
+// byIdHashReduce is byIdReduce followed by the content hash of the documents.
+func byIdHashReduce(leaflist *nodeList, count int, context interface{}) ([]byte, error) {
+	return reduceByIdLeaves(leaflist, count, true)
+}
+
+// byIdHashReReduce is byIdReReduce followed by the content hash of the
+// subtrees, which is left out if any of them does not have one.
+func byIdHashReReduce(leaflist *nodeList, count int, context interface{}) ([]byte, error) {
+	return reReduceByIdPointers(leaflist, count, true)
+}
+
+func reduceByIdLeaves(leaflist *nodeList, count int, withHash bool) ([]byte, error) {
 	var notDeleted, deleted, size uint64
+	var hash []byte
+	if withHash {
+		hash = make([]byte, gs_BY_ID_HASH_SIZE)
+	}
 	i := leaflist
 	for i != nil && count > 0 {
 		docinfo := DocumentInfo{}
-		decodeByIdValue(&docinfo, i.data)
+		err := decodeByIdValue(&docinfo, i.data)
+		if err != nil {
+			return nil, err
+		}
 		if docinfo.Deleted {
 			deleted++
 		} else {
 			notDeleted++
 		}
 		size += docinfo.Size
+		if withHash {
+			xorHash(hash, documentContentHash(i.key, &docinfo))
+		}
 		i = i.next
 		count--
 	}
-	return encodeByIdReduce(notDeleted, deleted, size), nil
+	return append(encodeByIdReduce(notDeleted, deleted, size), hash...), nil
 }
 
-func byIdReReduce(leaflist *nodeList, count int, context interface{}) ([]byte, error) {
+func reReduceByIdPointers(leaflist *nodeList, count int, withHash bool) ([]byte, error) {
 	var notDeleted, deleted, size uint64
+	var hash []byte
+	if withHash {
+		hash = make([]byte, gs_BY_ID_HASH_SIZE)
+	}
 	i := leaflist
 	for i != nil && count > 0 {
 		if i.pointer != nil {
+			if len(i.pointer.reducedValue) < gs_BY_ID_REDUCE_SIZE {
+				return nil, ErrShortData
+			}
 			nd, d, s := decodeByIdReduce(i.pointer.reducedValue)
 			notDeleted += nd
 			deleted += d
 			size += s
+			if hash != nil {
+				subtreeHash := decodeByIdReduceHash(i.pointer.reducedValue)
+				if subtreeHash == nil {
+					hash = nil
+				} else {
+					xorHash(hash, subtreeHash)
+				}
+			}
 		}
 		i = i.next
 		count--
 	}
-	return encodeByIdReduce(notDeleted, deleted, size), nil
+	return append(encodeByIdReduce(notDeleted, deleted, size), hash...), nil
 }
 
 func encodeByIdReduce(notDeleted, deleted, size uint64) []byte {
@@ -64,6 +114,51 @@ func decodeByIdReduce(buf []byte) (uint64, uint64, uint64) {
 	return notDeleted, deleted, size
 }
 
+// decodeByIdReduceHash returns the content hash of a by-id reduce, or nil
+// if it does not have one.
+func decodeByIdReduceHash(buf []byte) []byte {
+	if len(buf) < gs_BY_ID_REDUCE_SIZE+gs_BY_ID_HASH_SIZE {
+		return nil
+	}
+	return buf[gs_BY_ID_REDUCE_SIZE : gs_BY_ID_REDUCE_SIZE+gs_BY_ID_HASH_SIZE]
+}
+
+// documentContentHash hashes what identifies a version of a document, but
+// not where it is stored, so the same document hashes the same in any file.
+// The body is not in the leaf, and Size and ContentMeta depend on how the
+// body was compressed, so they are left out.
+func documentContentHash(id []byte, docinfo *DocumentInfo) []byte {
+	var buf [9]byte
+	h := fnv.New128a()
+	binary.BigEndian.PutUint16(buf[0:2], uint16(len(id)))
+	h.Write(buf[0:2])
+	h.Write(id)
+	binary.BigEndian.PutUint64(buf[0:8], docinfo.Rev)
+	buf[8] = 0
+	if docinfo.Deleted {
+		buf[8] = 1
+	}
+	h.Write(buf[0:9])
+	h.Write(docinfo.RevMeta)
+	return h.Sum(nil)
+}
+
+// xorHash combines the hashes of disjoint sets of documents, the result
+// does not depend on how they are grouped into nodes.
+func xorHash(dst, src []byte) {
+	for i := range dst {
+		dst[i] ^= src[i]
+	}
+}
+
+// byIdReducers returns the reduce functions for the by-id index of g.
+func (g *Gouchstore) byIdReducers() (reduceFunc, reduceFunc) {
+	if g.contentHash {
+		return byIdHashReduce, byIdHashReReduce
+	}
+	return byIdReduce, byIdReReduce
+}
+
 func bySeqReduce(leaflist *nodeList, count int, context interface{}) ([]byte, error) {
 	return encode_raw40(uint64(count)), nil
 }
@@ -73,7 +168,10 @@ func bySeqReReduce(leaflist *nodeList, count int, context interface{}) ([]byte,
 	i := leaflist
 	for i != nil && count > 0 {
 		if i.pointer != nil {
-			t := decode_raw40(i.pointer.reducedValue)
+			if len(i.pointer.reducedValue) < gs_BY_SEQ_REDUCE_SIZE {
+				return nil, ErrShortData
+			}
+			t := decode_raw40(i.pointer.reducedValue[0:gs_BY_SEQ_REDUCE_SIZE])
 			total += t
 		}
 		i = i.next
@@ -0,0 +1,122 @@
+//  Copyright (c) 2014 Marty Schoch
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package gouchstore
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// Couchbase lays out the RevMeta as 8 bytes CAS, 4 bytes expiry and
+// 4 bytes flags, all big-endian.  Newer versions append a flex meta code
+// and a datatype byte.
+const gs_REV_META_SIZE = 16
+const gs_REV_META_EXTENDED_SIZE = 18
+
+// CouchbaseRevMeta is a typed view of the RevMeta written by Couchbase.
+type CouchbaseRevMeta struct {
+	CAS          uint64 `json:"cas"`
+	Expiry       uint32 `json:"expiry"`
+	Flags        uint32 `json:"flags"`
+	FlexMetaCode uint8  `json:"flexMetaCode,omitempty"`
+	Datatype     uint8  `json:"datatype,omitempty"`
+	// Extended is true when the RevMeta has the flex meta code and datatype
+	// fields, they are also encoded whenever either is non-zero.
+	Extended bool `json:"-"`
+}
+
+// DecodeCouchbaseRevMeta decodes RevMeta bytes in the Couchbase layout.
+func DecodeCouchbaseRevMeta(revMeta []byte) (*CouchbaseRevMeta, error) {
+	if len(revMeta) != gs_REV_META_SIZE && len(revMeta) != gs_REV_META_EXTENDED_SIZE {
+		return nil, ErrInvalidRevMeta
+	}
+	rv := CouchbaseRevMeta{
+		CAS:    decode_raw64(revMeta[0:8]),
+		Expiry: decode_raw32(revMeta[8:12]),
+		Flags:  decode_raw32(revMeta[12:16]),
+	}
+	if len(revMeta) == gs_REV_META_EXTENDED_SIZE {
+		rv.Extended = true
+		rv.FlexMetaCode = decode_raw08(revMeta[16:17])
+		rv.Datatype = decode_raw08(revMeta[17:18])
+	}
+	return &rv, nil
+}
+
+// Encode returns the RevMeta bytes in the Couchbase layout.
+func (m *CouchbaseRevMeta) Encode() []byte {
+	buf := new(bytes.Buffer)
+	buf.Write(encode_raw64(m.CAS))
+	buf.Write(encode_raw32(m.Expiry))
+	buf.Write(encode_raw32(m.Flags))
+	if m.Extended || m.FlexMetaCode != 0 || m.Datatype != 0 {
+		buf.Write(encode_raw08(m.FlexMetaCode))
+		buf.Write(encode_raw08(m.Datatype))
+	}
+	return buf.Bytes()
+}
+
+// CouchbaseRevMeta decodes the RevMeta of this document in the Couchbase layout.
+func (di *DocumentInfo) CouchbaseRevMeta() (*CouchbaseRevMeta, error) {
+	return DecodeCouchbaseRevMeta(di.RevMeta)
+}
+
+// MarshalJSON encodes the fields of the DocumentInfo, adding the datatype
+// name and the decoded Couchbase RevMeta, when there is one.
+func (di *DocumentInfo) MarshalJSON() ([]byte, error) {
+	// fields has no methods, so it is encoded as a plain struct
+	type fields DocumentInfo
+	rv := struct {
+		fields
+		Datatype         string            `json:"datatype"`
+		CouchbaseRevMeta *CouchbaseRevMeta `json:"couchbaseRevMeta,omitempty"`
+	}{
+		fields:   fields(*di),
+		Datatype: DatatypeString(di.Datatype()),
+	}
+	revMeta, err := di.CouchbaseRevMeta()
+	if err == nil {
+		rv.CouchbaseRevMeta = revMeta
+	}
+	return json.Marshal(rv)
+}
+
+// SetCouchbaseRevMeta replaces the RevMeta of this document.
+func (di *DocumentInfo) SetCouchbaseRevMeta(m *CouchbaseRevMeta) {
+	di.RevMeta = m.Encode()
+}
+
+// Expiry returns the expiry time (seconds since the Unix epoch) stored in
+// the Couchbase RevMeta, or 0 if the document does not expire.
+func (di *DocumentInfo) Expiry() uint32 {
+	m, err := di.CouchbaseRevMeta()
+	if err != nil {
+		return 0
+	}
+	return m.Expiry
+}
+
+// SetExpiry stores the expiry time (seconds since the Unix epoch) in the
+// Couchbase RevMeta, starting one if the RevMeta is empty.  An expiry of 0
+// means the document does not expire.  It returns ErrInvalidRevMeta,
+// leaving the RevMeta alone, if it is in any other layout.
+func (di *DocumentInfo) SetExpiry(expiry uint32) error {
+	m := &CouchbaseRevMeta{}
+	if len(di.RevMeta) > 0 {
+		var err error
+		m, err = di.CouchbaseRevMeta()
+		if err != nil {
+			return err
+		}
+	}
+	m.Expiry = expiry
+	di.SetCouchbaseRevMeta(m)
+	return nil
+}
@@ -0,0 +1,138 @@
+//  Copyright (c) 2014 Marty Schoch
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package gouchstore
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestCouchbaseRevMetaFromBeerSample(t *testing.T) {
+	db, err := Open(testFileName, OPEN_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	docInfo, err := db.DocumentInfoById("rogue_ales-hazelnut_brown_nectar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	revMeta, err := docInfo.CouchbaseRevMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedRevMeta := &CouchbaseRevMeta{
+		CAS: 0x40fb569a16e,
+	}
+	if !reflect.DeepEqual(revMeta, expectedRevMeta) {
+		t.Errorf("expected %#v, got %#v", expectedRevMeta, revMeta)
+	}
+	if !bytes.Equal(revMeta.Encode(), docInfo.RevMeta) {
+		t.Errorf("expected encoding to round trip, got % x", revMeta.Encode())
+	}
+}
+
+func TestDocumentInfoMarshalJSON(t *testing.T) {
+	docInfo := &DocumentInfo{ID: "doc", Seq: 2, Rev: 3, ContentMeta: DOC_IS_JSON, Size: 4}
+	docInfo.SetCouchbaseRevMeta(&CouchbaseRevMeta{CAS: 5, Expiry: 6})
+	encoded, err := json.Marshal(docInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"id":"doc","seq":2,"rev":3,"revMeta":"AAAAAAAAAAUAAAAGAAAAAA==","contentMeta":0,` +
+		`"deleted":false,"size":4,"datatype":"json","couchbaseRevMeta":{"cas":5,"expiry":6,"flags":0}}`
+	if string(encoded) != expected {
+		t.Errorf("expected %s, got %s", expected, encoded)
+	}
+
+	// RevMeta in another layout is left out
+	docInfo.RevMeta = []byte{1}
+	encoded, err = json.Marshal(docInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(encoded, []byte("couchbaseRevMeta")) {
+		t.Errorf("expected no Couchbase RevMeta, got %s", encoded)
+	}
+}
+
+func TestCouchbaseRevMetaRoundTrip(t *testing.T) {
+	tests := []*CouchbaseRevMeta{
+		{CAS: 1, Expiry: 2, Flags: 3},
+		{CAS: 0xffffffffffffffff, Expiry: 0xffffffff, Flags: 0xdeadbeef, FlexMetaCode: 1, Datatype: 1, Extended: true},
+		{CAS: 4, Datatype: 1, Extended: true},
+		{CAS: 5, Extended: true},
+	}
+	for _, test := range tests {
+		encoded := test.Encode()
+		decoded, err := DecodeCouchbaseRevMeta(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(decoded, test) {
+			t.Errorf("expected %#v, got %#v", test, decoded)
+		}
+	}
+
+	for _, size := range []int{0, 8, 17, 32} {
+		_, err := DecodeCouchbaseRevMeta(make([]byte, size))
+		if err != ErrInvalidRevMeta {
+			t.Errorf("expected invalid rev meta for size %d, got %v", size, err)
+		}
+	}
+}
+
+func TestSetExpiryKeepsOtherFields(t *testing.T) {
+	docInfo := &DocumentInfo{}
+	docInfo.SetCouchbaseRevMeta(&CouchbaseRevMeta{CAS: 7, Flags: 9, FlexMetaCode: 1, Datatype: 1})
+	err := docInfo.SetExpiry(42)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	revMeta, err := docInfo.CouchbaseRevMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedRevMeta := &CouchbaseRevMeta{CAS: 7, Expiry: 42, Flags: 9, FlexMetaCode: 1, Datatype: 1, Extended: true}
+	if !reflect.DeepEqual(revMeta, expectedRevMeta) {
+		t.Errorf("expected %#v, got %#v", expectedRevMeta, revMeta)
+	}
+	if docInfo.Expiry() != 42 {
+		t.Errorf("expected expiry 42, got %d", docInfo.Expiry())
+	}
+}
+
+func TestSetExpiryOtherLayout(t *testing.T) {
+	revMeta := []byte{1, 2, 3}
+	docInfo := &DocumentInfo{RevMeta: revMeta}
+	err := docInfo.SetExpiry(42)
+	if err != ErrInvalidRevMeta {
+		t.Errorf("expected ErrInvalidRevMeta, got %v", err)
+	}
+	if !bytes.Equal(docInfo.RevMeta, revMeta) {
+		t.Errorf("expected the RevMeta to be left alone, got % x", docInfo.RevMeta)
+	}
+
+	// an 18 byte RevMeta keeps its size even with a zero flex meta code
+	extended := make([]byte, gs_REV_META_EXTENDED_SIZE)
+	extended[17] = 1
+	docInfo = &DocumentInfo{RevMeta: extended}
+	err = docInfo.SetExpiry(42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docInfo.RevMeta) != gs_REV_META_EXTENDED_SIZE || docInfo.RevMeta[17] != 1 {
+		t.Errorf("expected the datatype to be kept, got % x", docInfo.RevMeta)
+	}
+}
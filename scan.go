@@ -0,0 +1,317 @@
+//  Copyright (c) 2014 Marty Schoch
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package gouchstore
+
+import (
+	"bytes"
+	"errors"
+	"path"
+	"strings"
+)
+
+// errStopScan ends a walk early, it is not returned to the caller.
+var errStopScan = errors.New("stop scan")
+
+// DeletedFilter chooses between live and deleted documents.
+type DeletedFilter int
+
+const (
+	// DELETED_INCLUDE visits both live and deleted documents.
+	DELETED_INCLUDE DeletedFilter = iota
+	// DELETED_EXCLUDE visits only live documents.
+	DELETED_EXCLUDE
+	// DELETED_ONLY visits only deleted documents.
+	DELETED_ONLY
+)
+
+// ScanOptions chooses the documents a scan visits, the zero value visits all
+// of them.  Documents are filtered as the tree is walked, the callback is
+// only invoked for those which pass every filter.
+type ScanOptions struct {
+	// Prefix limits the scan to IDs starting with it.
+	Prefix string
+	// Match limits the scan to IDs matching the pattern, as in path.Match.
+	Match string
+	// Deleted chooses between live and deleted documents.
+	Deleted DeletedFilter
+	// MinSeq and MaxSeq limit the scan to documents last changed in the
+	// range, inclusive, zero means no limit.
+	MinSeq uint64
+	MaxSeq uint64
+	// ContentMetaMask limits the scan to documents with the bits of
+	// ContentMeta it selects.
+	ContentMetaMask uint8
+	ContentMeta     uint8
+	// Filter, if not nil, is applied last, the scan skips documents for
+	// which it returns false.
+	Filter func(documentInfo *DocumentInfo) bool
+}
+
+func (o *ScanOptions) validate() error {
+	if o.Deleted < DELETED_INCLUDE || o.Deleted > DELETED_ONLY {
+		return ErrInvalidArguments
+	}
+	if o.MaxSeq != 0 && o.MinSeq > o.MaxSeq {
+		return ErrInvalidArguments
+	}
+	if o.Match != "" {
+		_, err := path.Match(o.Match, "")
+		if err != nil {
+			return ErrInvalidArguments
+		}
+	}
+	return nil
+}
+
+// acceptsDeleted applies the Deleted filter.
+func (o *ScanOptions) acceptsDeleted(deleted bool) bool {
+	switch o.Deleted {
+	case DELETED_EXCLUDE:
+		return !deleted
+	case DELETED_ONLY:
+		return deleted
+	}
+	return true
+}
+
+// acceptsSeq applies the MinSeq and MaxSeq filters.
+func (o *ScanOptions) acceptsSeq(seq uint64) bool {
+	return seq >= o.MinSeq && (o.MaxSeq == 0 || seq <= o.MaxSeq)
+}
+
+// acceptsContentMeta applies the ContentMeta filter.
+func (o *ScanOptions) acceptsContentMeta(contentMeta uint8) bool {
+	return contentMeta&o.ContentMetaMask == o.ContentMeta&o.ContentMetaMask
+}
+
+// acceptsId applies the Prefix and Match filters.
+func (o *ScanOptions) acceptsId(id string) bool {
+	if !strings.HasPrefix(id, o.Prefix) {
+		return false
+	}
+	if o.Match != "" {
+		matched, _ := path.Match(o.Match, id)
+		return matched
+	}
+	return true
+}
+
+// accepts applies every filter to a decoded document info.
+func (o *ScanOptions) accepts(docInfo *DocumentInfo) bool {
+	return o.acceptsDeleted(docInfo.Deleted) && o.acceptsSeq(docInfo.Seq) &&
+		o.acceptsContentMeta(docInfo.ContentMeta) && o.acceptsId(docInfo.ID) &&
+		(o.Filter == nil || o.Filter(docInfo))
+}
+
+// IdCallback is invoked by ScanKeys for each document ID, which is only
+// valid until it returns.
+type IdCallback func(gouchstore *Gouchstore, id []byte, userContext interface{}) error
+
+// Scan is like AllDocuments, but only visits the documents chosen by options,
+// which may be nil.
+func (g *Gouchstore) Scan(startId, endId string, options *ScanOptions, cb DocumentInfoCallback, userContext interface{}) error {
+	return g.scan(startId, endId, options, &scanContext{cb: cb, userContext: userContext})
+}
+
+// ScanPrefix invokes cb for each document whose ID starts with prefix, in ID
+// order.
+func (g *Gouchstore) ScanPrefix(prefix string, cb DocumentInfoCallback, userContext interface{}) error {
+	return g.Scan("", "", &ScanOptions{Prefix: prefix}, cb, userContext)
+}
+
+// ScanKeys is like Scan, but only passes the document IDs to cb, without
+// decoding the rest of the document info unless options has a Filter or the
+// expiry index is on.
+func (g *Gouchstore) ScanKeys(startId, endId string, options *ScanOptions, cb IdCallback, userContext interface{}) error {
+	return g.scan(startId, endId, options, &scanContext{idCb: cb, userContext: userContext})
+}
+
+type scanContext struct {
+	g           *Gouchstore
+	now         uint32 // documents which expired by now are hidden, if the expiry index is on
+	options     *ScanOptions
+	prefix      []byte
+	cb          DocumentInfoCallback
+	idCb        IdCallback
+	userContext interface{}
+}
+
+func (g *Gouchstore) scan(startId, endId string, options *ScanOptions, sc *scanContext) error {
+	err := g.checkOpen()
+	if err != nil {
+		return err
+	}
+	if options == nil {
+		options = &ScanOptions{}
+	}
+	err = options.validate()
+	if err != nil {
+		return err
+	}
+	if g.header.byIdRoot == nil {
+		return nil
+	}
+	sc.g = g
+	if g.expiry {
+		sc.now = expiryNow()
+	}
+	sc.options = options
+	sc.prefix = []byte(options.Prefix)
+
+	if options.Prefix > startId {
+		startId = options.Prefix
+	}
+	keys := [][]byte{[]byte(startId)}
+	if endId != "" {
+		if endId < startId {
+			return nil
+		}
+		keys = append(keys, []byte(endId))
+	}
+	lr := lookupRequest{
+		compare:         gouchstoreIdComparator,
+		keys:            keys,
+		fetchCallback:   scanFetchCallback,
+		fold:            true,
+		callbackContext: sc,
+	}
+	err = g.btreeLookup(&lr, g.header.byIdRoot.pointer)
+	if err == errStopScan {
+		return nil
+	}
+	return err
+}
+
+func scanFetchCallback(req *lookupRequest, key []byte, value []byte) error {
+	if value == nil {
+		return nil
+	}
+	sc := req.callbackContext.(*scanContext)
+	// the keys start at the prefix, so the first without it is past the end
+	if !bytes.HasPrefix(key, sc.prefix) {
+		return errStopScan
+	}
+	accepted, err := sc.accept(key, value)
+	if err != nil || !accepted {
+		return err
+	}
+	if sc.idCb != nil && sc.options.Filter == nil && !sc.g.expiry {
+		return sc.idCb(sc.g, key, sc.userContext)
+	}
+
+	docInfo := &DocumentInfo{ID: string(key)}
+	err = decodeByIdValue(docInfo, value)
+	if err != nil {
+		return err
+	}
+	if sc.g.expiry && docInfo.expired(sc.now) {
+		return nil
+	}
+	if sc.options.Filter != nil && !sc.options.Filter(docInfo) {
+		return nil
+	}
+	if sc.idCb != nil {
+		return sc.idCb(sc.g, key, sc.userContext)
+	}
+	return sc.cb(sc.g, docInfo, sc.userContext)
+}
+
+// accept applies the filters which only need the encoded by-id value, the
+// prefix has already been checked.
+func (sc *scanContext) accept(key []byte, value []byte) (bool, error) {
+	if len(value) < 23 {
+		return false, ErrShortData
+	}
+	options := sc.options
+	if !options.acceptsDeleted(valueTopBit(value[10])) {
+		return false, nil
+	}
+	if (options.MinSeq != 0 || options.MaxSeq != 0) && !options.acceptsSeq(decode_raw48(value[0:6])) {
+		return false, nil
+	}
+	if !options.acceptsContentMeta(value[22]) {
+		return false, nil
+	}
+	if options.Match != "" && !options.acceptsId(string(key)) {
+		return false, nil
+	}
+	return true, nil
+}
+
+// ScanChanges is like ChangesSince, but only visits the documents chosen by
+// options, which may be nil.  The ID filters cannot narrow a walk in
+// sequence order, so they are checked for every change in the range.
+func (g *Gouchstore) ScanChanges(since uint64, till uint64, options *ScanOptions, cb DocumentInfoCallback, userContext interface{}) error {
+	if options == nil {
+		options = &ScanOptions{}
+	}
+	err := options.validate()
+	if err != nil {
+		return err
+	}
+	if options.MinSeq > since {
+		since = options.MinSeq
+	}
+	if options.MaxSeq != 0 && (till == 0 || options.MaxSeq < till) {
+		till = options.MaxSeq
+	}
+	if till != 0 && till < since {
+		return nil
+	}
+	return g.ChangesSince(since, till, func(g *Gouchstore, docInfo *DocumentInfo, userContext interface{}) error {
+		if !options.accepts(docInfo) {
+			return nil
+		}
+		return cb(g, docInfo, userContext)
+	}, userContext)
+}
+
+// DocumentInfoByIdWithOptions is DocumentInfoById, but returns ErrNotFound
+// for a document the filters of options, which may be nil, reject.
+func (g *Gouchstore) DocumentInfoByIdWithOptions(id string, options *ScanOptions) (*DocumentInfo, error) {
+	if options == nil {
+		options = &ScanOptions{}
+	}
+	err := options.validate()
+	if err != nil {
+		return nil, err
+	}
+	docInfo, err := g.DocumentInfoById(id)
+	if err != nil {
+		return nil, err
+	}
+	if !options.accepts(docInfo) {
+		return nil, ErrNotFound
+	}
+	return docInfo, nil
+}
+
+// DocumentInfosByIdsWithOptions is DocumentInfosByIds, but leaves out the
+// documents the filters of options, which may be nil, reject.
+func (g *Gouchstore) DocumentInfosByIdsWithOptions(identifiers []string, options *ScanOptions) ([]*DocumentInfo, error) {
+	if options == nil {
+		options = &ScanOptions{}
+	}
+	err := options.validate()
+	if err != nil {
+		return nil, err
+	}
+	docInfos, err := g.DocumentInfosByIds(identifiers)
+	if err != nil {
+		return nil, err
+	}
+	accepted := docInfos[:0]
+	for _, docInfo := range docInfos {
+		if options.accepts(docInfo) {
+			accepted = append(accepted, docInfo)
+		}
+	}
+	return accepted, nil
+}
@@ -0,0 +1,255 @@
+//  Copyright (c) 2014 Marty Schoch
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package gouchstore
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestScan(t *testing.T) {
+	defer os.Remove("test.couch")
+
+	db, err := Open("test.couch", OPEN_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// user:000 to user:299 then order:000 to order:299, every tenth user
+	// deleted and every third order not JSON
+	for _, kind := range []string{"user", "order"} {
+		for i := 0; i < 300; i++ {
+			id := fmt.Sprintf("%s:%03d", kind, i)
+			docInfo := &DocumentInfo{ID: id, Rev: 1, ContentMeta: DOC_IS_JSON}
+			doc := &Document{ID: id, Body: []byte(`{}`)}
+			if kind == "user" && i%10 == 0 {
+				docInfo.Deleted = true
+				doc = nil
+			}
+			if kind == "order" && i%3 == 0 {
+				docInfo.ContentMeta = DOC_NON_JSON_MODE
+			}
+			err = db.SaveDocument(doc, docInfo)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	err = db.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scan := func(startId, endId string, options *ScanOptions) []string {
+		var rv []string
+		err := db.Scan(startId, endId, options, func(g *Gouchstore, docInfo *DocumentInfo, userContext interface{}) error {
+			rv = append(rv, docInfo.ID)
+			return nil
+		}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rv
+	}
+	ids := func(kind string, from, to, step int) []string {
+		var rv []string
+		for i := from; i <= to; i += step {
+			rv = append(rv, fmt.Sprintf("%s:%03d", kind, i))
+		}
+		return rv
+	}
+
+	var prefixed []string
+	err = db.ScanPrefix("order:", func(g *Gouchstore, docInfo *DocumentInfo, userContext interface{}) error {
+		prefixed = append(prefixed, docInfo.ID)
+		return nil
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(prefixed, ids("order", 0, 299, 1)) {
+		t.Errorf("expected every order, got %d: %v", len(prefixed), prefixed)
+	}
+
+	tests := []struct {
+		startId, endId string
+		options        *ScanOptions
+		expected       []string
+	}{
+		{"", "", &ScanOptions{Prefix: "user:01"}, ids("user", 10, 19, 1)},
+		{"user:015", "", &ScanOptions{Prefix: "user:01"}, ids("user", 15, 19, 1)},
+		{"", "user:012", &ScanOptions{Prefix: "user:01"}, ids("user", 10, 12, 1)},
+		{"", "a", &ScanOptions{Prefix: "user:"}, nil},
+		{"", "", &ScanOptions{Prefix: "zzz"}, nil},
+		{"", "", &ScanOptions{Match: "user:?5?"}, append(append(ids("user", 50, 59, 1), ids("user", 150, 159, 1)...), ids("user", 250, 259, 1)...)},
+		{"", "", &ScanOptions{Prefix: "user:", Deleted: DELETED_ONLY}, ids("user", 0, 299, 10)},
+		{"user:000", "user:012", &ScanOptions{Deleted: DELETED_EXCLUDE}, append(ids("user", 1, 9, 1), "user:011", "user:012")},
+		{"", "", &ScanOptions{MinSeq: 598, MaxSeq: 599}, []string{"order:297", "order:298"}},
+		{"", "", &ScanOptions{MinSeq: 600}, []string{"order:299"}},
+		{"", "order:010", &ScanOptions{ContentMetaMask: 0xff, ContentMeta: DOC_NON_JSON_MODE}, ids("order", 0, 9, 3)},
+		{"", "", &ScanOptions{Filter: func(docInfo *DocumentInfo) bool {
+			return strings.HasSuffix(docInfo.ID, "99")
+		}}, []string{"order:099", "order:199", "order:299", "user:099", "user:199", "user:299"}},
+	}
+	for i, test := range tests {
+		actual := scan(test.startId, test.endId, test.options)
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("%d: expected %v, got %v", i, test.expected, actual)
+		}
+	}
+
+	// keys only
+	var keys []string
+	err = db.ScanKeys("", "", &ScanOptions{Prefix: "user:2", Deleted: DELETED_EXCLUDE}, func(g *Gouchstore, id []byte, userContext interface{}) error {
+		keys = append(keys, string(id))
+		return nil
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 90 || keys[0] != "user:201" || keys[89] != "user:299" {
+		t.Errorf("expected 90 live users from 201 to 299, got %d: %v", len(keys), keys)
+	}
+
+	// errors from the callback end the scan
+	stop := fmt.Errorf("stop")
+	count := 0
+	err = db.ScanPrefix("user:", func(g *Gouchstore, docInfo *DocumentInfo, userContext interface{}) error {
+		count++
+		if count == 5 {
+			return stop
+		}
+		return nil
+	}, nil)
+	if err != stop || count != 5 {
+		t.Errorf("expected the callback error after 5 documents, got %v after %d", err, count)
+	}
+
+	err = db.Scan("", "", &ScanOptions{Match: "["}, func(g *Gouchstore, docInfo *DocumentInfo, userContext interface{}) error {
+		return nil
+	}, nil)
+	if err != ErrInvalidArguments {
+		t.Errorf("expected ErrInvalidArguments for a bad pattern, got %v", err)
+	}
+}
+
+func TestScanDeleted(t *testing.T) {
+	defer os.Remove("test.couch")
+
+	db, err := Open("test.couch", OPEN_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 100; i++ {
+		id := fmt.Sprintf("doc-%03d", i)
+		err = db.SaveDocument(&Document{ID: id, Body: []byte(`{}`)}, &DocumentInfo{ID: id, Rev: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 100; i += 10 {
+		id := fmt.Sprintf("doc-%03d", i)
+		err = db.SaveDocument(nil, &DocumentInfo{ID: id, Rev: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a deleted document keeping a body
+	err = db.SaveDocument(&Document{ID: "doc-005", Body: []byte(`{"xattr":1}`)}, &DocumentInfo{ID: "doc-005", Rev: 2, Deleted: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"doc-010", "doc-005"} {
+		_, err = db.DocumentById(id)
+		if err != ErrNotFound {
+			t.Errorf("expected ErrNotFound for deleted %s, got %v", id, err)
+		}
+		_, err = db.DocumentBodyById(id)
+		if err != ErrNotFound {
+			t.Errorf("expected ErrNotFound for the body of deleted %s, got %v", id, err)
+		}
+		docInfo, err := db.DocumentInfoById(id)
+		if err != nil || !docInfo.Deleted {
+			t.Errorf("expected the info of deleted %s, got %v, %v", id, docInfo, err)
+		}
+		_, err = db.DocumentInfoByIdWithOptions(id, &ScanOptions{Deleted: DELETED_EXCLUDE})
+		if err != ErrNotFound {
+			t.Errorf("expected ErrNotFound excluding deleted %s, got %v", id, err)
+		}
+	}
+	docInfo, err := db.DocumentInfoById("doc-010")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.DocumentByDocumentInfo(docInfo)
+	if err != ErrNotFound {
+		t.Errorf("expected ErrNotFound for a document without a body, got %v", err)
+	}
+	docInfo, err = db.DocumentInfoById("doc-005")
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err := db.DocumentByDocumentInfo(docInfo)
+	if err != nil || string(doc.Body) != `{"xattr":1}` {
+		t.Errorf("expected the body kept by a deleted document, got %v, %v", doc, err)
+	}
+
+	docInfos, err := db.DocumentInfosByIdsWithOptions([]string{"doc-001", "doc-005", "doc-010", "doc-011"}, &ScanOptions{Deleted: DELETED_EXCLUDE})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docInfos) != 2 || docInfos[0].ID != "doc-001" || docInfos[1].ID != "doc-011" {
+		t.Errorf("expected doc-001 and doc-011, got %v", docInfos)
+	}
+
+	count := 0
+	err = db.Scan("", "", &ScanOptions{Deleted: DELETED_EXCLUDE}, func(g *Gouchstore, docInfo *DocumentInfo, userContext interface{}) error {
+		if docInfo.Deleted {
+			return fmt.Errorf("unexpected deleted %s", docInfo.ID)
+		}
+		count++
+		return nil
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 89 {
+		t.Errorf("expected 89 live documents, got %d", count)
+	}
+
+	var changes []string
+	err = db.ScanChanges(0, 0, &ScanOptions{Deleted: DELETED_ONLY}, func(g *Gouchstore, docInfo *DocumentInfo, userContext interface{}) error {
+		changes = append(changes, docInfo.ID)
+		return nil
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 11 || changes[0] != "doc-000" || changes[10] != "doc-005" {
+		t.Errorf("expected the 11 deletions in sequence order, got %v", changes)
+	}
+	changes = nil
+	err = db.ScanChanges(50, 0, &ScanOptions{Prefix: "doc-05", MaxSeq: 60}, func(g *Gouchstore, docInfo *DocumentInfo, userContext interface{}) error {
+		changes = append(changes, docInfo.ID)
+		return nil
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"doc-051", "doc-052", "doc-053", "doc-054", "doc-055", "doc-056", "doc-057", "doc-058", "doc-059"}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("expected %v, got %v", expected, changes)
+	}
+}
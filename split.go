@@ -0,0 +1,195 @@
+//  Copyright (c) 2014 Marty Schoch
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package gouchstore
+
+import (
+	"fmt"
+	"hash/crc32"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Partitioner returns the partition, from 0 to n-1, a document ID belongs in.
+type Partitioner func(id string, n int) int
+
+// HashPartitioner partitions IDs the way Couchbase assigns keys to vbuckets,
+// by the CRC32 of the ID.
+func HashPartitioner(id string, n int) int {
+	return int((crc32.ChecksumIEEE([]byte(id))>>16)&0x7fff) % n
+}
+
+// RangePartitioner partitions IDs by range, an ID goes in the partition of
+// the number of boundaries which are less than or equal to it.  The
+// boundaries must be sorted, and there must be one fewer than partitions.
+func RangePartitioner(boundaries ...string) Partitioner {
+	return func(id string, n int) int {
+		return sort.Search(len(boundaries), func(i int) bool {
+			return id < boundaries[i]
+		})
+	}
+}
+
+// SplitFilename returns the name Split gives partition i of src.
+func SplitFilename(src string, i int) string {
+	return fmt.Sprintf("%s.%d.couch", strings.TrimSuffix(src, ".couch"), i)
+}
+
+// Split writes the documents of the database src into n new databases,
+// named by SplitFilename, as chosen by partition, see SplitInto.
+func Split(src string, n int, partition Partitioner) error {
+	if n < 1 {
+		return ErrInvalidArguments
+	}
+	dsts := make([]string, n)
+	for i := range dsts {
+		dsts[i] = SplitFilename(src, i)
+	}
+	return SplitInto(src, dsts, partition, nil)
+}
+
+// SplitInto writes the documents of the database src into the new, or
+// empty, databases dsts, as chosen by partition.  Each keeps the order of
+// the documents in src but numbers them from 1, and gets a copy of every
+// local document.  The bodies are copied without being decoded.  The files
+// are opened with options, which may be nil, with Create and ReadOnly set as
+// needed.
+//
+// If the split fails the new dsts are removed.  The dsts must be distinct,
+// and may not be src.
+func SplitInto(src string, dsts []string, partition Partitioner, options *Options) error {
+	if len(dsts) < 1 || partition == nil {
+		return ErrInvalidArguments
+	}
+	for i, dst := range dsts {
+		if sameFileName(dst, src) {
+			return ErrInvalidArguments
+		}
+		for _, other := range dsts[:i] {
+			if sameFileName(dst, other) {
+				return ErrInvalidArguments
+			}
+		}
+	}
+	openOptions := Options{}
+	if options != nil {
+		openOptions = *options
+	}
+	sourceOptions := openOptions
+	sourceOptions.Create = false
+	sourceOptions.ReadOnly = true
+	source, err := OpenWithOptions(src, &sourceOptions)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	targetOptions := openOptions
+	targetOptions.Create = true
+	targetOptions.ReadOnly = false
+	targetOptions.IdTreeThresholds = source.thresholds.ById
+	targetOptions.SeqTreeThresholds = source.thresholds.BySeq
+	targetOptions.LocalTreeThresholds = source.thresholds.Local
+	targetOptions.ContentHash = source.contentHash
+	targets := make([]*Gouchstore, 0, len(dsts))
+	var created []string
+	defer func() {
+		for _, target := range targets {
+			target.Close()
+		}
+		for _, dst := range created {
+			os.Remove(dst)
+		}
+	}()
+	for _, dst := range dsts {
+		_, err = os.Stat(dst)
+		isNew := os.IsNotExist(err)
+		target, err := OpenWithOptions(dst, &targetOptions)
+		if err != nil {
+			return err
+		}
+		targets = append(targets, target)
+		if isNew {
+			created = append(created, dst)
+		}
+	}
+
+	err = source.splitInto(targets, partition)
+	if err != nil {
+		return err
+	}
+	for _, target := range targets {
+		err = target.Commit()
+		if err != nil {
+			return err
+		}
+	}
+	for len(targets) > 0 {
+		err = targets[0].Close()
+		targets = targets[1:]
+		if err != nil {
+			return err
+		}
+	}
+	created = nil
+	return nil
+}
+
+// splitInto copies the documents of g into the empty databases targets.
+func (g *Gouchstore) splitInto(targets []*Gouchstore, partition Partitioner) error {
+	builders := make([]*indexBuilder, 0, len(targets))
+	defer func() {
+		for _, builder := range builders {
+			builder.close()
+		}
+	}()
+	for _, target := range targets {
+		builder, err := target.newIndexBuilder()
+		if err != nil {
+			return err
+		}
+		builders = append(builders, builder)
+	}
+
+	err := g.rawChangesSince(0, 0, func(g *Gouchstore, info *DocumentInfo, userContext interface{}) error {
+		p := partition(info.ID, len(targets))
+		if p < 0 || p >= len(targets) {
+			return ErrInvalidArguments
+		}
+		target, builder := targets[p], builders[p]
+		if info.bodyPosition != 0 {
+			err := g.copyBody(target, info)
+			if err != nil {
+				return err
+			}
+		}
+		info.Seq = builder.seq + 1
+		return builder.add(encode_raw48(info.Seq), info.encodeBySeq(), []byte(info.ID), info.encodeById(), info.Expiry(), info.Deleted)
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	for i, target := range targets {
+		err = builders[i].finish()
+		if err != nil {
+			return err
+		}
+		builders[i].apply()
+		if g.header.localDocsRoot != nil {
+			err = g.compactLocalDocsTree(target, &compactContext{targetDb: target})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	g.logf("gouchstore: split %s into %d files", g.filename, len(targets))
+	return nil
+}
@@ -0,0 +1,151 @@
+//  Copyright (c) 2014 Marty Schoch
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package gouchstore
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestPartitioners(t *testing.T) {
+	// the vbucket of a key, as computed by Couchbase clients
+	if vb := HashPartitioner("hello", 1024); vb != 528 {
+		t.Errorf("expected vbucket 528, got %d", vb)
+	}
+	ranges := RangePartitioner("doc-0300", "doc-0600")
+	tests := map[string]int{
+		"":         0,
+		"doc-0299": 0,
+		"doc-0300": 1,
+		"doc-0599": 1,
+		"doc-0600": 2,
+		"zzz":      2,
+	}
+	for id, expected := range tests {
+		if p := ranges(id, 3); p != expected {
+			t.Errorf("expected %q in partition %d, got %d", id, expected, p)
+		}
+	}
+}
+
+func TestSplit(t *testing.T) {
+	defer os.Remove("test.couch")
+	for i := 0; i < 4; i++ {
+		defer os.Remove(SplitFilename("test.couch", i))
+	}
+
+	db, err := Open("test.couch", OPEN_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		id := fmt.Sprintf("doc-%04d", i)
+		docInfo := &DocumentInfo{ID: id, Rev: 1, Deleted: i%100 == 0}
+		var doc *Document
+		if !docInfo.Deleted {
+			doc = &Document{ID: id, Body: []byte(fmt.Sprintf(`{"i":%d}`, i))}
+		}
+		err = db.SaveDocument(doc, docInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = db.SaveLocalDocument(&LocalDocument{ID: "_local/config", Body: []byte(`{"a":1}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	err = SplitInto("test.couch", []string{"test.couch"}, HashPartitioner, nil)
+	if err != ErrInvalidArguments {
+		t.Errorf("expected ErrInvalidArguments splitting into the source, got %v", err)
+	}
+	err = SplitInto("test.couch", []string{SplitFilename("test.couch", 0), SplitFilename("test.couch", 0)}, HashPartitioner, nil)
+	if err != ErrInvalidArguments {
+		t.Errorf("expected ErrInvalidArguments splitting into the same file twice, got %v", err)
+	}
+
+	err = Split("test.couch", 4, HashPartitioner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := uint64(0)
+	for p := 0; p < 4; p++ {
+		part, err := Open(SplitFilename("test.couch", p), OPEN_RDONLY)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seq := uint64(0)
+		last := -1
+		err = part.ChangesSince(0, 0, func(g *Gouchstore, docInfo *DocumentInfo, userContext interface{}) error {
+			seq++
+			var i int
+			fmt.Sscanf(docInfo.ID, "doc-%04d", &i)
+			if HashPartitioner(docInfo.ID, 4) != p {
+				return fmt.Errorf("%s is in the wrong partition %d", docInfo.ID, p)
+			}
+			if docInfo.Seq != seq || i <= last {
+				return fmt.Errorf("expected %s at seq %d, after doc %d", docInfo.ID, docInfo.Seq, last)
+			}
+			last = i
+			if docInfo.Deleted != (i%100 == 0) {
+				return fmt.Errorf("expected %s deleted %t", docInfo.ID, i%100 == 0)
+			}
+			if docInfo.Deleted {
+				return nil
+			}
+			doc, err := g.DocumentById(docInfo.ID)
+			if err != nil {
+				return err
+			}
+			if string(doc.Body) != fmt.Sprintf(`{"i":%d}`, i) {
+				return fmt.Errorf("expected body of %d, got %s", i, doc.Body)
+			}
+			return nil
+		}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seq == 0 {
+			t.Errorf("expected documents in partition %d", p)
+		}
+		total += seq
+		localDoc, err := part.LocalDocumentById("_local/config")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(localDoc.Body) != `{"a":1}` {
+			t.Errorf("expected the local document in partition %d, got %s", p, localDoc.Body)
+		}
+		part.Close()
+	}
+	if total != 1000 {
+		t.Errorf("expected 1000 documents across the partitions, got %d", total)
+	}
+
+	// a partitioner out of range fails, and removes the new files
+	for i := 0; i < 4; i++ {
+		os.Remove(SplitFilename("test.couch", i))
+	}
+	err = Split("test.couch", 2, RangePartitioner("doc-0300", "doc-0600"))
+	if err != ErrInvalidArguments {
+		t.Errorf("expected ErrInvalidArguments, got %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := os.Stat(SplitFilename("test.couch", i)); !os.IsNotExist(err) {
+			t.Errorf("expected partition %d to be removed, got %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,472 @@
+//  Copyright (c) 2014 Marty Schoch
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package gouchstore
+
+import (
+	"container/heap"
+	"container/list"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// STORE_VBUCKETS is the number of vbuckets Couchbase uses.
+const STORE_VBUCKETS = 1024
+
+const gs_STORE_MAX_OPEN = 64
+const gs_STORE_SCAN_BATCH_SIZE = 64
+
+// StoreOptions controls how a Store is opened.
+type StoreOptions struct {
+	VBuckets    int         // number of vbucket files, STORE_VBUCKETS if zero
+	MaxOpen     int         // most files kept open at once, 64 if zero
+	Partitioner Partitioner // maps IDs to vbuckets, HashPartitioner if nil
+	Options     *Options    // how each file is opened, Create is set when writing
+}
+
+// StoreDocumentInfoCallback is used to iterate over the documents of a Store.
+type StoreDocumentInfoCallback func(store *Store, vbucket int, documentInfo *DocumentInfo, userContext interface{}) error
+
+// Store gives access to a directory of vbucket files, named by
+// VBucketFilename, each holding the documents whose IDs map to it.  Files are
+// opened as they are needed, and the least recently used are closed to keep
+// no more than MaxOpen open.
+//
+// A Store is safe for concurrent use.  Changes are committed by Commit, by
+// Close, and also whenever a write closes a file with changes to stay within
+// MaxOpen.  Reads only close files without changes, so files with changes
+// may keep more than MaxOpen open until the next write or Commit.
+type Store struct {
+	dir      string
+	options  StoreOptions
+	m        sync.Mutex
+	unpinned *sync.Cond // signalled, with m, when a file is unpinned
+	files    map[int]*list.Element
+	lru      *list.List
+	closed   bool
+}
+
+type storeFile struct {
+	vbucket int
+	db      *Gouchstore
+	dirty   bool
+	pins    int
+}
+
+// VBucketFilename returns the name of the file holding vbucket.
+func VBucketFilename(vbucket int) string {
+	return fmt.Sprintf("%d.couch", vbucket)
+}
+
+// OpenStore opens the Store in the existing directory dir.
+func OpenStore(dir string, options *StoreOptions) (*Store, error) {
+	rv := &Store{
+		dir:   dir,
+		files: make(map[int]*list.Element),
+		lru:   list.New(),
+	}
+	rv.unpinned = sync.NewCond(&rv.m)
+	if options != nil {
+		rv.options = *options
+	}
+	if rv.options.VBuckets == 0 {
+		rv.options.VBuckets = STORE_VBUCKETS
+	}
+	if rv.options.MaxOpen == 0 {
+		rv.options.MaxOpen = gs_STORE_MAX_OPEN
+	}
+	if rv.options.Partitioner == nil {
+		rv.options.Partitioner = HashPartitioner
+	}
+	if rv.options.VBuckets < 0 || rv.options.MaxOpen < 0 {
+		return nil, ErrInvalidArguments
+	}
+	if rv.options.Options != nil {
+		err := rv.options.Options.Validate()
+		if err != nil {
+			return nil, err
+		}
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, ErrInvalidArguments
+	}
+	return rv, nil
+}
+
+// VBucket returns the vbucket the document id belongs in.
+func (s *Store) VBucket(id string) int {
+	return s.options.Partitioner(id, s.options.VBuckets)
+}
+
+// file returns the open file for vbucket, opening it if needed.  It returns
+// nil if the file does not exist and create is false.  Only writes, which
+// create, commit the files they close.
+func (s *Store) file(vbucket int, create bool) (*storeFile, error) {
+	if s.closed {
+		return nil, ErrClosed
+	}
+	if vbucket < 0 || vbucket >= s.options.VBuckets {
+		return nil, ErrInvalidArguments
+	}
+	if e, ok := s.files[vbucket]; ok {
+		s.lru.MoveToFront(e)
+		return e.Value.(*storeFile), nil
+	}
+
+	filename := filepath.Join(s.dir, VBucketFilename(vbucket))
+	if !create {
+		_, err := os.Stat(filename)
+		if os.IsNotExist(err) {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	err := s.evict(s.options.MaxOpen-1, create)
+	if err != nil {
+		return nil, err
+	}
+	options := Options{}
+	if s.options.Options != nil {
+		options = *s.options.Options
+	}
+	options.Create = create && !options.ReadOnly
+	db, err := OpenWithOptions(filename, &options)
+	if err != nil {
+		return nil, err
+	}
+	rv := &storeFile{vbucket: vbucket, db: db}
+	s.files[vbucket] = s.lru.PushFront(rv)
+	return rv, nil
+}
+
+// evict closes the least recently used files until no more than max are
+// open, committing their changes if commit is set, otherwise files with
+// changes are kept.  Files in use are kept.
+func (s *Store) evict(max int, commit bool) error {
+	e := s.lru.Back()
+	for s.lru.Len() > max && e != nil {
+		f := e.Value.(*storeFile)
+		prev := e.Prev()
+		if f.pins == 0 && (commit || !f.dirty) {
+			err := s.closeFile(f)
+			if err != nil {
+				return err
+			}
+			s.lru.Remove(e)
+			delete(s.files, f.vbucket)
+		}
+		e = prev
+	}
+	return nil
+}
+
+// unpin releases a file pinned by f.pins++, s.m must be held.
+func (s *Store) unpin(f *storeFile) {
+	f.pins--
+	if f.pins == 0 {
+		s.unpinned.Broadcast()
+	}
+}
+
+func (s *Store) closeFile(f *storeFile) error {
+	if f.dirty {
+		err := f.db.Commit()
+		if err != nil {
+			return err
+		}
+		f.dirty = false
+	}
+	return f.db.Close()
+}
+
+// Get returns the document with the given id, or ErrNotFound if it is
+// missing or deleted.
+func (s *Store) Get(id string) (*Document, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	f, err := s.file(s.VBucket(id), false)
+	if err != nil {
+		return nil, err
+	}
+	if f == nil {
+		return nil, ErrNotFound
+	}
+	return f.db.DocumentById(id)
+}
+
+// GetInfo returns the DocumentInfo of the document with the given id.
+func (s *Store) GetInfo(id string) (*DocumentInfo, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	f, err := s.file(s.VBucket(id), false)
+	if err != nil {
+		return nil, err
+	}
+	if f == nil {
+		return nil, ErrNotFound
+	}
+	return f.db.DocumentInfoById(id)
+}
+
+// Set saves the document in its vbucket, as SaveDocument does.
+func (s *Store) Set(doc *Document, docInfo *DocumentInfo) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	f, err := s.file(s.VBucket(docInfo.ID), true)
+	if err != nil {
+		return err
+	}
+	err = f.db.SaveDocument(doc, docInfo)
+	if err != nil {
+		return err
+	}
+	f.dirty = true
+	return nil
+}
+
+// Delete saves docInfo as deleted in its vbucket.
+func (s *Store) Delete(docInfo *DocumentInfo) error {
+	docInfo.Deleted = true
+	return s.Set(nil, docInfo)
+}
+
+// Commit commits every file with changes.
+func (s *Store) Commit() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	for e := s.lru.Front(); e != nil; e = e.Next() {
+		f := e.Value.(*storeFile)
+		if f.dirty {
+			err := f.db.Commit()
+			if err != nil {
+				return err
+			}
+			f.dirty = false
+		}
+	}
+	return nil
+}
+
+// ChangesSince iterates through the documents of vbucket in sequence order,
+// as Gouchstore.ChangesSince does.  The Store is locked while it runs, so
+// cb must not use the Store, only the Gouchstore it is given.
+func (s *Store) ChangesSince(vbucket int, since uint64, till uint64, cb DocumentInfoCallback, userContext interface{}) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	f, err := s.file(vbucket, false)
+	if err != nil || f == nil {
+		return err
+	}
+	f.pins++
+	defer s.unpin(f)
+	return f.db.ChangesSince(since, till, cb, userContext)
+}
+
+// AllDocuments iterates through the documents of every vbucket, merged in ID
+// order, from startId through endId (inclusive), an empty endId continues
+// to the last document.  The Store is not locked while cb runs.
+//
+// Each vbucket is read in batches, resuming after the last ID of the batch
+// before, so no file is pinned between batches.  Like every read, the scan
+// only closes files without changes to stay within MaxOpen.
+func (s *Store) AllDocuments(startId, endId string, cb StoreDocumentInfoCallback, userContext interface{}) error {
+	h := &storeScanHeap{}
+	for vbucket := 0; vbucket < s.options.VBuckets; vbucket++ {
+		scan := &storeScan{vbucket: vbucket, start: startId}
+		err := s.fillScan(scan, endId)
+		if err != nil {
+			return err
+		}
+		if len(scan.batch) > 0 {
+			h.scans = append(h.scans, scan)
+		}
+	}
+	heap.Init(h)
+
+	for h.Len() > 0 {
+		scan := h.scans[0]
+		docInfo := scan.batch[0]
+		scan.batch = scan.batch[1:]
+		err := cb(s, scan.vbucket, docInfo, userContext)
+		if err != nil {
+			return err
+		}
+		if len(scan.batch) == 0 && !scan.done {
+			err = s.fillScan(scan, endId)
+			if err != nil {
+				return err
+			}
+		}
+		if len(scan.batch) == 0 {
+			heap.Pop(h)
+		} else {
+			heap.Fix(h, 0)
+		}
+	}
+	return nil
+}
+
+// fillScan reads the next batch of documents of a vbucket, from its cursor.
+func (s *Store) fillScan(scan *storeScan, endId string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	f, err := s.file(scan.vbucket, false)
+	if err != nil {
+		return err
+	}
+	if f == nil {
+		scan.done = true
+		return nil
+	}
+	err = f.db.AllDocuments(scan.start, endId, func(g *Gouchstore, docInfo *DocumentInfo, userContext interface{}) error {
+		if scan.started && docInfo.ID == scan.start {
+			// already seen in the last batch
+			return nil
+		}
+		scan.batch = append(scan.batch, docInfo)
+		if len(scan.batch) == gs_STORE_SCAN_BATCH_SIZE {
+			return errStopScan
+		}
+		return nil
+	}, nil)
+	if err == errStopScan {
+		err = nil
+	} else if err == nil {
+		scan.done = true
+	}
+	if len(scan.batch) > 0 {
+		scan.start = scan.batch[len(scan.batch)-1].ID
+		scan.started = true
+	}
+	return err
+}
+
+// storeScan is the cursor of one vbucket in AllDocuments.
+type storeScan struct {
+	vbucket int
+	start   string // the last ID read, once started
+	started bool
+	done    bool
+	batch   []*DocumentInfo
+}
+
+// storeScanHeap orders the scans by their next document ID.
+type storeScanHeap struct {
+	scans []*storeScan
+}
+
+func (h *storeScanHeap) Len() int { return len(h.scans) }
+func (h *storeScanHeap) Less(i, j int) bool {
+	return h.scans[i].batch[0].ID < h.scans[j].batch[0].ID
+}
+func (h *storeScanHeap) Swap(i, j int)      { h.scans[i], h.scans[j] = h.scans[j], h.scans[i] }
+func (h *storeScanHeap) Push(x interface{}) { h.scans = append(h.scans, x.(*storeScan)) }
+func (h *storeScanHeap) Pop() interface{} {
+	old := h.scans
+	rv := old[len(old)-1]
+	h.scans = old[:len(old)-1]
+	return rv
+}
+
+// CompactVBucket compacts the file of vbucket with CompactLive, the Store
+// stays usable meanwhile.
+func (s *Store) CompactVBucket(vbucket int) error {
+	s.m.Lock()
+	f, err := s.file(vbucket, false)
+	if err != nil || f == nil {
+		s.m.Unlock()
+		return err
+	}
+	f.pins++
+	s.m.Unlock()
+
+	target := filepath.Join(s.dir, VBucketFilename(vbucket)+".compact")
+	err = f.db.CompactLive(target, &s.m)
+
+	s.m.Lock()
+	s.unpin(f)
+	s.m.Unlock()
+	return err
+}
+
+// DatabaseInfo returns the totals of every vbucket file, LastSeq is the sum
+// of their last sequence numbers and FileName is the directory.
+func (s *Store) DatabaseInfo() (*DatabaseInfo, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	rv := &DatabaseInfo{FileName: s.dir}
+	for vbucket := 0; vbucket < s.options.VBuckets; vbucket++ {
+		f, err := s.file(vbucket, false)
+		if err != nil {
+			return nil, err
+		}
+		if f == nil {
+			continue
+		}
+		info, err := f.db.DatabaseInfo()
+		if err != nil {
+			return nil, err
+		}
+		rv.LastSeq += info.LastSeq
+		rv.DocumentCount += info.DocumentCount
+		rv.DeletedCount += info.DeletedCount
+		rv.SpaceUsed += info.SpaceUsed
+		rv.FileSize += info.FileSize
+	}
+	return rv, nil
+}
+
+// Close commits the changes of every open file and closes it.  Files in use,
+// such as by CompactVBucket, are closed once they are no longer used.
+func (s *Store) Close() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	// nothing new can be pinned once closed is set
+	s.closed = true
+	for s.pinned() {
+		s.unpinned.Wait()
+	}
+	var rv error
+	for e := s.lru.Front(); e != nil; e = e.Next() {
+		f := e.Value.(*storeFile)
+		err := s.closeFile(f)
+		if err != nil {
+			// the commit failed, the file must still be closed
+			f.db.Close()
+			if rv == nil {
+				rv = err
+			}
+		}
+	}
+	s.files = nil
+	s.lru.Init()
+	return rv
+}
+
+func (s *Store) pinned() bool {
+	for e := s.lru.Front(); e != nil; e = e.Next() {
+		if e.Value.(*storeFile).pins > 0 {
+			return true
+		}
+	}
+	return false
+}
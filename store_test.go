@@ -0,0 +1,350 @@
+//  Copyright (c) 2014 Marty Schoch
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package gouchstore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenStore(dir, &StoreOptions{VBuckets: 16, MaxOpen: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	for i := 0; i < 500; i++ {
+		id := fmt.Sprintf("doc-%04d", i)
+		err = store.Set(&Document{ID: id, Body: []byte(fmt.Sprintf(`{"i":%d}`, i))}, &DocumentInfo{ID: id, Rev: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if store.lru.Len() > 3 {
+			t.Fatalf("expected at most 3 open files, got %d", store.lru.Len())
+		}
+	}
+	for i := 0; i < 500; i += 50 {
+		err = store.Delete(&DocumentInfo{ID: fmt.Sprintf("doc-%04d", i), Rev: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = store.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	doc, err := store.Get("doc-0123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(doc.Body) != `{"i":123}` {
+		t.Errorf("expected body of doc 123, got %s", doc.Body)
+	}
+	docInfo, err := store.GetInfo("doc-0050")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !docInfo.Deleted || docInfo.Rev != 2 {
+		t.Errorf("expected doc 50 deleted at rev 2, got %v", docInfo)
+	}
+	_, err = store.Get("missing")
+	if err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+
+	// merged in id order across the files
+	count := 0
+	vbuckets := make(map[int]bool)
+	err = store.AllDocuments("doc-0100", "doc-0399", func(s *Store, vbucket int, docInfo *DocumentInfo, userContext interface{}) error {
+		expected := fmt.Sprintf("doc-%04d", 100+count)
+		if docInfo.ID != expected {
+			return fmt.Errorf("expected %s, got %s", expected, docInfo.ID)
+		}
+		if vbucket != s.VBucket(docInfo.ID) {
+			return fmt.Errorf("expected %s in vbucket %d, got %d", docInfo.ID, s.VBucket(docInfo.ID), vbucket)
+		}
+		vbuckets[vbucket] = true
+		count++
+		return nil
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 300 {
+		t.Errorf("expected 300 documents, got %d", count)
+	}
+	if len(vbuckets) != 16 {
+		t.Errorf("expected documents from 16 vbuckets, got %d", len(vbuckets))
+	}
+
+	vbucket := store.VBucket("doc-0000")
+	changes := 0
+	lastSeq := uint64(0)
+	err = store.ChangesSince(vbucket, 0, 0, func(g *Gouchstore, docInfo *DocumentInfo, userContext interface{}) error {
+		if store.VBucket(docInfo.ID) != vbucket || docInfo.Seq <= lastSeq {
+			return fmt.Errorf("unexpected change %s at %d", docInfo.ID, docInfo.Seq)
+		}
+		lastSeq = docInfo.Seq
+		changes++
+		return nil
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changes == 0 {
+		t.Errorf("expected changes in vbucket %d", vbucket)
+	}
+
+	info, err := store.DatabaseInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.DocumentCount != 490 || info.DeletedCount != 10 || info.LastSeq != 510 {
+		t.Errorf("expected 490 documents and 10 deleted at 510 changes, got %d, %d, %d", info.DocumentCount, info.DeletedCount, info.LastSeq)
+	}
+
+	// compacting one file leaves the rest alone
+	filename := filepath.Join(dir, VBucketFilename(vbucket))
+	before, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.CompactVBucket(vbucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Size() >= before.Size() {
+		t.Errorf("expected vbucket %d to shrink from %d, got %d", vbucket, before.Size(), after.Size())
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 16 {
+		t.Errorf("expected 16 files, got %d", len(entries))
+	}
+
+	// changes to files closed by writes to stay under MaxOpen are committed
+	err = store.Set(&Document{ID: "late", Body: []byte(`{}`)}, &DocumentInfo{ID: "late", Rev: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 500; i += 7 {
+		id := fmt.Sprintf("doc-%04d", i)
+		if store.VBucket(id) == store.VBucket("late") {
+			continue
+		}
+		err = store.Set(&Document{ID: id, Body: []byte(`{}`)}, &DocumentInfo{ID: id, Rev: 3})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := store.files[store.VBucket("late")]; ok {
+		t.Fatalf("expected the file of late to be closed")
+	}
+	db, err := Open(filepath.Join(dir, VBucketFilename(store.VBucket("late"))), OPEN_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, err = db.DocumentInfoById("late")
+	if err != nil {
+		t.Errorf("expected evicted changes to be committed, got %v", err)
+	}
+}
+
+func TestStoreReadsDoNotCommit(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenStore(dir, &StoreOptions{VBuckets: 8, MaxOpen: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	for i := 0; i < 200; i++ {
+		id := fmt.Sprintf("doc-%04d", i)
+		err = store.Set(&Document{ID: id, Body: []byte(`{}`)}, &DocumentInfo{ID: id, Rev: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = store.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Set(&Document{ID: "late", Body: []byte(`{}`)}, &DocumentInfo{ID: "late", Rev: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vbucket := store.VBucket("late")
+
+	// reading every vbucket keeps the file with changes open
+	count := 0
+	err = store.AllDocuments("", "", func(s *Store, vbucket int, docInfo *DocumentInfo, userContext interface{}) error {
+		count++
+		return nil
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 201 {
+		t.Errorf("expected 201 documents, got %d", count)
+	}
+	for i := 0; i < 200; i += 3 {
+		_, err = store.GetInfo(fmt.Sprintf("doc-%04d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = store.DatabaseInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.files[vbucket]; !ok {
+		t.Fatalf("expected the file with changes to stay open")
+	}
+	if store.lru.Len() > 3 {
+		t.Errorf("expected at most 3 open files, got %d", store.lru.Len())
+	}
+
+	// and the change is still uncommitted
+	db, err := Open(filepath.Join(dir, VBucketFilename(vbucket)), OPEN_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, err = db.DocumentInfoById("late")
+	if err != ErrNotFound {
+		t.Errorf("expected the change to be uncommitted, got %v", err)
+	}
+}
+
+func TestStoreClose(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenStore(dir, &StoreOptions{VBuckets: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Set(&Document{ID: "doc", Body: []byte(`{}`)}, &DocumentInfo{ID: "doc", Rev: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a pinned file, as during CompactVBucket, is waited for
+	store.m.Lock()
+	f := store.files[store.VBucket("doc")].Value.(*storeFile)
+	f.pins++
+	store.m.Unlock()
+	closed := make(chan error)
+	go func() {
+		closed <- store.Close()
+	}()
+	select {
+	case err = <-closed:
+		t.Fatalf("expected Close to wait for the pinned file, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	_, err = store.Get("doc")
+	if err != ErrClosed {
+		t.Errorf("expected ErrClosed while closing, got %v", err)
+	}
+	store.m.Lock()
+	store.unpin(f)
+	store.m.Unlock()
+	err = <-closed
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the uncommitted change was committed by Close
+	store, err = OpenStore(dir, &StoreOptions{VBuckets: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	_, err = store.GetInfo("doc")
+	if err != nil {
+		t.Errorf("expected the change to be committed, got %v", err)
+	}
+}
+
+func TestStoreConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	store, err := OpenStore(dir, &StoreOptions{VBuckets: 8, MaxOpen: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	for i := 0; i < 100; i++ {
+		id := fmt.Sprintf("doc-%04d", i)
+		err = store.Set(&Document{ID: id, Body: []byte(`{}`)}, &DocumentInfo{ID: id, Rev: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = store.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				id := fmt.Sprintf("w%d-%04d", w, i)
+				err := store.Set(&Document{ID: id, Body: []byte(`{}`)}, &DocumentInfo{ID: id, Rev: 1})
+				if err == nil {
+					_, err = store.GetInfo(id)
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for vbucket := 0; vbucket < 8; vbucket++ {
+			err := store.CompactVBucket(vbucket)
+			if err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	info, err := store.DatabaseInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.DocumentCount != 500 {
+		t.Errorf("expected 500 documents, got %d", info.DocumentCount)
+	}
+}
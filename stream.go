@@ -0,0 +1,253 @@
+//  Copyright (c) 2014 Marty Schoch
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package gouchstore
+
+import (
+	"bytes"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+// The by-sequence index stores the ID length in 12 bits and the on disk
+// size of the body chunk in 28 bits.
+const gs_MAX_ID_LENGTH = 1<<12 - 1
+const gs_MAX_DOC_DISK_SIZE int64 = 1<<28 - 1
+
+const gs_STREAM_BUFFER_SIZE = 64 * 1024
+
+// maxIDLength is smaller when the expiry index is on, its keys are the
+// document ID prefixed with the 4 byte expiry time.
+func (g *Gouchstore) maxIDLength() int {
+	if g.expiry {
+		return gs_MAX_ID_LENGTH - 4
+	}
+	return gs_MAX_ID_LENGTH
+}
+
+func (g *Gouchstore) checkID(id string) error {
+	if len(id) > g.maxIDLength() {
+		return ErrKeyTooLarge
+	}
+	return nil
+}
+
+// chunkDiskSize returns the number of bytes a data chunk of size bytes
+// takes up when written at pos, including the prefix and block markers.
+func chunkDiskSize(pos, size int64) int64 {
+	end := pos
+	remaining := gs_CHUNK_LENGTH_SIZE + gs_CHUNK_CRC_SIZE + size
+	for remaining > 0 {
+		if end%gs_BLOCK_SIZE == 0 {
+			end++
+			continue
+		}
+		n := gs_BLOCK_SIZE - end%gs_BLOCK_SIZE
+		if n > remaining {
+			n = remaining
+		}
+		end += n
+		remaining -= n
+	}
+	return end - pos
+}
+
+// checkDocuments fails early, before anything is written, when a document
+// ID cannot be encoded, or an uncompressed body certainly will not fit.
+func (g *Gouchstore) checkDocuments(docs []*Document, docInfos []*DocumentInfo) error {
+	if len(docs) != len(docInfos) {
+		return ErrInvalidArguments
+	}
+	for i, docInfo := range docInfos {
+		if docInfo == nil {
+			return ErrInvalidArguments
+		}
+		err := g.checkID(docInfo.ID)
+		if err != nil {
+			return err
+		}
+		if docs[i] != nil && !docInfo.Compressed() && chunkDiskSize(g.pos, int64(len(docs[i].Body))) > gs_MAX_DOC_DISK_SIZE {
+			return ErrDocumentTooLarge
+		}
+	}
+	return nil
+}
+
+// SaveDocumentFromReader stores a document whose body is read from r,
+// without holding the whole body in memory.  Bodies which are compressed,
+// or which must be checked for JSON, are read into memory first.
+func (g *Gouchstore) SaveDocumentFromReader(docInfo *DocumentInfo, r io.Reader) error {
+	err := g.checkWritable()
+	if err != nil {
+		return err
+	}
+	if docInfo == nil || r == nil {
+		return ErrInvalidArguments
+	}
+	err = g.checkID(docInfo.ID)
+	if err != nil {
+		return err
+	}
+	if docInfo.Compressed() || g.jsonMode != JSON_MODE_OFF {
+		body, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		return g.SaveDocument(&Document{ID: docInfo.ID, Body: body}, docInfo)
+	}
+
+	seq := g.header.updateSeq + 1
+	updated := *docInfo
+	updated.Seq = seq
+	updated.Deleted = false
+	pos, size, err := g.writeChunkFromReader(r)
+	if err != nil {
+		return err
+	}
+	updated.bodyPosition = uint64(pos)
+	updated.Size = uint64(size)
+
+	err = g.updateIndexes([][]byte{encode_raw48(seq)}, [][]byte{updated.encodeBySeq()},
+		[][]byte{[]byte(updated.ID)}, [][]byte{updated.encodeById()})
+	if err != nil {
+		return err
+	}
+	docInfo.Seq = seq
+	g.header.updateSeq = seq
+	return nil
+}
+
+// writeChunkFromReader writes a data chunk at the end of the file, the
+// prefix is reserved first and filled in once the length and crc are known.
+func (g *Gouchstore) writeChunkFromReader(r io.Reader) (int64, int64, error) {
+	startPos := g.pos
+	prefix := make([]byte, gs_CHUNK_LENGTH_SIZE+gs_CHUNK_CRC_SIZE)
+	written, err := g.writeAt(prefix, startPos, false)
+	if err != nil {
+		return startPos, written, err
+	}
+	pos := startPos + written
+
+	crc := crc32.NewIEEE()
+	var size int64
+	buf := make([]byte, gs_STREAM_BUFFER_SIZE)
+	for {
+		n, rerr := r.Read(buf)
+		if n > 0 {
+			size += int64(n)
+			if chunkDiskSize(startPos, size) > gs_MAX_DOC_DISK_SIZE {
+				return startPos, pos - startPos, ErrDocumentTooLarge
+			}
+			crc.Write(buf[:n])
+			written, err = g.writeAt(buf[:n], pos, false)
+			if err != nil {
+				return startPos, pos - startPos, err
+			}
+			pos += written
+		}
+		if rerr == io.EOF {
+			break
+		} else if rerr != nil {
+			return startPos, pos - startPos, rerr
+		}
+	}
+
+	copy(prefix, encode_raw31_highestbiton(uint32(size)))
+	copy(prefix[gs_CHUNK_LENGTH_SIZE:], encode_raw32(crc.Sum32()))
+	_, err = g.writeAt(prefix, startPos, false)
+	if err != nil {
+		return startPos, pos - startPos, err
+	}
+	g.pos = pos
+	return startPos, pos - startPos, nil
+}
+
+// OpenDocumentReader returns a reader for the body of the document
+// described by docInfo, the body is read from disk as it is consumed.
+// The checksum is verified when the end of the body is reached, a
+// mismatch is reported instead of io.EOF.
+//
+// Compressed bodies are read and decompressed in one piece.  A body which
+// would extend past the end of the file is reported as a *CorruptError.
+func (g *Gouchstore) OpenDocumentReader(docInfo *DocumentInfo) (io.Reader, error) {
+	err := g.checkOpen()
+	if err != nil {
+		return nil, err
+	}
+	if docInfo == nil {
+		return nil, ErrInvalidArguments
+	}
+	// deleted documents usually have no body
+	if docInfo.Deleted || docInfo.bodyPosition == 0 || (g.expiry && docInfo.expired(expiryNow())) {
+		return nil, ErrNotFound
+	}
+	if docInfo.Compressed() {
+		body, err := g.readCompressedDataChunkAt(int64(docInfo.bodyPosition))
+		if err != nil {
+			return nil, err
+		}
+		return bytes.NewReader(body), nil
+	}
+
+	pos := int64(docInfo.bodyPosition)
+	chunkPrefix := make([]byte, gs_CHUNK_LENGTH_SIZE+gs_CHUNK_CRC_SIZE)
+	n, err := g.readAt(chunkPrefix, pos)
+	if err != nil {
+		return nil, err
+	}
+	if n < gs_CHUNK_LENGTH_SIZE+gs_CHUNK_CRC_SIZE {
+		return nil, corruptAt(pos, CHUNK_TYPE_DATA, ErrChunkShortPrefix)
+	}
+	size := int64(decode_raw31(chunkPrefix[0:gs_CHUNK_LENGTH_SIZE]))
+	if pos+chunkDiskSize(pos, size) > g.pos {
+		return nil, corruptAt(pos, CHUNK_TYPE_DATA, ErrChunkDataLessThanSize)
+	}
+	return &chunkReader{
+		g:         g,
+		start:     pos,
+		pos:       pos + n,
+		remaining: size,
+		crc:       decode_raw32(chunkPrefix[gs_CHUNK_LENGTH_SIZE:]),
+		hash:      crc32.NewIEEE(),
+	}, nil
+}
+
+type chunkReader struct {
+	g         *Gouchstore
+	start     int64
+	pos       int64
+	remaining int64
+	crc       uint32
+	hash      hash.Hash32
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	if c.remaining == 0 {
+		if c.hash.Sum32() != c.crc {
+			return 0, corruptAt(c.start, CHUNK_TYPE_DATA, ErrChunkBadCRC)
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.g.readAt(p, c.pos)
+	if err != nil {
+		return 0, err
+	}
+	if n < int64(len(p)) {
+		return 0, corruptAt(c.start, CHUNK_TYPE_DATA, ErrChunkDataLessThanSize)
+	}
+	// n includes any block markers which were skipped
+	c.pos += n
+	c.remaining -= int64(len(p))
+	c.hash.Write(p)
+	return len(p), nil
+}
@@ -0,0 +1,300 @@
+//  Copyright (c) 2014 Marty Schoch
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package gouchstore
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func largeBody(size int) []byte {
+	rv := make([]byte, size)
+	for i := range rv {
+		rv[i] = byte(i % 251)
+	}
+	return rv
+}
+
+func TestStreamLargeDocument(t *testing.T) {
+	defer os.Remove("test.couch")
+	db, err := Open("test.couch", OPEN_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := largeBody(3*gs_STREAM_BUFFER_SIZE + 12345)
+	docInfo := &DocumentInfo{ID: "large", Rev: 1}
+	err = db.SaveDocumentFromReader(docInfo, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if docInfo.Seq != 1 {
+		t.Errorf("expected seq 1, got %d", docInfo.Seq)
+	}
+	// a small compressed document goes through the in memory path
+	err = db.SaveDocumentFromReader(&DocumentInfo{ID: "small", Rev: 1, ContentMeta: DOC_IS_COMPRESSED}, strings.NewReader(`{"abc":123}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db, err = Open("test.couch", OPEN_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	docInfo, err = db.DocumentInfoById("large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if docInfo.Size != uint64(chunkDiskSize(int64(docInfo.bodyPosition), int64(len(body)))) {
+		t.Errorf("unexpected size %d for body of %d bytes", docInfo.Size, len(body))
+	}
+	r, err := db.OpenDocumentReader(docInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	streamed, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(streamed, body) {
+		t.Errorf("streamed body does not match")
+	}
+	doc, err := db.DocumentById("large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(doc.Body, body) {
+		t.Errorf("body does not match")
+	}
+
+	docInfo, err = db.DocumentInfoById("small")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err = db.OpenDocumentReader(docInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	streamed, err = io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(streamed) != `{"abc":123}` {
+		t.Errorf("expected small body, got %s", streamed)
+	}
+}
+
+func TestStreamDetectsBadCRC(t *testing.T) {
+	defer os.Remove("test.couch")
+	db, err := Open("test.couch", OPEN_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	docInfo := &DocumentInfo{ID: "large", Rev: 1}
+	err = db.SaveDocumentFromReader(docInfo, bytes.NewReader(largeBody(10000)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	f, err := os.OpenFile("test.couch", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the body of the first document follows the initial header
+	_, err = f.WriteAt([]byte{0xff, 0xff}, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	db, err = Open("test.couch", OPEN_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	docInfo, err = db.DocumentInfoById("large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := db.OpenDocumentReader(docInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadAll(r)
+	if !errors.Is(err, ErrChunkBadCRC) || !errors.Is(err, ErrCorrupt) {
+		t.Errorf("expected bad crc, got %v", err)
+	}
+	var corruptErr *CorruptError
+	if !errors.As(err, &corruptErr) || corruptErr.Offset != int64(docInfo.bodyPosition) || corruptErr.ChunkType != CHUNK_TYPE_DATA {
+		t.Errorf("expected corruption of the data chunk at %d, got %v", docInfo.bodyPosition, err)
+	}
+}
+
+func TestStreamChecksBodyPosition(t *testing.T) {
+	defer os.Remove("test.couch")
+	db, err := Open("test.couch", OPEN_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.SaveDocumentFromReader(&DocumentInfo{ID: "large", Rev: 1}, bytes.NewReader(largeBody(10000)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	docInfo, err := db.DocumentInfoById("large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// a document without a body
+	db, err = Open("test.couch", OPEN_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.OpenDocumentReader(&DocumentInfo{ID: "large", Rev: 1})
+	if err != ErrNotFound {
+		t.Errorf("expected ErrNotFound without a body, got %v", err)
+	}
+	db.Close()
+
+	// a length reaching past the end of the file
+	f, err := os.OpenFile("test.couch", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, int64(docInfo.bodyPosition))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	db, err = Open("test.couch", OPEN_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, err = db.OpenDocumentReader(docInfo)
+	var corruptErr *CorruptError
+	if !errors.As(err, &corruptErr) || corruptErr.Err != ErrChunkDataLessThanSize || corruptErr.Offset != int64(docInfo.bodyPosition) {
+		t.Errorf("expected the data chunk at %d to be corrupt, got %v", docInfo.bodyPosition, err)
+	}
+}
+
+func TestIDTooLarge(t *testing.T) {
+	defer os.Remove("test.couch")
+	db, err := Open("test.couch", OPEN_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	longID := strings.Repeat("a", gs_MAX_ID_LENGTH+1)
+	err = db.SaveDocument(&Document{ID: longID, Body: []byte(`{}`)}, &DocumentInfo{ID: longID, Rev: 1})
+	if err != ErrKeyTooLarge {
+		t.Errorf("expected id too large, got %v", err)
+	}
+	err = db.SaveDocumentFromReader(&DocumentInfo{ID: longID, Rev: 1}, strings.NewReader(`{}`))
+	if err != ErrKeyTooLarge {
+		t.Errorf("expected id too large, got %v", err)
+	}
+	err = db.SaveLocalDocument(&LocalDocument{ID: longID, Body: []byte(`{}`)})
+	if err != ErrKeyTooLarge {
+		t.Errorf("expected id too large, got %v", err)
+	}
+
+	maxID := longID[:gs_MAX_ID_LENGTH]
+	err = db.SaveDocument(&Document{ID: maxID, Body: []byte(`{}`)}, &DocumentInfo{ID: maxID, Rev: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	docInfo, err := db.DocumentInfoById(maxID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if docInfo.ID != maxID {
+		t.Errorf("expected the longest id to round trip")
+	}
+}
+
+func TestIDTooLargeForExpiryIndex(t *testing.T) {
+	defer os.Remove("test.couch")
+	db, err := Open("test.couch", OPEN_CREATE|OPEN_EXPIRY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	id := strings.Repeat("a", gs_MAX_ID_LENGTH)
+	err = db.SaveDocument(&Document{ID: id, Body: []byte(`{}`)}, &DocumentInfo{ID: id, Rev: 1})
+	if err != ErrKeyTooLarge {
+		t.Errorf("expected id too large, got %v", err)
+	}
+}
+
+func TestChunkDiskSize(t *testing.T) {
+	tests := []struct {
+		pos  int64
+		size int64
+		disk int64
+	}{
+		{1, 0, 8},
+		{1, 100, 108},
+		{4096, 100, 109},
+		{4000, 100, 109},
+		{1, 2 * 4095, 2*4095 + 8 + 2},
+	}
+	for _, test := range tests {
+		disk := chunkDiskSize(test.pos, test.size)
+		if disk != test.disk {
+			t.Errorf("expected %d bytes at %d for %d, got %d", test.disk, test.pos, test.size, disk)
+		}
+	}
+
+	defer os.Remove("test.couch")
+	db, err := Open("test.couch", OPEN_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, size := range []int{0, 100, 4000, 5000, 70000} {
+		docInfo := &DocumentInfo{ID: "doc", Rev: 1}
+		pos := db.pos
+		err = db.SaveDocument(&Document{ID: "doc", Body: largeBody(size)}, docInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		docInfo, err = db.DocumentInfoById("doc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(docInfo.Size) != chunkDiskSize(pos, int64(size)) {
+			t.Errorf("expected size %d for %d bytes, got %d", chunkDiskSize(pos, int64(size)), size, docInfo.Size)
+		}
+	}
+}
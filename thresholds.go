@@ -0,0 +1,111 @@
+//  Copyright (c) 2014 Marty Schoch
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package gouchstore
+
+import (
+	"encoding/json"
+)
+
+const gs_DB_CHUNK_THRESHOLD int = 1279
+
+// The thresholds a file was written with are stored in a local document,
+// so that they survive reopening and compaction.
+const gs_THRESHOLDS_DOC_ID = "_local/gouchstore-thresholds"
+
+// ChunkThresholds are the sizes in bytes at which the leaf (KV) and
+// interior (KP) nodes of a btree are split.  Larger nodes mean fewer levels
+// to read on lookup, but more bytes rewritten for every update.
+type ChunkThresholds struct {
+	KV int `json:"kv"`
+	KP int `json:"kp"`
+}
+
+func (c ChunkThresholds) valid() bool {
+	return c.KV >= 0 && c.KP >= 0
+}
+
+// or fills in the thresholds which are not set from other.
+func (c ChunkThresholds) or(other ChunkThresholds) ChunkThresholds {
+	if c.KV == 0 {
+		c.KV = other.KV
+	}
+	if c.KP == 0 {
+		c.KP = other.KP
+	}
+	return c
+}
+
+// treeThresholds holds the thresholds of each of the trees in a file.
+type treeThresholds struct {
+	ById  ChunkThresholds `json:"byId"`
+	BySeq ChunkThresholds `json:"bySeq"`
+	Local ChunkThresholds `json:"local"`
+}
+
+func (t treeThresholds) or(other treeThresholds) treeThresholds {
+	return treeThresholds{
+		ById:  t.ById.or(other.ById),
+		BySeq: t.BySeq.or(other.BySeq),
+		Local: t.Local.or(other.Local),
+	}
+}
+
+func uniformThresholds(threshold int) treeThresholds {
+	c := ChunkThresholds{KV: threshold, KP: threshold}
+	return treeThresholds{ById: c, BySeq: c, Local: c}
+}
+
+// loadThresholds settles the thresholds used by this handle, those given
+// when opening take precedence over those recorded in the file, anything
+// left unset uses the default.
+func (g *Gouchstore) loadThresholds() error {
+	var recorded treeThresholds
+	localDoc, err := g.LocalDocumentById(gs_THRESHOLDS_DOC_ID)
+	if err == nil {
+		err = json.Unmarshal(localDoc.Body, &recorded)
+		if err != nil {
+			return ErrCorrupt
+		}
+	} else if err != ErrNotFound {
+		return err
+	}
+
+	requested := treeThresholds{
+		ById:  g.options.IdTreeThresholds,
+		BySeq: g.options.SeqTreeThresholds,
+		Local: g.options.LocalTreeThresholds,
+	}.or(uniformThresholds(g.options.ChunkThreshold))
+	g.thresholds = requested.or(recorded).or(uniformThresholds(gs_DB_CHUNK_THRESHOLD))
+
+	if err == ErrNotFound {
+		g.thresholdsDirty = g.thresholds != uniformThresholds(gs_DB_CHUNK_THRESHOLD)
+	} else {
+		g.thresholdsDirty = g.thresholds != recorded
+	}
+	return nil
+}
+
+// saveThresholds records the thresholds in their local document if they
+// changed, it must be called before the header is written.
+func (g *Gouchstore) saveThresholds() error {
+	if !g.thresholdsDirty {
+		return nil
+	}
+	body, err := json.Marshal(g.thresholds)
+	if err != nil {
+		return err
+	}
+	err = g.SaveLocalDocument(&LocalDocument{ID: gs_THRESHOLDS_DOC_ID, Body: body})
+	if err != nil {
+		return err
+	}
+	g.thresholdsDirty = false
+	return nil
+}
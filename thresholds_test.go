@@ -0,0 +1,199 @@
+//  Copyright (c) 2014 Marty Schoch
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package gouchstore
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func saveNumberedDocs(db *Gouchstore, start, count int) error {
+	docs := make([]*Document, count)
+	docInfos := make([]*DocumentInfo, count)
+	for i := range docs {
+		id := fmt.Sprintf("doc-%08d", start+i)
+		docs[i] = &Document{ID: id, Body: []byte(`{"abc":123}`)}
+		docInfos[i] = NewDocumentInfo(id)
+		docInfos[i].Rev = 1
+	}
+	err := db.SaveDocuments(docs, docInfos)
+	if err != nil {
+		return err
+	}
+	return db.Commit()
+}
+
+func TestChunkThresholdsRecorded(t *testing.T) {
+	defer os.Remove("test.couch")
+	defer os.Remove("test-compacted.couch")
+
+	expected := treeThresholds{
+		ById:  ChunkThresholds{KV: 200, KP: 300},
+		BySeq: ChunkThresholds{KV: 4000, KP: 4000},
+		Local: ChunkThresholds{KV: 100, KP: gs_DB_CHUNK_THRESHOLD},
+	}
+	db, err := OpenWithOptions("test.couch", &Options{
+		Create:              true,
+		ChunkThreshold:      4000,
+		IdTreeThresholds:    expected.ById,
+		LocalTreeThresholds: ChunkThresholds{KV: 100, KP: gs_DB_CHUNK_THRESHOLD},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.thresholds != expected {
+		t.Errorf("expected thresholds %v, got %v", expected, db.thresholds)
+	}
+	err = saveNumberedDocs(db, 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// reopened without options, the recorded thresholds are used
+	db, err = Open("test.couch", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.thresholds != expected {
+		t.Errorf("expected recorded thresholds %v, got %v", expected, db.thresholds)
+	}
+	err = db.Compact("test-compacted.couch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db, err = Open("test-compacted.couch", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.thresholds != expected {
+		t.Errorf("expected compaction to keep thresholds %v, got %v", expected, db.thresholds)
+	}
+	db.Close()
+
+	// options given when opening replace what was recorded
+	db, err = OpenWithOptions("test.couch", &Options{SeqTreeThresholds: ChunkThresholds{KV: 500}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected.BySeq.KV = 500
+	if db.thresholds != expected {
+		t.Errorf("expected thresholds %v, got %v", expected, db.thresholds)
+	}
+	err = saveNumberedDocs(db, 100, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db, err = Open("test.couch", OPEN_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if db.thresholds != expected {
+		t.Errorf("expected thresholds %v, got %v", expected, db.thresholds)
+	}
+	dbInfo, err := db.DatabaseInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dbInfo.DocumentCount != 110 {
+		t.Errorf("expected 110 documents, got %d", dbInfo.DocumentCount)
+	}
+}
+
+func TestDefaultChunkThresholdsNotRecorded(t *testing.T) {
+	defer os.Remove("test.couch")
+	db, err := Open("test.couch", OPEN_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = saveNumberedDocs(db, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.LocalDocumentById(gs_THRESHOLDS_DOC_ID)
+	if err != ErrNotFound {
+		t.Errorf("expected no thresholds document for the defaults, got %v", err)
+	}
+}
+
+var benchmarkThresholds = []int{256, 1279, 4096, 16384}
+
+// BenchmarkThresholdWrite reports how many bytes are appended to the file
+// for each document saved, in batches of 10, at different thresholds.
+func BenchmarkThresholdWrite(b *testing.B) {
+	for _, threshold := range benchmarkThresholds {
+		b.Run(fmt.Sprintf("threshold-%d", threshold), func(b *testing.B) {
+			defer os.Remove("bench.couch")
+			db, err := OpenWithOptions("bench.couch", &Options{Create: true, Durability: DURABILITY_NONE, ChunkThreshold: threshold})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+			err = saveNumberedDocs(db, 0, 10000)
+			if err != nil {
+				b.Fatal(err)
+			}
+			startPos := db.pos
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				err = saveNumberedDocs(db, (i*7919)%10000, 10)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(db.pos-startPos)/float64(b.N*10), "bytes/doc")
+		})
+	}
+}
+
+// BenchmarkThresholdLookup reports the number of nodes read per lookup at
+// different thresholds.
+func BenchmarkThresholdLookup(b *testing.B) {
+	for _, threshold := range benchmarkThresholds {
+		b.Run(fmt.Sprintf("threshold-%d", threshold), func(b *testing.B) {
+			defer os.Remove("bench.couch")
+			db, err := OpenWithOptions("bench.couch", &Options{Create: true, Durability: DURABILITY_NONE, ChunkThreshold: threshold})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+			err = saveNumberedDocs(db, 0, 10000)
+			if err != nil {
+				b.Fatal(err)
+			}
+			nodes := 0
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				id := fmt.Sprintf("doc-%08d", (i*7919)%10000)
+				err = db.WalkIdTree(id, id, func(g *Gouchstore, depth int, documentInfo *DocumentInfo, key []byte, subTreeSize uint64, reducedValue []byte, userContext interface{}) error {
+					if documentInfo == nil {
+						nodes++
+					}
+					return nil
+				}, nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+				_, err = db.DocumentInfoById(id)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(nodes)/float64(b.N), "nodes/lookup")
+		})
+	}
+}
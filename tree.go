@@ -18,6 +18,10 @@ type lookupContext struct {
 	indexType            int
 	depth                int
 	callbackContext      interface{}
+	// includeExpired passes on documents which have expired, which are
+	// otherwise hidden when the expiry index is on
+	includeExpired bool
+	now            uint32
 }
 
 type lookupRequest struct {
@@ -29,12 +33,20 @@ type lookupRequest struct {
 	fetchCallback   callback
 	nodeCallback    callback
 	callbackContext interface{}
+	// readNode, if not nil, is used instead of readNodeAt
+	readNode func(pos int64) ([]byte, error)
 }
 
 type callback func(req *lookupRequest, key []byte, value []byte) error
 
 func (g *Gouchstore) btreeLookupInner(req *lookupRequest, diskPos uint64, current, end int) error {
-	nodeData, err := g.readCompressedDataChunkAt(int64(diskPos))
+	var nodeData []byte
+	var err error
+	if req.readNode != nil {
+		nodeData, err = req.readNode(int64(diskPos))
+	} else {
+		nodeData, err = g.readNodeAt(int64(diskPos))
+	}
 	if err != nil {
 		return err
 	}
@@ -58,11 +70,14 @@ func (g *Gouchstore) btreeLookupInner(req *lookupRequest, diskPos uint64, curren
 				if req.nodeCallback != nil {
 					err = req.nodeCallback(req, k, v)
 					if err != nil {
-						return err
+						return corruptNode(int64(diskPos), err)
 					}
 				}
 
-				valNodePointer := decodeNodePointer(v)
+				valNodePointer, err := decodeNodePointer(v)
+				if err != nil {
+					return corruptNode(int64(diskPos), err)
+				}
 				err = g.btreeLookupInner(req, valNodePointer.pointer, current, lastItem)
 				if err != nil {
 					return err
@@ -74,11 +89,14 @@ func (g *Gouchstore) btreeLookupInner(req *lookupRequest, diskPos uint64, curren
 				if req.nodeCallback != nil {
 					err = req.nodeCallback(req, nil, nil)
 					if err != nil {
-						return err
+						return corruptNode(int64(diskPos), err)
 					}
 				}
 			}
 		}
+		if kvIterator.Err() != nil {
+			return corruptNode(int64(diskPos), kvIterator.Err())
+		}
 	} else if nodeData[0] == gs_BTREE_LEAF {
 		kvIterator := newKeyValueIterator(nodeData[1:])
 		for k, v := kvIterator.Next(); k != nil && current < end; k, v = kvIterator.Next() {
@@ -96,7 +114,7 @@ func (g *Gouchstore) btreeLookupInner(req *lookupRequest, diskPos uint64, curren
 				// Found
 				err = req.fetchCallback(req, k, v)
 				if err != nil {
-					return err
+					return corruptNode(int64(diskPos), err)
 				}
 
 				if !req.inFold {
@@ -104,11 +122,19 @@ func (g *Gouchstore) btreeLookupInner(req *lookupRequest, diskPos uint64, curren
 				}
 			}
 		}
+		if kvIterator.Err() != nil {
+			return corruptNode(int64(diskPos), kvIterator.Err())
+		}
+	} else {
+		return corruptAt(int64(diskPos), CHUNK_TYPE_NODE, ErrBadNodeType)
 	}
 
 	//Any remaining items are not found.
 	for current < end && !req.fold {
 		err = req.fetchCallback(req, req.keys[current], nil)
+		if err != nil {
+			return err
+		}
 		current++
 	}
 
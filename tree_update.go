@@ -15,9 +15,7 @@ import (
 	"sort"
 )
 
-const gs_DB_CHUNK_THRESHOLD int = 1279
-
-type btreeFetchCallback func(req *modifyRequest, k []byte, v []byte, context interface{})
+type btreeFetchCallback func(req *modifyRequest, k []byte, v []byte, context interface{}) error
 type btreePurgeKPFunc func(np *nodePointer, context interface{}) int
 type btreePurgeKVFunc func(key, val []byte, context interface{}) int
 
@@ -29,11 +27,13 @@ type nodeList struct {
 }
 
 type indexUpdateContext struct {
-	seqacts []modifyAction
-	actpos  int
-	seqs    [][]byte
-	seqvals [][]byte
-	valpos  int
+	seqacts    []modifyAction
+	actpos     int
+	seqs       [][]byte
+	seqvals    [][]byte
+	valpos     int
+	expiry     bool
+	expiryacts []modifyAction
 }
 
 const (
@@ -98,7 +98,7 @@ func (g *Gouchstore) addDocToUpdateList(doc *Document, docInfo *DocumentInfo, se
 	if doc != nil {
 		var diskSize uint64
 
-		err := g.writeDoc(doc, &updated.bodyPosition, &diskSize, docInfo.compressed())
+		err := g.writeDoc(doc, &updated.bodyPosition, &diskSize, docInfo.Compressed())
 		if err != nil {
 			return nil, nil, nil, nil, err
 		}
@@ -118,13 +118,14 @@ func (g *Gouchstore) addDocToUpdateList(doc *Document, docInfo *DocumentInfo, se
 }
 
 func (g *Gouchstore) writeDoc(doc *Document, bp *uint64, diskSize *uint64, compress bool) error {
-	var err error
-	var pos, size int64
+	body := doc.Body
 	if compress {
-		pos, size, err = g.writeCompressedChunk(doc.Body)
-	} else {
-		pos, size, err = g.writeChunk(doc.Body, false)
+		body = g.codec.Encode(nil, body)
 	}
+	if chunkDiskSize(g.pos, int64(len(body))) > gs_MAX_DOC_DISK_SIZE {
+		return ErrDocumentTooLarge
+	}
+	pos, size, err := g.writeChunk(body, false)
 	if err != nil {
 		return err
 	}
@@ -137,20 +138,31 @@ func (g *Gouchstore) writeDoc(doc *Document, bp *uint64, diskSize *uint64, compr
 	return nil
 }
 
-func idFetchUpdate(req *modifyRequest, k []byte, v []byte, context interface{}) {
+func idFetchUpdate(req *modifyRequest, k []byte, v []byte, context interface{}) error {
 	indexUpdateContext := context.(*indexUpdateContext)
 	if v == nil {
-		return // doc not found
+		return nil // doc not found
 	}
 
 	raw := DocumentInfo{}
-	decodeByIdValue(&raw, v)
+	err := decodeByIdValue(&raw, v)
+	if err != nil {
+		return err
+	}
 	oldseq := raw.Seq
 
 	indexUpdateContext.seqacts[indexUpdateContext.actpos].typ = gs_ACTION_REMOVE
 	indexUpdateContext.seqacts[indexUpdateContext.actpos].value = nil
 	indexUpdateContext.seqacts[indexUpdateContext.actpos].key = encode_raw48(oldseq)
 	indexUpdateContext.actpos++
+
+	if indexUpdateContext.expiry && !raw.Deleted && raw.Expiry() != 0 {
+		indexUpdateContext.expiryacts = append(indexUpdateContext.expiryacts, modifyAction{
+			typ: gs_ACTION_REMOVE,
+			key: expiryKey(raw.Expiry(), k),
+		})
+	}
+	return nil
 }
 
 func (g *Gouchstore) updateIndexes(seqs, seqvals, ids, idvals [][]byte) error {
@@ -166,6 +178,7 @@ func (g *Gouchstore) updateIndexes(seqs, seqvals, ids, idvals [][]byte) error {
 	fetcharg.seqs = seqs
 	fetcharg.seqvals = seqvals
 	fetcharg.valpos = 0
+	fetcharg.expiry = g.expiry
 
 	// sort the ids
 	sortedIds := idAndValueList{
@@ -185,15 +198,14 @@ func (g *Gouchstore) updateIndexes(seqs, seqvals, ids, idvals [][]byte) error {
 
 	idrq.cmp = gouchstoreIdComparator
 	idrq.actions = idacts
-	idrq.reduce = byIdReduce
-	idrq.rereduce = byIdReReduce
+	idrq.reduce, idrq.rereduce = g.byIdReducers()
 	idrq.fetchCallback = idFetchUpdate
 	idrq.compacting = false
 	idrq.enablePurging = false
 	idrq.purgeKP = nil
 	idrq.purgeKV = nil
-	idrq.kpChunkThreshold = gs_DB_CHUNK_THRESHOLD
-	idrq.kvChunkThreshold = gs_DB_CHUNK_THRESHOLD
+	idrq.kpChunkThreshold = g.thresholds.ById.KP
+	idrq.kvChunkThreshold = g.thresholds.ById.KV
 
 	newIdRoot, err := g.modifyBtree(&idrq, g.header.byIdRoot)
 	if err != nil {
@@ -223,8 +235,8 @@ func (g *Gouchstore) updateIndexes(seqs, seqvals, ids, idvals [][]byte) error {
 	seqrq.enablePurging = false
 	seqrq.purgeKP = nil
 	seqrq.purgeKV = nil
-	seqrq.kpChunkThreshold = gs_DB_CHUNK_THRESHOLD
-	seqrq.kvChunkThreshold = gs_DB_CHUNK_THRESHOLD
+	seqrq.kpChunkThreshold = g.thresholds.BySeq.KP
+	seqrq.kvChunkThreshold = g.thresholds.BySeq.KV
 
 	newSeqRoot, err := g.modifyBtree(&seqrq, g.header.bySeqRoot)
 	if err != nil {
@@ -239,6 +251,13 @@ func (g *Gouchstore) updateIndexes(seqs, seqvals, ids, idvals [][]byte) error {
 		g.header.bySeqRoot = newSeqRoot
 	}
 
+	if g.expiry {
+		err = g.updateExpiryIndex(fetcharg.expiryacts, ids, idvals)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -290,7 +309,7 @@ func (g *Gouchstore) modifyNode(req *modifyRequest, np *nodePointer, start, end
 	}
 
 	if np != nil {
-		nodebuf, err = g.readCompressedDataChunkAt(int64(np.pointer))
+		nodebuf, err = g.readNodeAt(int64(np.pointer))
 		if err != nil {
 			return err
 		}
@@ -307,7 +326,10 @@ func (g *Gouchstore) modifyNode(req *modifyRequest, np *nodePointer, start, end
 		localResult.nodeType = gs_KV_NODE
 		for bufpos < nodebuflen {
 			var cmpKey, valBuf []byte
-			cmpKey, valBuf, bufpos = decodeKeyValue(nodebuf, bufpos)
+			cmpKey, valBuf, bufpos, err = decodeKeyValue(nodebuf, bufpos)
+			if err != nil {
+				return corruptNode(int64(np.pointer), err)
+			}
 			advance := false
 			for !advance && start < end {
 				advance = true
@@ -328,7 +350,10 @@ func (g *Gouchstore) modifyNode(req *modifyRequest, np *nodePointer, start, end
 					case gs_ACTION_FETCH:
 						if req.fetchCallback != nil {
 							// not found
-							req.fetchCallback(req, req.actions[start].key, nil, req.actions[start].arg)
+							err = req.fetchCallback(req, req.actions[start].key, nil, req.actions[start].arg)
+							if err != nil {
+								return err
+							}
 						}
 					}
 					start++
@@ -344,7 +369,10 @@ func (g *Gouchstore) modifyNode(req *modifyRequest, np *nodePointer, start, end
 						localResult.modified = true
 					case gs_ACTION_FETCH:
 						if req.fetchCallback != nil {
-							req.fetchCallback(req, req.actions[start].key, valBuf, req.actions[start].arg)
+							err = req.fetchCallback(req, req.actions[start].key, valBuf, req.actions[start].arg)
+							if err != nil {
+								return corruptNode(int64(np.pointer), err)
+							}
 						}
 						// Do next action on same item in the node, as our action was a fetch
 						// and there may be an equivalent insert or remove
@@ -373,7 +401,10 @@ func (g *Gouchstore) modifyNode(req *modifyRequest, np *nodePointer, start, end
 			case gs_ACTION_FETCH:
 				if req.fetchCallback != nil {
 					// not found
-					req.fetchCallback(req, req.actions[start].key, nil, req.actions[start].arg)
+					err = req.fetchCallback(req, req.actions[start].key, nil, req.actions[start].arg)
+					if err != nil {
+						return err
+					}
 				}
 			}
 			start++
@@ -382,17 +413,23 @@ func (g *Gouchstore) modifyNode(req *modifyRequest, np *nodePointer, start, end
 		localResult.nodeType = gs_KP_NODE
 		for bufpos < nodebuflen && start < end {
 			var cmpKey, valBuf []byte
-			cmpKey, valBuf, bufpos = decodeKeyValue(nodebuf, bufpos)
+			cmpKey, valBuf, bufpos, err = decodeKeyValue(nodebuf, bufpos)
+			if err != nil {
+				return corruptNode(int64(np.pointer), err)
+			}
 			cmpVal := req.cmp(cmpKey, req.actions[start].key)
 			if bufpos == nodebuflen {
 				// We're at the last item in the kpnode, must apply all our
 				// actions here.
-				desc := decodeNodePointer(valBuf)
+				desc, err := decodeNodePointer(valBuf)
+				if err != nil {
+					return corruptNode(int64(np.pointer), err)
+				}
 				desc.key = cmpKey
 
 				err = g.modifyNode(req, desc, start, end, localResult)
 				if err != nil {
-					return nil
+					return err
 				}
 				break
 			}
@@ -400,10 +437,13 @@ func (g *Gouchstore) modifyNode(req *modifyRequest, np *nodePointer, start, end
 			if cmpVal < 0 {
 				// Key in node item less than action item and not at end
 				// position, so just add it and continue.
-				add := decodeNodePointer(valBuf)
+				add, err := decodeNodePointer(valBuf)
+				if err != nil {
+					return corruptNode(int64(np.pointer), err)
+				}
 				add.key = cmpKey
 
-				err := g.maybePurgeKP(req, add, localResult)
+				err = g.maybePurgeKP(req, add, localResult)
 				if err != nil {
 					return err
 				}
@@ -416,10 +456,13 @@ func (g *Gouchstore) modifyNode(req *modifyRequest, np *nodePointer, start, end
 					rangeEnd++
 				}
 
-				desc := decodeNodePointer(valBuf)
+				desc, err := decodeNodePointer(valBuf)
+				if err != nil {
+					return corruptNode(int64(np.pointer), err)
+				}
 				desc.key = cmpKey
 
-				err := g.modifyNode(req, desc, start, rangeEnd, localResult)
+				err = g.modifyNode(req, desc, start, rangeEnd, localResult)
 				start = rangeEnd
 				if err != nil {
 					return err
@@ -428,17 +471,23 @@ func (g *Gouchstore) modifyNode(req *modifyRequest, np *nodePointer, start, end
 		}
 		for bufpos < nodebuflen {
 			var cmpKey, valBuf []byte
-			cmpKey, valBuf, bufpos = decodeKeyValue(nodebuf, bufpos)
-			add := decodeNodePointer(valBuf)
+			cmpKey, valBuf, bufpos, err = decodeKeyValue(nodebuf, bufpos)
+			if err != nil {
+				return corruptNode(int64(np.pointer), err)
+			}
+			add, err := decodeNodePointer(valBuf)
+			if err != nil {
+				return corruptNode(int64(np.pointer), err)
+			}
 			add.key = cmpKey
 
-			err := g.maybePurgeKP(req, add, localResult)
+			err = g.maybePurgeKP(req, add, localResult)
 			if err != nil {
 				return err
 			}
 		}
 	} else {
-		return gs_ERROR_CORRUPT
+		return corruptAt(int64(np.pointer), CHUNK_TYPE_NODE, ErrBadNodeType)
 	}
 	val = localResult.values
 	for val != nil {
@@ -736,7 +785,7 @@ func (g *Gouchstore) purgeNode(req *modifyRequest, np *nodePointer, dst *modifyR
 		return g.mrPushPointerInfo(np, dst)
 	}
 
-	nodebuf, err = g.readCompressedDataChunkAt(int64(np.pointer))
+	nodebuf, err = g.readNodeAt(int64(np.pointer))
 	if err != nil {
 		return err
 	}
@@ -747,7 +796,10 @@ func (g *Gouchstore) purgeNode(req *modifyRequest, np *nodePointer, dst *modifyR
 		localResult.nodeType = gs_KV_NODE
 		for bufpos < nodebuflen {
 			var cmpKey, valBuf []byte
-			cmpKey, valBuf, bufpos = decodeKeyValue(nodebuf, bufpos)
+			cmpKey, valBuf, bufpos, err = decodeKeyValue(nodebuf, bufpos)
+			if err != nil {
+				return corruptNode(int64(np.pointer), err)
+			}
 			err = g.maybePurgeKV(req, cmpKey, valBuf, localResult)
 			if err != nil {
 				return err
@@ -757,10 +809,16 @@ func (g *Gouchstore) purgeNode(req *modifyRequest, np *nodePointer, dst *modifyR
 	} else if nodebuf[0] == 0 { //KP Node
 		localResult.nodeType = gs_KP_NODE
 		for bufpos < nodebuflen {
-			cmpKey, valBuf, posOffset := decodeKeyValue(nodebuf, bufpos)
-			bufpos += posOffset
+			var cmpKey, valBuf []byte
+			cmpKey, valBuf, bufpos, err = decodeKeyValue(nodebuf, bufpos)
+			if err != nil {
+				return corruptNode(int64(np.pointer), err)
+			}
 
-			desc := decodeNodePointer(valBuf)
+			desc, err := decodeNodePointer(valBuf)
+			if err != nil {
+				return corruptNode(int64(np.pointer), err)
+			}
 			desc.key = cmpKey
 
 			err = g.maybePurgeKP(req, desc, localResult)
@@ -770,7 +828,7 @@ func (g *Gouchstore) purgeNode(req *modifyRequest, np *nodePointer, dst *modifyR
 		}
 
 	} else {
-		return gs_ERROR_CORRUPT
+		return corruptAt(int64(np.pointer), CHUNK_TYPE_NODE, ErrBadNodeType)
 	}
 
 	// Write out changes and add node back to parent
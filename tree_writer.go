@@ -56,11 +56,17 @@ func (imt *InMemoryTreeWriter) Sort() error {
 }
 
 func (imt *InMemoryTreeWriter) Write(db *Gouchstore) (*nodePointer, error) {
-	targetMr := newBtreeModifyResult(imt.keyCompare, imt.reduce, imt.rereduce, imt.reduceContext, gs_DB_CHUNK_THRESHOLD, gs_DB_CHUNK_THRESHOLD)
+	targetMr := newBtreeModifyResult(imt.keyCompare, imt.reduce, imt.rereduce, imt.reduceContext, db.thresholds.ById.KV, db.thresholds.ById.KP)
 
 	for i, key := range imt.keys {
+		if i > 0 && imt.keyCompare(imt.keys[i-1], key) == 0 {
+			return nil, ErrDuplicateID
+		}
 		value := imt.vals[i]
-		db.mrPushItem(key, value, targetMr)
+		err := db.mrPushItem(key, value, targetMr)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	newRoot, err := db.completeNewBtree(targetMr)
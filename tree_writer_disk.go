@@ -10,15 +10,14 @@
 package gouchstore
 
 import (
-	"bytes"
+	"bufio"
+	"io"
 	"io/ioutil"
 	"os"
-
-	"github.com/mschoch/mergesort"
 )
 
-// FIXME this isn't really MB right? its a count of items, not their size
-const ID_SORT_CHUNK_SIZE = (10 * 1024 * 1024) // 10MB. Make tuneable?
+// Deprecated: the sort is limited by SortConfig.MemoryBudget, in bytes.
+const ID_SORT_CHUNK_SIZE = (10 * 1024 * 1024)
 
 type OnDiskTreeWriter struct {
 	keyCompare       btreeKeyComparator
@@ -27,20 +26,30 @@ type OnDiskTreeWriter struct {
 	reduceContext    interface{}
 	unsortedFilePath string
 	file             *os.File
+	w                *bufio.Writer
+	sortConfig       SortConfig
+	sorter           *externalSorter // holds the sorted items, after Sort
 }
 
 func NewOnDiskTreeWriter(unsortedFilePath string, keyCompare btreeKeyComparator, reduce, rereduce reduceFunc, reduceContext interface{}) (*OnDiskTreeWriter, error) {
+	return newOnDiskTreeWriter(SortConfig{}, unsortedFilePath, keyCompare, reduce, rereduce, reduceContext)
+}
+
+// newOnDiskTreeWriter creates the temporary file in sortConfig.TempDir, when
+// no unsortedFilePath is given.
+func newOnDiskTreeWriter(sortConfig SortConfig, unsortedFilePath string, keyCompare btreeKeyComparator, reduce, rereduce reduceFunc, reduceContext interface{}) (*OnDiskTreeWriter, error) {
 	rv := OnDiskTreeWriter{
 		unsortedFilePath: unsortedFilePath,
 		keyCompare:       keyCompare,
 		reduce:           reduce,
 		rereduce:         rereduce,
 		reduceContext:    reduceContext,
+		sortConfig:       sortConfig,
 	}
 
 	var err error
 	if unsortedFilePath == "" {
-		rv.file, err = ioutil.TempFile("", "tw")
+		rv.file, err = ioutil.TempFile(sortConfig.TempDir, "tw")
 		if err != nil {
 			return nil, err
 		}
@@ -55,109 +64,110 @@ func NewOnDiskTreeWriter(unsortedFilePath string, keyCompare btreeKeyComparator,
 			return nil, err
 		}
 	}
+	rv.w = bufio.NewWriterSize(rv.file, gs_SORT_BUFFER_SIZE)
 
 	return &rv, nil
 }
 
 func (imt *OnDiskTreeWriter) AddItem(key, value []byte) error {
-	buffer := new(bytes.Buffer)
-	buffer.Write(encode_raw16(uint16(len(key))))
-	buffer.Write(encode_raw32(uint32(len(value))))
-	buffer.Write(key)
-	buffer.Write(value)
-	_, err := imt.file.Write(buffer.Bytes())
-	return err
-}
-
-func (imt *OnDiskTreeWriter) Sort() error {
-	// rewind to beginning
-	imt.file.Seek(0, os.SEEK_SET)
-	// sort it
-	err := mergesort.MergeSort(imt.file, imt.file, readRecord, writeRecord, compareRecords, imt, ID_SORT_CHUNK_SIZE)
+	buf := make([]byte, 0, 6+len(key)+len(value))
+	buf = append(buf, encode_raw16(uint16(len(key)))...)
+	buf = append(buf, encode_raw32(uint32(len(value)))...)
+	buf = append(buf, key...)
+	buf = append(buf, value...)
+	_, err := imt.w.Write(buf)
 	return err
 }
 
-func (imt *OnDiskTreeWriter) Write(db *Gouchstore) (*nodePointer, error) {
-	targetMr := newBtreeModifyResult(imt.keyCompare, imt.reduce, imt.rereduce, imt.reduceContext, gs_DB_CHUNK_THRESHOLD, gs_DB_CHUNK_THRESHOLD)
-
-	// rewind to beginning
-	imt.file.Seek(0, os.SEEK_SET)
-	rec, err := readRecord(imt.file, nil)
-	for err == nil {
-		sr := rec.(sortRecord)
-		db.mrPushItem(sr.key, sr.val, targetMr)
-		rec, err = readRecord(imt.file, nil)
-	}
-
-	newRoot, err := db.completeNewBtree(targetMr)
+// rewind flushes the items added and moves back to the first.
+func (imt *OnDiskTreeWriter) rewind() error {
+	err := imt.w.Flush()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return newRoot, nil
+	_, err = imt.file.Seek(0, os.SEEK_SET)
+	return err
 }
 
-func (imt *OnDiskTreeWriter) Close() error {
-	err := imt.file.Close()
+// Sort sorts the items into runs with an external merge sort, using no more
+// memory than the configured budget.  Write merges the runs as it goes, the
+// file itself is left unsorted.
+func (imt *OnDiskTreeWriter) Sort() error {
+	err := imt.rewind()
 	if err != nil {
 		return err
 	}
-	if imt.unsortedFilePath == "" {
-		// if this was a tmp file, remove it, otherwise it is callers responsibility
-		err = os.Remove(imt.file.Name())
+	if imt.sorter != nil {
+		imt.sorter.close()
 	}
-	return err
+	imt.sorter = newExternalSorter(imt.keyCompare, imt.sortConfig)
+	return imt.sorter.split(imt.file)
 }
 
-type sortRecord struct {
-	klen uint16
-	vlen uint32
-	key  []byte
-	val  []byte
-}
+func (imt *OnDiskTreeWriter) Write(db *Gouchstore) (*nodePointer, error) {
+	targetMr := newBtreeModifyResult(imt.keyCompare, imt.reduce, imt.rereduce, imt.reduceContext, db.thresholds.ById.KV, db.thresholds.ById.KP)
 
-func readRecord(file *os.File, context interface{}) (interface{}, error) {
-	klenBytes := make([]byte, 2)
-	_, err := file.Read(klenBytes)
-	if err != nil {
-		return nil, err
+	var prev []byte
+	push := func(rec sortRecord) error {
+		if prev != nil && imt.keyCompare(prev, rec.key) == 0 {
+			return ErrDuplicateID
+		}
+		prev = rec.key
+		return db.mrPushItem(rec.key, rec.val, targetMr)
+	}
+	var err error
+	if imt.sorter != nil {
+		err = imt.sorter.each(push)
+	} else {
+		// not sorted, the items are written in the order added
+		err = imt.each(push)
 	}
-	vlenBytes := make([]byte, 4)
-	_, err = file.Read(vlenBytes)
 	if err != nil {
 		return nil, err
 	}
 
-	rv := sortRecord{}
-	rv.klen = decode_raw16(klenBytes)
-	rv.vlen = decode_raw32(vlenBytes)
-	rv.key = make([]byte, rv.klen)
-	rv.val = make([]byte, rv.vlen)
-
-	_, err = file.Read(rv.key)
+	newRoot, err := db.completeNewBtree(targetMr)
 	if err != nil {
 		return nil, err
 	}
-	_, err = file.Read(rv.val)
+	return newRoot, nil
+}
+
+func (imt *OnDiskTreeWriter) each(fn func(rec sortRecord) error) error {
+	err := imt.rewind()
 	if err != nil {
-		return nil, err
+		return err
+	}
+	in := bufio.NewReaderSize(imt.file, gs_SORT_BUFFER_SIZE)
+	rec, err := readSortRecord(in)
+	for err == nil {
+		err = fn(rec)
+		if err != nil {
+			return err
+		}
+		rec, err = readSortRecord(in)
+	}
+	if err != io.EOF {
+		return err
 	}
-	return rv, nil
+	return nil
 }
 
-func writeRecord(file *os.File, rec interface{}, context interface{}) error {
-	sr := rec.(sortRecord)
-	buffer := new(bytes.Buffer)
-	buffer.Write(encode_raw16(sr.klen))
-	buffer.Write(encode_raw32(sr.vlen))
-	buffer.Write(sr.key)
-	buffer.Write(sr.val)
-	_, err := file.Write(buffer.Bytes())
+func (imt *OnDiskTreeWriter) Close() error {
+	if imt.sorter != nil {
+		imt.sorter.close()
+	}
+	err := imt.w.Flush()
+	cerr := imt.file.Close()
+	if err == nil {
+		err = cerr
+	}
+	if imt.unsortedFilePath == "" {
+		// if this was a tmp file, remove it, otherwise it is callers responsibility
+		rerr := os.Remove(imt.file.Name())
+		if err == nil {
+			err = rerr
+		}
+	}
 	return err
 }
-
-func compareRecords(rec1, rec2 interface{}, context interface{}) int {
-	treeWriter := context.(*OnDiskTreeWriter)
-	r1 := rec1.(sortRecord)
-	r2 := rec2.(sortRecord)
-	return treeWriter.keyCompare(r1.key, r2.key)
-}
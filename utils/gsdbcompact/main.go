@@ -10,13 +10,29 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"os"
+	"strings"
 
 	"github.com/mschoch/gouchstore"
 )
 
 var memCompact = flag.Bool("memCompact", false, "perform compaction in memory")
+var timeout = flag.Duration("timeout", 0, "give up compacting after this long, 0 for no limit")
+var progress = flag.Bool("progress", true, "show a progress bar")
+
+const progressBarWidth = 40
+
+func printProgress(p gouchstore.CompactProgress) {
+	fraction := 1.0
+	if p.DocsTotal > 0 {
+		fraction = float64(p.DocsCopied) / float64(p.DocsTotal)
+	}
+	filled := int(fraction * progressBarWidth)
+	fmt.Fprintf(os.Stderr, "\r[%s%s] %3.0f%% %d/%d docs %.1f MB", strings.Repeat("=", filled), strings.Repeat(" ", progressBarWidth-filled), fraction*100, p.DocsCopied, p.DocsTotal, float64(p.BytesWritten)/(1024*1024))
+}
 
 func main() {
 
@@ -43,8 +59,24 @@ func main() {
 	}
 	defer db.Close()
 
-	err = db.Compact(flag.Arg(1))
-	if err != nil {
+	ctx := context.Background()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+	options := &gouchstore.CompactOptions{}
+	if *progress {
+		options.Progress = printProgress
+	}
+
+	err = db.CompactWithOptions(ctx, flag.Arg(1), options)
+	if *progress {
+		fmt.Fprintln(os.Stderr)
+	}
+	if err == context.DeadlineExceeded {
+		fmt.Printf("compaction did not finish within %v\n", *timeout)
+	} else if err != nil {
 		fmt.Println(err)
 	}
 }
@@ -0,0 +1,86 @@
+//  Copyright (c) 2014 Marty Schoch
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/mschoch/gouchstore"
+)
+
+var fromHeader = flag.Uint64("from", 0, "header position to read the first file at, 0 for the latest")
+var toHeader = flag.Uint64("to", 0, "header position to read the second file at, 0 for the latest")
+var bodies = flag.Bool("bodies", false, "also compare the bodies of documents with the same revision")
+var ranges = flag.Bool("ranges", false, "only print the ranges of ids which differ")
+
+func open(filename string, headerPosition uint64) (*gouchstore.Gouchstore, error) {
+	db, err := gouchstore.Open(filename, gouchstore.OPEN_RDONLY)
+	if err != nil || headerPosition == 0 {
+		return db, err
+	}
+	defer db.Close()
+	return db.Snapshot(headerPosition)
+}
+
+func main() {
+
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		fmt.Println("Must specify path to a gouchstore compatible file")
+		return
+	}
+	// with one file, compare two of its headers
+	other := flag.Arg(0)
+	if flag.NArg() > 1 {
+		other = flag.Arg(1)
+	}
+
+	a, err := open(flag.Arg(0), *fromHeader)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer a.Close()
+	b, err := open(other, *toHeader)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer b.Close()
+
+	if *ranges {
+		keyRanges, err := gouchstore.DiffRanges(a, b)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		for _, keyRange := range keyRanges {
+			fmt.Printf("%s - %s\n", keyRange.Start, keyRange.End)
+		}
+		return
+	}
+
+	err = gouchstore.DiffWithOptions(a, b, &gouchstore.DiffOptions{CompareBodies: *bodies}, func(diffType gouchstore.DiffType, before, after *gouchstore.DocumentInfo, userContext interface{}) error {
+		switch diffType {
+		case gouchstore.DIFF_ADDED:
+			fmt.Printf("added %s rev %d\n", after.ID, after.Rev)
+		case gouchstore.DIFF_REMOVED:
+			fmt.Printf("removed %s rev %d\n", before.ID, before.Rev)
+		case gouchstore.DIFF_CHANGED:
+			fmt.Printf("changed %s rev %d deleted %t -> rev %d deleted %t\n", before.ID, before.Rev, before.Deleted, after.Rev, after.Deleted)
+		}
+		return nil
+	}, nil)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
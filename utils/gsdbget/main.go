@@ -19,6 +19,7 @@ import (
 
 var printBody = flag.Bool("printBody", true, "only print the document body")
 var printInfo = flag.Bool("printInfo", true, "only print the document info")
+var excludeDeleted = flag.Bool("excludeDeleted", false, "report deleted documents as not found")
 
 func main() {
 
@@ -38,7 +39,11 @@ func main() {
 	}
 	defer db.Close()
 
-	docInfo, err := db.DocumentInfoById(flag.Args()[1])
+	options := &gouchstore.ScanOptions{}
+	if *excludeDeleted {
+		options.Deleted = gouchstore.DELETED_EXCLUDE
+	}
+	docInfo, err := db.DocumentInfoByIdWithOptions(flag.Args()[1], options)
 	if err != nil {
 		fmt.Println(err)
 		return
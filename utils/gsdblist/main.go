@@ -21,6 +21,16 @@ var startId = flag.String("startId", "", "the document ID to scan from")
 var endId = flag.String("endId", "", "the document ID to scan to")
 var startSeq = flag.Int("startSeq", -1, "the sequence number to scan from")
 var endSeq = flag.Int("endSeq", -1, "the sequence number to scan to")
+var prefix = flag.String("prefix", "", "only list document IDs starting with this prefix")
+var match = flag.String("match", "", "only list document IDs matching this pattern, such as user:*")
+var keysOnly = flag.Bool("keysOnly", false, "only list the document IDs")
+var deleted = flag.String("deleted", "include", "include, exclude or only list deleted documents")
+
+var deletedFilters = map[string]gouchstore.DeletedFilter{
+	"include": gouchstore.DELETED_INCLUDE,
+	"exclude": gouchstore.DELETED_EXCLUDE,
+	"only":    gouchstore.DELETED_ONLY,
+}
 
 func allDocumentsCallback(g *gouchstore.Gouchstore, docInfo *gouchstore.DocumentInfo, userContext interface{}) error {
 	bytes, err := json.MarshalIndent(docInfo, "", "  ")
@@ -33,6 +43,12 @@ func allDocumentsCallback(g *gouchstore.Gouchstore, docInfo *gouchstore.Document
 	return nil
 }
 
+func keysOnlyCallback(g *gouchstore.Gouchstore, id []byte, userContext interface{}) error {
+	userContext.(map[string]int)["count"]++
+	fmt.Println(string(id))
+	return nil
+}
+
 func main() {
 
 	flag.Parse()
@@ -41,6 +57,11 @@ func main() {
 		fmt.Println("Must specify path to a gouchstore compatible file")
 		return
 	}
+	deletedFilter, ok := deletedFilters[*deleted]
+	if !ok {
+		fmt.Println("-deleted must be one of include, exclude or only")
+		return
+	}
 	db, err := gouchstore.Open(flag.Args()[0], gouchstore.OPEN_RDONLY)
 	if err != nil {
 		fmt.Println(err)
@@ -49,19 +70,33 @@ func main() {
 	defer db.Close()
 
 	context := map[string]int{"count": 0}
+	options := &gouchstore.ScanOptions{
+		Prefix:  *prefix,
+		Match:   *match,
+		Deleted: deletedFilter,
+	}
 
 	// sequence mode
 	if *startSeq != -1 || *endSeq != -1 {
 		if *startSeq < 0 {
 			*startSeq = 0
 		}
-		db.ChangesSince(uint64(*startSeq), uint64(*endSeq), allDocumentsCallback, context)
+		err = db.ScanChanges(uint64(*startSeq), uint64(*endSeq), options, func(g *gouchstore.Gouchstore, docInfo *gouchstore.DocumentInfo, userContext interface{}) error {
+			if *keysOnly {
+				return keysOnlyCallback(g, []byte(docInfo.ID), userContext)
+			}
+			return allDocumentsCallback(g, docInfo, userContext)
+		}, context)
 		if err != nil {
 			fmt.Println(err)
 			return
 		}
 	} else { // id mode
-		err = db.AllDocuments(*startId, *endId, allDocumentsCallback, context)
+		if *keysOnly {
+			err = db.ScanKeys(*startId, *endId, options, keysOnlyCallback, context)
+		} else {
+			err = db.Scan(*startId, *endId, options, allDocumentsCallback, context)
+		}
 		if err != nil {
 			fmt.Println(err)
 			return
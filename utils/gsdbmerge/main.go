@@ -0,0 +1,51 @@
+//  Copyright (c) 2014 Marty Schoch
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/mschoch/gouchstore"
+)
+
+var tempDir = flag.String("tempDir", "", "directory for temporary sort files")
+var sortMemory = flag.Int("sortMemory", 0, "bytes of memory used for sorting, 0 for the default")
+var keepFirst = flag.Bool("keepFirst", false, "keep the first version of a document, rather than the highest revision")
+
+func main() {
+
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		fmt.Println("Must specify path to the new merged gouchstore file")
+		return
+	} else if flag.NArg() < 2 {
+		fmt.Println("Must specify paths to the gouchstore files to merge")
+		return
+	}
+
+	options := &gouchstore.MergeOptions{
+		Sort: gouchstore.SortConfig{
+			TempDir:      *tempDir,
+			MemoryBudget: *sortMemory,
+		},
+	}
+	if *keepFirst {
+		options.Resolver = func(current, candidate *gouchstore.DocumentInfo) bool {
+			return false
+		}
+	}
+
+	err := gouchstore.MergeWithOptions(flag.Arg(0), options, flag.Args()[1:]...)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
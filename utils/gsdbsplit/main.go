@@ -0,0 +1,49 @@
+//  Copyright (c) 2014 Marty Schoch
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/mschoch/gouchstore"
+)
+
+var n = flag.Int("n", 2, "number of files to split into, by hash of the document id")
+var ranges = flag.String("ranges", "", "comma separated document ids starting each file after the first, instead of hashing")
+
+func main() {
+
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		fmt.Println("Must specify path to a gouchstore compatible file")
+		return
+	}
+	src := flag.Arg(0)
+
+	partitions := *n
+	partition := gouchstore.Partitioner(gouchstore.HashPartitioner)
+	if *ranges != "" {
+		boundaries := strings.Split(*ranges, ",")
+		partitions = len(boundaries) + 1
+		partition = gouchstore.RangePartitioner(boundaries...)
+	}
+
+	err := gouchstore.Split(src, partitions, partition)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	for i := 0; i < partitions; i++ {
+		fmt.Println(gouchstore.SplitFilename(src, i))
+	}
+}